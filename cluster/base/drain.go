@@ -0,0 +1,16 @@
+// Package base 实例下线接口定义
+package base
+
+import (
+	"context"
+)
+
+// Drainer 实例下线管理接口，集群管理器可选实现。调度器下线实例时，先将本地实例标记为下线中，
+// 其他实例感知到后接手本地实例的分区，之后本地实例再关闭session并注销，避免下线期间分区无人处理
+type Drainer interface {
+	// MarkDraining 将本地实例标记为下线中，标记后GetAllInstances返回的本地实例IsDraining为true，
+	// 并且需要触发Watch事件通知其他实例
+	MarkDraining(ctx context.Context) error
+	// UnmarkDraining 取消本地实例的下线中标记，用于下线中途取消时回滚，同样需要触发Watch事件通知其他实例
+	UnmarkDraining(ctx context.Context) error
+}
@@ -10,13 +10,56 @@ type WatchChan <-chan *WatchResponse
 const (
 	// EventTypeUnknown 未知类型
 	EventTypeUnknown EventType = 0
-	// EventTypeInsChanged 实例列表发生变化
+	// EventTypeInsChanged 实例列表发生变化，为兼容只关心该事件的使用方，
+	// 每个包含实例变化的watch响应最后都会附带一个该事件
 	EventTypeInsChanged EventType = 1
+	// EventTypeInstanceAdded 新增实例
+	EventTypeInstanceAdded EventType = 2
+	// EventTypeInstanceRemoved 实例被删除，例如注销或者心跳超时
+	EventTypeInstanceRemoved EventType = 3
+	// EventTypeInstanceUpdated 实例内容变化，例如标记为下线中或者元数据变化
+	EventTypeInstanceUpdated EventType = 4
+	// EventTypeLeaderChanged leader变化，事件中的实例为新的leader（只保证id有效），没有leader时为nil
+	EventTypeLeaderChanged EventType = 5
+	// EventTypeWatchReset 监听中断后重新建立，期间的事件可能丢失，使用方需要丢弃本地缓存的实例列表，
+	// 同一响应中随后的EventTypeInstanceAdded事件即为当前的全部实例
+	EventTypeWatchReset EventType = 6
+	// EventTypeLeaseLost 本地实例的租约失效，集群中的本地实例节点已经或者即将被删除，事件中的实例为本地实例，版本号为0。
+	// 集群管理器会尝试重新注册，成功后推送本地实例的EventTypeInstanceAdded事件（节点还没有删除时为EventTypeInstanceUpdated事件），
+	// 期间本地实例不应该继续处理分区
+	EventTypeLeaseLost EventType = 7
 )
 
+// String 事件类型名称
+func (t EventType) String() string {
+	switch t {
+	case EventTypeInsChanged:
+		return "InsChanged"
+	case EventTypeInstanceAdded:
+		return "InstanceAdded"
+	case EventTypeInstanceRemoved:
+		return "InstanceRemoved"
+	case EventTypeInstanceUpdated:
+		return "InstanceUpdated"
+	case EventTypeLeaderChanged:
+		return "LeaderChanged"
+	case EventTypeWatchReset:
+		return "WatchReset"
+	case EventTypeLeaseLost:
+		return "LeaseLost"
+	default:
+		return "Unknown"
+	}
+}
+
 // Event 事件接口
 type Event interface {
+	// GetType 获取事件类型
 	GetType() EventType
+	// GetInstance 获取事件相关的实例，EventTypeInsChanged以及EventTypeWatchReset事件为nil
+	GetInstance() Instance
+	// GetRevision 获取事件对应的集群版本号，集群管理器不支持版本号时为0
+	GetRevision() int64
 }
 
 // WatchResponse watch响应
@@ -27,20 +70,43 @@ type WatchResponse struct {
 
 // NewWatchRsp 创建一个Watch响应
 func NewWatchRsp(eventType EventType) *WatchResponse {
-	e := &dftEvent{
-		eventType: eventType,
-	}
+	return NewWatchRspWithEvents(NewEvent(eventType, nil, 0))
+}
+
+// NewWatchRspWithEvents 创建包含多个事件的Watch响应
+func NewWatchRspWithEvents(events ...Event) *WatchResponse {
 	return &WatchResponse{
-		Events: []Event{e},
+		Events: events,
+	}
+}
+
+// NewEvent 创建事件
+func NewEvent(eventType EventType, ins Instance, revision int64) Event {
+	return &dftEvent{
+		eventType: eventType,
+		instance:  ins,
+		revision:  revision,
 	}
 }
 
 // dftEvent 默认事件结构体
 type dftEvent struct {
 	eventType EventType
+	instance  Instance
+	revision  int64
 }
 
 // GetType 获取事件类型
 func (e *dftEvent) GetType() EventType {
 	return e.eventType
 }
+
+// GetInstance 获取事件相关的实例
+func (e *dftEvent) GetInstance() Instance {
+	return e.instance
+}
+
+// GetRevision 获取事件对应的集群版本号
+func (e *dftEvent) GetRevision() int64 {
+	return e.revision
+}
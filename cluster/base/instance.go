@@ -7,4 +7,8 @@ type Instance interface {
 	GetID() string
 	// IsValid 是否是有效实例
 	IsValid() bool
+	// IsDraining 是否正在下线，下线中的实例仍然是有效实例，但是不再分配分区
+	IsDraining() bool
+	// GetMetadata 获取实例元数据
+	GetMetadata() Metadata
 }
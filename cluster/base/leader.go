@@ -0,0 +1,39 @@
+// Package base 选主与集中分区分配接口定义
+package base
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotLeader 本地实例不是leader，不能发布分区分配结果
+var ErrNotLeader = errors.New("not leader")
+
+// Assignment 分区分配结果，由leader根据集群成员计算所有分区的归属后发布
+type Assignment struct {
+	// Version 分配结果版本号，每次发布递增，实例只应用比当前更新的版本
+	Version uint64 `json:"version"`
+	// Leader 发布该分配结果的实例id
+	Leader string `json:"leader"`
+	// ShardNum 分区总数
+	ShardNum uint32 `json:"shard_num"`
+	// Shards 以实例id为key的分区id列表
+	Shards map[string][]uint32 `json:"shards"`
+}
+
+// LeaderElector 选主接口，集群管理器可选实现。开启集中分配后，集群内只有leader计算所有分区的归属并发布，
+// 其他实例监听分配结果启动或者停止对应分区，避免各实例视图不一致时分区重复或者遗漏
+type LeaderElector interface {
+	// Campaign 参与选主，阻塞直到本地实例成为leader或者ctx结束。成为leader后返回的channel
+	// 会在失去leader身份（主动放弃或者租约失效）时关闭，ctx只控制等待选主的过程
+	Campaign(ctx context.Context) (<-chan struct{}, error)
+	// Resign 主动放弃leader身份，本地实例不是leader时不做任何处理
+	Resign(ctx context.Context) error
+	// PublishAssignment 发布分区分配结果，本地实例不是leader时返回ErrNotLeader，
+	// 版本号不大于已发布的版本号时返回错误
+	PublishAssignment(ctx context.Context, assignment *Assignment) error
+	// GetAssignment 获取最新发布的分配结果，尚未发布时返回nil
+	GetAssignment(ctx context.Context) (*Assignment, error)
+	// WatchAssignment 监听分配结果，已经有发布结果时调用后会主动推送一次，ctx结束或者监听中断时关闭channel
+	WatchAssignment(ctx context.Context) (<-chan *Assignment, error)
+}
@@ -0,0 +1,68 @@
+// Package base 分布式频控接口定义
+package base
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter 分桶的频控接口，每个桶在interval内最多发放一个令牌。
+// 集群管理器可选实现，实现后整个集群共享同一份频控，调度器用它控制各实例的鉴权（identify）频率，
+// 避免多个实例同时调整分区时超过机器人维度的max_concurrency限制
+type RateLimiter interface {
+	// Acquire 获取指定桶的令牌，获取不到时阻塞等待，直到获取成功或者ctx结束
+	Acquire(ctx context.Context, bucket uint32, interval time.Duration) error
+}
+
+// NewMemoryRateLimiter 创建进程内的频控，仅对当前进程生效，用于单实例部署或者集群管理器不支持频控时
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryRateLimiter{
+		next: make(map[uint32]time.Time),
+	}
+}
+
+// memoryRateLimiter 进程内的频控实现
+type memoryRateLimiter struct {
+	mu sync.Mutex
+	// next 各个桶下一个可用令牌的时间
+	next map[uint32]time.Time
+}
+
+// Acquire 预约指定桶的下一个令牌，并等待到令牌可用的时间，先到先得
+func (l *memoryRateLimiter) Acquire(ctx context.Context, bucket uint32, interval time.Duration) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[bucket]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[bucket] = at.Add(interval)
+	l.mu.Unlock()
+	if err := WaitUntil(ctx, at); err != nil {
+		// 没有使用的令牌归还给下一个请求，之后已经有其他请求预约时不能回退
+		l.mu.Lock()
+		if l.next[bucket].Equal(at.Add(interval)) {
+			l.next[bucket] = at
+		}
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// WaitUntil 等待到指定时间，ctx结束时返回错误
+func WaitUntil(ctx context.Context, at time.Time) error {
+	wait := time.Until(at)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,59 @@
+// Package base 分布式频控接口定义
+package base
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter_Acquire(t *testing.T) {
+	interval := 50 * time.Millisecond
+	l := NewMemoryRateLimiter()
+	begin := time.Now()
+	// 不同桶之间互不影响
+	for bucket := uint32(0); bucket < 3; bucket++ {
+		if err := l.Acquire(context.Background(), bucket, interval); err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+	}
+	if cost := time.Since(begin); cost >= interval {
+		t.Errorf("Acquire() different buckets cost %v, want < %v", cost, interval)
+	}
+	// 同一个桶需要间隔interval
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(context.Background(), 0, interval); err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+	}
+	if cost := time.Since(begin); cost < 2*interval {
+		t.Errorf("Acquire() same bucket cost %v, want >= %v", cost, 2*interval)
+	}
+	// ctx结束时返回错误
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Acquire(ctx, 0, interval); err != context.Canceled {
+		t.Errorf("Acquire() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMemoryRateLimiter_Acquire_canceled(t *testing.T) {
+	interval := 100 * time.Millisecond
+	l := NewMemoryRateLimiter()
+	begin := time.Now()
+	if err := l.Acquire(context.Background(), 0, interval); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	// 等待期间ctx结束，预约的令牌归还给下一个请求
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, 0, interval); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := l.Acquire(context.Background(), 0, interval); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if cost := time.Since(begin); cost >= 2*interval {
+		t.Errorf("Acquire() after canceled reservation cost %v, want < %v", cost, 2*interval)
+	}
+}
@@ -0,0 +1,22 @@
+// Package base 集群实例元数据定义
+package base
+
+import (
+	"time"
+)
+
+// Metadata 实例元数据，供调度策略等使用，各字段均为可选
+type Metadata struct {
+	// Weight 实例权重，例如按照cpu核数设置，为0表示使用默认权重
+	Weight uint32 `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// Zone 实例所在的可用区
+	Zone string `json:"zone,omitempty" yaml:"zone,omitempty"`
+	// Version 实例的构建版本
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// MaxShards 实例最多负责的分区数，为0表示不限制
+	MaxShards uint32 `json:"max_shards,omitempty" yaml:"max_shards,omitempty"`
+	// StartTime 实例启动时间
+	StartTime time.Time `json:"start_time,omitempty" yaml:"start_time,omitempty"`
+	// Labels 自定义标签
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
@@ -0,0 +1,133 @@
+// Package base 分区session存储接口定义
+package base
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Session 分区session信息，用于重新调度或者进程重启后resume，避免重新鉴权丢失中间的事件
+type Session struct {
+	// ShardID 分区id
+	ShardID uint32 `json:"shard_id"`
+	// ShardCount 分区总数，分区总数变化后session不能再resume
+	ShardCount uint32 `json:"shard_count"`
+	// SessionID gateway返回的session id
+	SessionID string `json:"session_id"`
+	// LastSeq 最近收到的事件序号
+	LastSeq uint32 `json:"last_seq"`
+}
+
+// SessionStore 分区session存储接口，集群管理器可选实现。
+// 集群共享的存储可以让分区迁移到其他实例后依然能够resume
+type SessionStore interface {
+	// LoadSession 读取分区session，不存在时返回nil
+	LoadSession(ctx context.Context, shardID uint32) (*Session, error)
+	// SaveSession 保存分区session
+	SaveSession(ctx context.Context, session *Session) error
+	// DeleteSession 删除分区session，session失效不能再resume时调用
+	DeleteSession(ctx context.Context, shardID uint32) error
+}
+
+// NewMemorySessionStore 创建进程内的session存储，仅在进程内重新调度时有效
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		sessions: make(map[uint32]Session),
+	}
+}
+
+// memorySessionStore 进程内的session存储
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[uint32]Session
+}
+
+// LoadSession 读取分区session
+func (s *memorySessionStore) LoadSession(ctx context.Context, shardID uint32) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[shardID]
+	if !ok {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// SaveSession 保存分区session
+func (s *memorySessionStore) SaveSession(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ShardID] = *session
+	return nil
+}
+
+// DeleteSession 删除分区session
+func (s *memorySessionStore) DeleteSession(ctx context.Context, shardID uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, shardID)
+	return nil
+}
+
+// NewFileSessionStore 创建基于本地文件的session存储，每个分区一个json文件，进程重启后依然有效，
+// 目录不存在时会自动创建
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+// fileSessionStore 基于本地文件的session存储
+type fileSessionStore struct {
+	dir string
+}
+
+// LoadSession 读取分区session
+func (s *fileSessionStore) LoadSession(ctx context.Context, shardID uint32) (*Session, error) {
+	data, err := ioutil.ReadFile(s.path(shardID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SaveSession 保存分区session，先写临时文件再rename，避免进程异常退出时留下不完整的文件
+func (s *fileSessionStore) SaveSession(ctx context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	path := s.path(session.ShardID)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DeleteSession 删除分区session
+func (s *fileSessionStore) DeleteSession(ctx context.Context, shardID uint32) error {
+	err := os.Remove(s.path(shardID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// path 分区session文件路径
+func (s *fileSessionStore) path(shardID uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("shard_%d.json", shardID))
+}
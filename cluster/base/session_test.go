@@ -0,0 +1,54 @@
+// Package base 分区session存储接口定义
+package base
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileSessionStore() error = %v", err)
+	}
+	tests := []struct {
+		name  string
+		store SessionStore
+	}{
+		{name: "memory", store: NewMemorySessionStore()},
+		{name: "file", store: fileStore},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.store.LoadSession(ctx, 1)
+			if err != nil || got != nil {
+				t.Fatalf("LoadSession() = %v, %v, want nil", got, err)
+			}
+			want := &Session{ShardID: 1, ShardCount: 4, SessionID: "sid", LastSeq: 10}
+			if err := tt.store.SaveSession(ctx, want); err != nil {
+				t.Fatalf("SaveSession() error = %v", err)
+			}
+			if got, err = tt.store.LoadSession(ctx, 1); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadSession() = %+v, %v, want %+v", got, err, want)
+			}
+			if err := tt.store.DeleteSession(ctx, 1); err != nil {
+				t.Fatalf("DeleteSession() error = %v", err)
+			}
+			if err := tt.store.DeleteSession(ctx, 1); err != nil {
+				t.Fatalf("DeleteSession() not exist error = %v", err)
+			}
+			if got, err = tt.store.LoadSession(ctx, 1); err != nil || got != nil {
+				t.Errorf("LoadSession() after delete = %v, %v, want nil", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+// Package base 分区归属接口定义
+package base
+
+import (
+	"context"
+)
+
+// ShardOwner 分区归属管理接口，集群管理器可选实现。调度器发现集群管理器实现了该接口时，
+// 在启动分区session前会先获取分区归属，保证同一时刻一个分区只会被一个实例消费
+type ShardOwner interface {
+	// AcquireShard 尝试获取分区归属，分区无归属或者已经归属本实例时返回true，
+	// 归属应该与本地实例的存活绑定，实例失效后自动释放
+	AcquireShard(ctx context.Context, shardID uint32) (bool, error)
+	// ReleaseShard 释放本地实例持有的分区归属，分区不属于本地实例时不做任何处理
+	ReleaseShard(ctx context.Context, shardID uint32) error
+}
@@ -76,11 +76,16 @@ func (cluster *Cluster) GetAllInstances(ctx context.Context) ([]base.Instance, e
 	return cluster.baseInsList, nil
 }
 
-// Watch 监听集群事件
+// Watch 监听集群事件，配置文件中的实例不会变化，只推送一次配置文件中的全部实例，不支持版本号
 func (cluster *Cluster) Watch(ctx context.Context) (base.WatchChan, error) {
 	// 创建一个buffer为1的channel，并往其中写入一个事件
+	events := make([]base.Event, 0, len(cluster.baseInsList)+1)
+	for _, ins := range cluster.baseInsList {
+		events = append(events, base.NewEvent(base.EventTypeInstanceAdded, ins, 0))
+	}
+	events = append(events, base.NewEvent(base.EventTypeInsChanged, nil, 0))
 	wc := make(chan *base.WatchResponse, 1)
-	wc <- base.NewWatchRsp(base.EventTypeInsChanged)
+	wc <- base.NewWatchRspWithEvents(events...)
 	return wc, nil
 }
 
@@ -6,6 +6,7 @@ package configfile
 import (
 	"context"
 	"errors"
+	"reflect"
 	"testing"
 
 	"github.com/agiledragon/gomonkey/v2"
@@ -65,3 +66,41 @@ func TestCluster_RegInstance(t *testing.T) {
 		})
 	}
 }
+
+func TestCluster_GetAllInstances_metadata(t *testing.T) {
+	cluster, err := New("./cluster_config.yaml")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	insList, err := cluster.GetAllInstances(testCtx)
+	if err != nil || len(insList) != 3 {
+		t.Fatalf("Cluster.GetAllInstances() = %v, %v", insList, err)
+	}
+	want := base.Metadata{Weight: 2, Zone: "zone-a", MaxShards: 8, Labels: map[string]string{"cores": "8"}}
+	if got := insList[0].GetMetadata(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Instance.GetMetadata() = %+v, want %+v", got, want)
+	}
+	if got := insList[1].GetMetadata(); !reflect.DeepEqual(got, base.Metadata{}) {
+		t.Errorf("Instance.GetMetadata() = %+v, want empty", got)
+	}
+}
+
+func TestCluster_Watch(t *testing.T) {
+	wc, err := testCluster.Watch(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	rsp := <-wc
+	insList, _ := testCluster.GetAllInstances(testCtx)
+	if len(rsp.Events) != len(insList)+1 {
+		t.Fatalf("Cluster.Watch() got %v events, want %v", len(rsp.Events), len(insList)+1)
+	}
+	for i, ins := range insList {
+		if ev := rsp.Events[i]; ev.GetType() != base.EventTypeInstanceAdded || ev.GetInstance() != ins {
+			t.Errorf("event %v = %v %v, want InstanceAdded %v", i, ev.GetType(), ev.GetInstance(), ins.GetID())
+		}
+	}
+	if ev := rsp.Events[len(insList)]; ev.GetType() != base.EventTypeInsChanged {
+		t.Errorf("last event = %v, want InsChanged", ev.GetType())
+	}
+}
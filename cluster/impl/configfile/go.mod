@@ -2,6 +2,8 @@ module github.com/tencent-connect/botgo-plugins/cluster/impl/configfile
 
 go 1.15
 
+replace github.com/tencent-connect/botgo-plugins/cluster/base => ../../base
+
 require (
 	github.com/agiledragon/gomonkey/v2 v2.3.1
 	github.com/tencent-connect/botgo-plugins/cluster/base v0.0.0-20211124073815-757ae5fa4913
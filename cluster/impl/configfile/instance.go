@@ -1,10 +1,18 @@
 // Package configfile 基于配置文件实现的集群实例
 package configfile
 
+import (
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
 // Instance 实例配置
 type Instance struct {
 	// ID 实例ID，需要保证唯一
 	ID string `yaml:"id"`
+	// Draining 是否正在下线，下线中的实例不再分配分区，修改配置后需要重启各实例生效
+	Draining bool `yaml:"draining"`
+	// Metadata 实例元数据，与id平铺配置，例如 weight、zone、max_shards、labels 等
+	Metadata base.Metadata `yaml:",inline"`
 }
 
 // GetID 获取实例名称
@@ -16,3 +24,13 @@ func (ins *Instance) GetID() string {
 func (ins *Instance) IsValid() bool {
 	return ins.ID != ""
 }
+
+// IsDraining 是否正在下线
+func (ins *Instance) IsDraining() bool {
+	return ins.Draining
+}
+
+// GetMetadata 获取实例元数据
+func (ins *Instance) GetMetadata() base.Metadata {
+	return ins.Metadata
+}
@@ -0,0 +1,66 @@
+// Package etcd 本文件实现etcd client的链接配置
+package etcd
+
+import (
+	"errors"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// TLSConfig etcd链接的TLS配置，证书与私钥均为PEM格式的文件路径
+type TLSConfig struct {
+	// CAFile 校验服务端证书的CA证书，为空时使用系统CA
+	CAFile string
+	// CertFile 客户端证书，etcd开启客户端证书校验（mTLS）时需要设置，需要与KeyFile同时设置
+	CertFile string
+	// KeyFile 客户端证书私钥
+	KeyFile string
+	// ServerName 校验服务端证书使用的域名，为空时使用endpoint中的地址
+	ServerName string
+}
+
+// checkTLS 检查TLS配置
+func checkTLS(cfg *TLSConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("tls cert file and key file must both be set")
+	}
+	return nil
+}
+
+// newClient 按照集群参数创建etcd client，设置了Namespace时client的所有读写与监听都限定在该前缀下
+func newClient(args *Args) (*clientv3.Client, error) {
+	cfg := clientv3.Config{
+		Endpoints:   args.EtcdEndPoints,
+		DialTimeout: args.EtcdTimeout,
+		Username:    args.Username,
+		Password:    args.Password,
+	}
+	if args.TLS != nil {
+		info := transport.TLSInfo{
+			TrustedCAFile: args.TLS.CAFile,
+			CertFile:      args.TLS.CertFile,
+			KeyFile:       args.TLS.KeyFile,
+			ServerName:    args.TLS.ServerName,
+		}
+		tlsCfg, err := info.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsCfg
+	}
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if args.Namespace != "" {
+		cli.KV = namespace.NewKV(cli.KV, args.Namespace)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, args.Namespace)
+		cli.Lease = namespace.NewLease(cli.Lease, args.Namespace)
+	}
+	return cli, nil
+}
@@ -0,0 +1,231 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// testCerts 测试用的CA、服务端与客户端证书文件
+type testCerts struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+// writeTestCerts 生成自签名CA以及由其签发的服务端与客户端证书，写入临时目录
+func writeTestCerts(t *testing.T) *testCerts {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "botgo-etcd-certs")
+	if err != nil {
+		t.Fatalf("create temp dir failed. err:%v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "botgo test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca failed. err:%v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	certs := &testCerts{ca: filepath.Join(dir, "ca.pem")}
+	writePEM(t, certs.ca, "CERTIFICATE", caDER)
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("create cert failed. err:%v", err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("marshal key failed. err:%v", err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	certs.serverCert, certs.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	certs.clientCert, certs.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return certs
+}
+
+// writePEM 将der数据以PEM格式写入文件
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("write %s failed. err:%v", file, err)
+	}
+}
+
+// startTLSTestEtcd 启动开启了客户端证书校验的内嵌etcd服务
+func startTLSTestEtcd(t *testing.T, certs *testCerts) []string {
+	t.Helper()
+	return startTestEtcdWith(t, func(cfg *embed.Config) {
+		clientURL := cfg.LCUrls[0]
+		clientURL.Scheme = "https"
+		cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+		cfg.ClientTLSInfo = transport.TLSInfo{
+			CertFile:       certs.serverCert,
+			KeyFile:        certs.serverKey,
+			TrustedCAFile:  certs.ca,
+			ClientCertAuth: true,
+		}
+	})
+}
+
+func TestCluster_tls(t *testing.T) {
+	certs := writeTestCerts(t)
+	endpoints := startTLSTestEtcd(t, certs)
+	mTLS := &TLSConfig{CAFile: certs.ca, CertFile: certs.clientCert, KeyFile: certs.clientKey}
+
+	// 开启鉴权，客户端证书的CN不是etcd用户，必须使用用户名密码
+	adminArgs := NewArgs(testClusterName, endpoints)
+	adminArgs.TLS = mTLS
+	admin, err := newClient(adminArgs)
+	if err != nil {
+		t.Fatalf("newClient() error = %v", err)
+	}
+	defer admin.Close()
+	if _, err := admin.UserAdd(testCtx, "root", "rootpw"); err != nil {
+		t.Fatalf("UserAdd() error = %v", err)
+	}
+	if _, err := admin.UserGrantRole(testCtx, "root", "root"); err != nil {
+		t.Fatalf("UserGrantRole() error = %v", err)
+	}
+	if _, err := admin.AuthEnable(testCtx); err != nil {
+		t.Fatalf("AuthEnable() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		tls      *TLSConfig
+		username string
+		password string
+		wantErr  bool
+	}{
+		{name: "mtls and auth", tls: mTLS, username: "root", password: "rootpw", wantErr: false},
+		{name: "wrong password", tls: mTLS, username: "root", password: "wrong", wantErr: true},
+		{name: "no client cert", tls: &TLSConfig{CAFile: certs.ca}, username: "root", password: "rootpw", wantErr: true},
+		{name: "no tls", username: "root", password: "rootpw", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewArgs(testClusterName, endpoints)
+			args.TLS, args.Username, args.Password = tt.tls, tt.username, tt.password
+			if !tt.wantErr {
+				// 握手失败的用例需要等待超时才返回，成功的用例开启-race时TLS握手与鉴权较慢，放宽超时
+				args.EtcdTimeout = 5 * time.Second
+			}
+			c, err := NewWithArgs(args)
+			if err != nil {
+				t.Fatalf("NewWithArgs() error = %v", err)
+			}
+			cluster := c.(*Cluster)
+			defer cluster.Close()
+			ctx, cancel := cluster.getCtx()
+			defer cancel()
+			_, err = cluster.RegInstance(ctx, "ins1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Cluster.RegInstance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer cluster.UnregInstance(testCtx)
+			all, err := cluster.GetAllInstances(testCtx)
+			if err != nil || len(all) != 1 {
+				t.Errorf("Cluster.GetAllInstances() = %v, error = %v", all, err)
+			}
+		})
+	}
+}
+
+func TestCluster_namespace(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newCluster := func(namespace string) *Cluster {
+		args := NewArgs(testClusterName, endpoints)
+		args.Namespace = namespace
+		c, err := NewWithArgs(args)
+		if err != nil {
+			t.Fatalf("NewWithArgs() error = %v", err)
+		}
+		t.Cleanup(func() { _ = c.(*Cluster).Close() })
+		return c.(*Cluster)
+	}
+	c1, c2, plain := newCluster("/ns1/"), newCluster("/ns2/"), newCluster("")
+	if _, err := c1.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	if all, err := c1.GetAllInstances(testCtx); err != nil || len(all) != 1 {
+		t.Errorf("Cluster.GetAllInstances() in namespace = %v, error = %v", all, err)
+	}
+	// 同名集群在不同的namespace下互不可见
+	for _, c := range []*Cluster{c2, plain} {
+		if all, err := c.GetAllInstances(testCtx); err != nil || len(all) != 0 {
+			t.Errorf("Cluster.GetAllInstances() in namespace %q = %v, error = %v", c.args.Namespace, all, err)
+		}
+	}
+	cli, _ := plain.getClient()
+	rsp, err := cli.Get(testCtx, "/ns1/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil || rsp.Count != 1 {
+		t.Errorf("Get() namespaced keys = %v, error = %v", rsp, err)
+	}
+	// 集群目录直接位于namespace下
+	rsp, err = cli.Get(testCtx, "/ns1/"+testClusterName+"/instances/ins1", clientv3.WithCountOnly())
+	if err != nil || rsp.Count != 1 {
+		t.Errorf("Get() namespaced instance node = %v, error = %v", rsp, err)
+	}
+}
+
+func Test_checkTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *TLSConfig
+		wantErr bool
+	}{
+		{name: "nil", cfg: nil, wantErr: false},
+		{name: "ca only", cfg: &TLSConfig{CAFile: "ca.pem"}, wantErr: false},
+		{name: "cert and key", cfg: &TLSConfig{CertFile: "c.pem", KeyFile: "k.pem"}, wantErr: false},
+		{name: "cert without key", cfg: &TLSConfig{CertFile: "c.pem"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkTLS(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("checkTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
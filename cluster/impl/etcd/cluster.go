@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tencent-connect/botgo-plugins/cluster/base"
@@ -26,6 +28,26 @@ type Args struct {
 	HBInterval time.Duration
 	// HBTimeoutCount 心跳超时次数，默认DftHBTimeoutCount
 	HBTimeoutCount int64
+	// OnFatal 后台协程发生致命错误时的回调，默认为DftOnFatal，会直接退出进程
+	OnFatal func(error)
+	// Metadata 本地实例元数据，注册时写入实例节点，StartTime为零值时使用注册时间
+	Metadata base.Metadata
+	// TLS etcd链接的TLS配置，为nil时不使用TLS，此时EtcdEndPoints需要使用http地址
+	TLS *TLSConfig
+	// Username etcd用户名，为空时不鉴权
+	Username string
+	// Password etcd密码
+	Password string
+	// Namespace etcd key前缀，集群的所有节点都会写入该前缀下，多个业务共用同一个etcd时用于隔离，例如 "/botgo/"，
+	// 不以"/"结尾时会自动补上
+	Namespace string
+	// KeyPrefix 集群节点的根目录，集群的所有节点都位于 KeyPrefix/ClusterName/ 下，为空时使用DftKeyPrefix。
+	// 设置了Namespace时为Namespace下的相对目录，为空时集群目录直接位于Namespace下，即 Namespace + ClusterName/
+	KeyPrefix string
+	// LegacyCompat 是否兼容旧版本的实例节点 clusterName_id，开启后同时写入并读取旧版本的实例节点，用于从旧版本滚动升级。
+	// 旧版本不支持Namespace，因此不能与Namespace同时设置。旧版本的key无法区分集群 bot 与 bot_2，
+	// 存在以 ClusterName_ 开头的其他集群时不能开启
+	LegacyCompat bool
 }
 
 const (
@@ -37,14 +59,38 @@ const (
 	DftHBTimeoutCount = 3
 	// DftWatchWakeInterval 默认Watch wake间隔
 	DftWatchWakeInterval = time.Second * 60
+	// DftRewatchInterval watch中断后重新建立监听的等待时间
+	DftRewatchInterval = time.Second
+	// DftKeyPrefix 默认集群节点根目录
+	DftKeyPrefix = "/botgo"
 )
 
 // Cluster ETCD版本的集群管理器
 type Cluster struct {
 	// args 集群参数
 	args Args
+	// regMu 串行化RegInstance和UnregInstance
+	regMu sync.Mutex
+	// insMu 保护localInstance
+	insMu sync.Mutex
 	// localInstance 本地实例，默认为nil，注册后赋值到此处
 	localInstance *Instance
+	// cliMu 保护cli和closed
+	cliMu sync.Mutex
+	// cli 集群共用的etcd client，第一次使用时创建，Close时关闭
+	cli *clientv3.Client
+	// closed 是否已经关闭
+	closed bool
+	// leaseMu 保护leaseLostGen和leaseLost
+	leaseMu sync.Mutex
+	// leaseLostGen 本地实例租约失效的次数，只增不减，watch协程与自己已经推送过的次数比较，不会遗漏任何时刻发生的租约失效
+	leaseLostGen uint64
+	// leaseLost 本地实例租约失效时关闭，关闭后替换为新的channel，只用于唤醒watch协程
+	leaseLost chan struct{}
+	// leaderMu 保护leader
+	leaderMu sync.Mutex
+	// leader 本地实例成为leader后的选主会话，不是leader时为nil
+	leader *leader
 }
 
 // New 创建集群管理器
@@ -57,9 +103,16 @@ func NewWithArgs(args *Args) (base.Cluster, error) {
 	if err := checkArgs(args); err != nil {
 		return nil, err
 	}
-	return &Cluster{
+	cluster := &Cluster{
 		args: *args,
-	}, nil
+	}
+	if ns := cluster.args.Namespace; ns != "" && !strings.HasSuffix(ns, "/") {
+		cluster.args.Namespace = ns + "/"
+	}
+	if cluster.args.KeyPrefix == "" && cluster.args.Namespace == "" {
+		cluster.args.KeyPrefix = DftKeyPrefix
+	}
+	return cluster, nil
 }
 
 // NewArgs 构建默认参数
@@ -73,79 +126,105 @@ func NewArgs(clusterName string, endpoints []string) *Args {
 	}
 }
 
-// RegInstance 注册实例，如果id为空，则自动使用ip作为id，完整实例名称为 clusterName_id
+// RegInstance 注册实例，如果id为空，则自动使用ip作为id，完整实例名称为 clusterName_id，实例节点key为 KeyPrefix/clusterName/instances/id
 func (cluster *Cluster) RegInstance(ctx context.Context, id string) (base.Instance, error) {
-	if cluster.localInstance != nil {
+	cluster.regMu.Lock()
+	defer cluster.regMu.Unlock()
+	if ins := cluster.getLocalInstance(); ins != nil {
 		// 已注册，直接返回
-		return cluster.localInstance, nil
+		return ins, nil
 	}
 	// 创建实例
 	ins, err := newInstance(cluster.args.ClusterName, id)
 	if err != nil {
 		return nil, err
 	}
+	ins.metadata = cluster.args.Metadata
+	if ins.metadata.StartTime.IsZero() {
+		ins.metadata.StartTime = time.Now()
+	}
 	cli, err := cluster.getClient()
 	if err != nil {
 		return nil, err
 	}
-	defer cli.Close()
 	// 创建etcd节点
-	err = putNode(ctx, cli, ins, cluster.getTTL())
+	err = cluster.putNode(ctx, cli, ins)
 	if err != nil {
 		return nil, err
 	}
-	if err = cluster.startHeartBeat(ins); err != nil {
-		return nil, err
-	}
+	cluster.startHeartBeat(cli, ins)
 	// 保存本地实例
-	cluster.localInstance = ins
+	cluster.setLocalInstance(ins)
 	return ins, nil
 }
 
 // UnregInstance 注销实例
 func (cluster *Cluster) UnregInstance(ctx context.Context) error {
-	if cluster.localInstance == nil {
+	cluster.regMu.Lock()
+	defer cluster.regMu.Unlock()
+	ins := cluster.getLocalInstance()
+	if ins == nil {
 		return nil
 	}
-	cluster.localInstance.cancel()
+	// 等待心跳协程退出后再删除节点，避免心跳在删除后重新写入节点
+	ins.cancel()
+	ins.waitHeartBeat()
+	// 注销后不能再发布分配结果，尽快让其他实例当选
+	_ = cluster.Resign(ctx)
 	cli, err := cluster.getClient()
 	if err != nil {
 		return err
 	}
-	defer cli.Close()
-	_ = delNode(ctx, cli, cluster.localInstance)
-	cluster.localInstance = nil
+	_ = cluster.delNode(ctx, cli, ins)
+	cluster.setLocalInstance(nil)
 	return nil
 }
 
+// getLocalInstance 获取本地实例，没有注册时为nil
+func (cluster *Cluster) getLocalInstance() *Instance {
+	cluster.insMu.Lock()
+	defer cluster.insMu.Unlock()
+	return cluster.localInstance
+}
+
+// setLocalInstance 设置本地实例
+func (cluster *Cluster) setLocalInstance(ins *Instance) {
+	cluster.insMu.Lock()
+	defer cluster.insMu.Unlock()
+	cluster.localInstance = ins
+}
+
 // GetAllInstances 获取所有实例的列表
 func (cluster *Cluster) GetAllInstances(ctx context.Context) ([]base.Instance, error) {
 	cli, err := cluster.getClient()
 	if err != nil {
 		return nil, err
 	}
-	defer cli.Close()
-	rsp, err := cli.Get(ctx, cluster.args.ClusterName, clientv3.WithPrefix())
-	if err != nil {
-		return nil, err
-	}
 	var instances []base.Instance
-	for _, item := range rsp.Kvs {
-		ins, err := newInstanceWithID(string(item.Key))
+	// 兼容模式下同一个实例可能同时存在新旧两个节点
+	seen := make(map[string]bool)
+	for _, prefix := range cluster.instancePrefixes() {
+		rsp, err := cli.Get(ctx, prefix, clientv3.WithPrefix())
 		if err != nil {
-			continue
+			return nil, err
+		}
+		for _, item := range rsp.Kvs {
+			if ins := cluster.kvInstance(item.Key, item.Value); ins != nil && !seen[ins.GetID()] {
+				seen[ins.GetID()] = true
+				instances = append(instances, ins)
+			}
 		}
-		instances = append(instances, ins)
 	}
 	return instances, nil
 }
 
 // GetLocalInstance 获取本地实例
 func (cluster *Cluster) GetLocalInstance(ctx context.Context) (base.Instance, error) {
-	if cluster.localInstance == nil {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
 		return nil, errors.New("no valid local interface. plz register first")
 	}
-	return cluster.localInstance, nil
+	return ins, nil
 }
 
 // Watch 监听集群事件
@@ -155,105 +234,143 @@ func (cluster *Cluster) Watch(ctx context.Context) (base.WatchChan, error) {
 		return nil, err
 	}
 	wc := make(chan *base.WatchResponse)
+	// 只推送开始监听之后发生的租约失效
+	lostGen, _ := cluster.leaseLostState()
 	go func() {
 		defer func() {
-			cli.Close()
+			// 关闭channel通知使用方watch已经结束
+			close(wc)
 			if r := recover(); r != nil {
-				buf := make([]byte, 4096)
-				buf = buf[:runtime.Stack(buf, false)]
-				fmt.Printf("[WatchChanPanic]err:%v, stack:\n%s\n", r, buf)
-				// 如果故障，则退出进程（通常不可能进入到这里）
-				os.Exit(-1)
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				cluster.fatal(panicError("WatchChanPanic", r))
 			}
 		}()
-		cluster.doWatch(ctx, cli, wc)
+		cluster.doWatch(ctx, cli, wc, lostGen)
 	}()
 	return wc, nil
 }
 
-// 启动监听，并将结果转投到watchchan
-func (cluster *Cluster) doWatch(ctx context.Context, cli *clientv3.Client, wc chan *base.WatchResponse) {
-	rch := cli.Watch(ctx, cluster.args.ClusterName, clientv3.WithPrefix())
-	// 启动watch时强制推送一次事件
-	wc <- base.NewWatchRsp(base.EventTypeInsChanged)
-	for {
-		select {
-		case rsp, ok := <-rch:
-			if !ok {
-				time.Sleep(time.Millisecond)
-				continue
-			}
-			for _, ev := range rsp.Events {
-				if ev.Type != clientv3.EventTypeDelete && ev.Type != clientv3.EventTypePut {
-					continue
-				}
-				wc <- base.NewWatchRsp(base.EventTypeInsChanged)
-				break
-			}
-		case <-ctx.Done():
-			close(wc)
-			return
-		}
-	}
-}
-
-func (cluster *Cluster) startHeartBeat(ins *Instance) error {
-	cli, err := cluster.getClient()
-	if err != nil {
-		return err
-	}
+// startHeartBeat 启动心跳协程，通过KeepAlive流为实例租约续期，租约失效后通知使用方并重新注册实例节点，直到实例注销
+func (cluster *Cluster) startHeartBeat(cli *clientv3.Client, ins *Instance) {
+	ins.hbDone = make(chan struct{})
 	go func() {
 		defer func() {
-			cli.Close()
+			close(ins.hbDone)
 			if r := recover(); r != nil {
-				buf := make([]byte, 4096)
-				buf = buf[:runtime.Stack(buf, false)]
-				fmt.Printf("[HeartBeatPanic]ins:%v, err:%v, stack:\n%s\n", ins.GetID(), r, buf)
-				// 如果故障，则退出进程（通常不可能进入到这里）
-				os.Exit(-1)
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				cluster.fatal(panicError("HeartBeatPanic:"+ins.GetID(), r))
 			}
 		}()
-		ticker := time.NewTicker(cluster.args.HBInterval)
+		// wait 重新注册前的等待时间，租约刚失效时立即重新注册，失败后按照心跳间隔重试
+		wait := time.Duration(0)
 		for {
+			if leaseID := ins.getLease(); leaseID != 0 {
+				cluster.keepAlive(cli, ins, leaseID)
+				if ins.ctx.Err() != nil {
+					return
+				}
+				log.Errorf("lease %x of %v lost", leaseID, ins.GetID())
+				ins.setLease(0)
+				cluster.notifyLeaseLost()
+				wait = 0
+			}
 			select {
-			case <-ticker.C:
-				_ = cluster.keepAlive(cli, ins)
+			case <-time.After(wait):
 			case <-ins.ctx.Done():
 				return
 			}
+			if ins.ctx.Err() != nil {
+				return
+			}
+			wait = cluster.args.HBInterval
+			// 实例注销时中断重新注册
+			ctx, cancel := context.WithTimeout(ins.ctx, cluster.args.EtcdTimeout)
+			err := cluster.putNode(ctx, cli, ins)
+			cancel()
+			if err != nil {
+				log.Errorf("re-register %v failed. err:%v", ins.GetID(), err)
+				continue
+			}
+			log.Infof("re-register %v with lease %x", ins.GetID(), ins.getLease())
 		}
 	}()
-	return nil
 }
 
-func (cluster *Cluster) getCtx() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), cluster.args.EtcdTimeout)
+// keepAlive 通过KeepAlive流为租约续期，直到租约失效（续期超时或者租约已被删除）或者实例注销后返回
+func (cluster *Cluster) keepAlive(cli *clientv3.Client, ins *Instance, leaseID clientv3.LeaseID) {
+	ch, err := cli.KeepAlive(ins.ctx, leaseID)
+	if err != nil {
+		log.Errorf("keep alive failed. err:%v", err)
+		return
+	}
+	for range ch {
+		// 续期成功的响应，不需要处理
+	}
 }
 
-// keepAlive 尝试续期，如果续期失败，则等待下次心跳调度重新创建节点
-func (cluster *Cluster) keepAlive(cli *clientv3.Client, ins *Instance) error {
-	if !ins.IsValid() {
-		return errors.New("invalid instance")
+// leaseLostState 获取本地实例租约失效的次数以及下一次失效时关闭的唤醒channel
+func (cluster *Cluster) leaseLostState() (uint64, <-chan struct{}) {
+	cluster.leaseMu.Lock()
+	defer cluster.leaseMu.Unlock()
+	if cluster.leaseLost == nil {
+		cluster.leaseLost = make(chan struct{})
 	}
-	ctx, cancel := cluster.getCtx()
-	defer cancel()
-	if ins.leaseID != 0 {
-		// 续租
-		_, err := cli.KeepAliveOnce(ctx, ins.leaseID)
-		if err != nil {
-			log.Errorf("keep alive failed. err:%v", err)
-			// 续租失败，则清除租约，等待下次keepAlive重新putNode
-			ins.leaseID = 0
-			return err
-		}
-	} else {
-		// 如果没有租约，则尝试重新put设置租约
-		if err := putNode(ctx, cli, ins, cluster.getTTL()); err != nil {
-			log.Errorf("keep alive put node failed. err:%v", err)
-			return err
-		}
+	return cluster.leaseLostGen, cluster.leaseLost
+}
+
+// notifyLeaseLost 增加租约失效次数，关闭当前的唤醒channel并替换为新的channel，通知所有watch协程租约失效
+func (cluster *Cluster) notifyLeaseLost() {
+	cluster.leaseMu.Lock()
+	defer cluster.leaseMu.Unlock()
+	cluster.leaseLostGen++
+	if cluster.leaseLost != nil {
+		close(cluster.leaseLost)
 	}
-	return nil
+	cluster.leaseLost = make(chan struct{})
+}
+
+// Close 停止心跳并关闭etcd链接，关闭后集群管理器不能再使用。
+// 没有注销的本地实例节点会在租约超时后删除，如果希望其他实例立即感知，请先调用UnregInstance
+func (cluster *Cluster) Close() error {
+	cluster.cliMu.Lock()
+	defer cluster.cliMu.Unlock()
+	if cluster.closed {
+		return nil
+	}
+	cluster.closed = true
+	if ins := cluster.getLocalInstance(); ins != nil {
+		ins.cancel()
+	}
+	if cluster.cli == nil {
+		return nil
+	}
+	return cluster.cli.Close()
+}
+
+// DftOnFatal 默认的致命错误处理，打印日志后退出进程
+func DftOnFatal(err error) {
+	log.Errorf("[Fatal]err:%v, process exit", err)
+	os.Exit(-1)
+}
+
+// fatal 上报致命错误
+func (cluster *Cluster) fatal(err error) {
+	onFatal := cluster.args.OnFatal
+	if onFatal == nil {
+		onFatal = DftOnFatal
+	}
+	onFatal(err)
+}
+
+// panicError 将recover得到的panic信息转换为错误，附带调用堆栈
+func panicError(tag string, r interface{}) error {
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	return fmt.Errorf("[%s]panic:%v, stack:\n%s", tag, r, buf)
+}
+
+func (cluster *Cluster) getCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cluster.args.EtcdTimeout)
 }
 
 // getTTL 获取ttl秒数
@@ -261,49 +378,84 @@ func (cluster *Cluster) getTTL() int64 {
 	return int64(cluster.args.HBInterval/time.Second) * cluster.args.HBTimeoutCount
 }
 
+// isClosed 集群管理器是否已经关闭
+func (cluster *Cluster) isClosed() bool {
+	cluster.cliMu.Lock()
+	defer cluster.cliMu.Unlock()
+	return cluster.closed
+}
+
+// getClient 获取集群共用的etcd client，第一次使用时创建
 func (cluster *Cluster) getClient() (*clientv3.Client, error) {
-	return clientv3.New(clientv3.Config{
-		Endpoints:   cluster.args.EtcdEndPoints,
-		DialTimeout: cluster.args.EtcdTimeout,
-	})
+	cluster.cliMu.Lock()
+	defer cluster.cliMu.Unlock()
+	if cluster.closed {
+		return nil, errors.New("cluster closed")
+	}
+	if cluster.cli == nil {
+		cli, err := newClient(&cluster.args)
+		if err != nil {
+			return nil, err
+		}
+		cluster.cli = cli
+	}
+	return cluster.cli, nil
 }
 
-func delNode(ctx context.Context, cli *clientv3.Client, ins *Instance) error {
+// delNode 删除实例节点并撤销租约
+func (cluster *Cluster) delNode(ctx context.Context, cli *clientv3.Client, ins *Instance) error {
 	if !ins.IsValid() {
 		return errors.New("invalid instance")
 	}
-	_, err := cli.Delete(ctx, ins.GetID())
-	_, _ = cli.Revoke(ctx, ins.leaseID)
+	var err error
+	for _, key := range cluster.instanceKeys(ins) {
+		if _, e := cli.Delete(ctx, key); e != nil {
+			err = e
+		}
+	}
+	_, _ = cli.Revoke(ctx, ins.getLease())
 	ins.clear()
 	return err
 }
 
-// putNode 写入etcd节点
-func putNode(ctx context.Context, cli *clientv3.Client, ins *Instance, ttl int64) error {
+// putNode 申请新的租约并写入实例节点
+func (cluster *Cluster) putNode(ctx context.Context, cli *clientv3.Client, ins *Instance) error {
 	if !ins.IsValid() {
 		return errors.New("invalid instance")
 	}
 	// 创建租约
-	rsp, err := cli.Grant(ctx, ttl)
+	rsp, err := cli.Grant(ctx, cluster.getTTL())
 	if err != nil {
 		return err
 	}
-	// 写入etcd节点，节点内容暂无实际意义，暂且写入1
-	_, err = cli.Put(ctx, ins.GetID(), "1", clientv3.WithLease(rsp.ID))
-	if err != nil {
+	if err := cluster.writeNode(ctx, cli, ins, rsp.ID); err != nil {
 		return err
 	}
-	ins.leaseID = rsp.ID
+	ins.setLease(rsp.ID)
+	return nil
+}
+
+// writeNode 使用指定租约写入实例节点，节点内容为json格式的实例状态
+func (cluster *Cluster) writeNode(ctx context.Context, cli *clientv3.Client, ins *Instance, leaseID clientv3.LeaseID) error {
+	for _, key := range cluster.instanceKeys(ins) {
+		if _, err := cli.Put(ctx, key, encodeNode(ins), clientv3.WithLease(leaseID)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func checkArgs(args *Args) error {
-	if args.ClusterName == "" {
+	if args.ClusterName == "" || strings.Contains(args.ClusterName, "/") {
 		return errors.New("invalid cluster name")
 	}
 	if len(args.EtcdEndPoints) == 0 {
 		return errors.New("invalid endpoints")
 	}
+	if args.LegacyCompat && args.Namespace != "" {
+		// 旧版本的实例节点不在namespace下，namespace内读取不到
+		return errors.New("legacy compat can not be used with namespace")
+	}
 	if args.EtcdTimeout < time.Second {
 		return fmt.Errorf("invalid etcd timeout:%v", args.EtcdTimeout)
 	}
@@ -313,5 +465,8 @@ func checkArgs(args *Args) error {
 	if args.HBTimeoutCount < DftHBTimeoutCount {
 		return fmt.Errorf("invalid heartbeat timeout count:%v", args.HBTimeoutCount)
 	}
-	return nil
+	if args.Username == "" && args.Password != "" {
+		return errors.New("password set without username")
+	}
+	return checkTLS(args.TLS)
 }
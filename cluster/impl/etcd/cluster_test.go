@@ -5,6 +5,7 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/tencent-connect/botgo-plugins/cluster/base"
@@ -46,6 +47,7 @@ func TestNew(t *testing.T) {
 					EtcdTimeout:    DftEtcdTimeout,
 					HBInterval:     DftHBInterval,
 					HBTimeoutCount: DftHBTimeoutCount,
+					KeyPrefix:      DftKeyPrefix,
 				},
 			},
 			wantErr: false,
@@ -68,8 +70,6 @@ func TestNew(t *testing.T) {
 func applyEtcd() *gomonkey.Patches {
 	return gomonkey.ApplyMethodSeq(reflect.TypeOf(clientv3.NewLease(testClientV3)), "Grant", []gomonkey.OutputCell{
 		{Values: gomonkey.Params{&clientv3.LeaseGrantResponse{}, nil}, Times: 10000},
-	}).ApplyMethodSeq(reflect.TypeOf(clientv3.NewLease(testClientV3)), "KeepAliveOnce", []gomonkey.OutputCell{
-		{Values: gomonkey.Params{nil, nil}, Times: 10000},
 	}).ApplyMethodSeq(reflect.TypeOf(clientv3.NewLease(testClientV3)), "Revoke", []gomonkey.OutputCell{
 		{Values: gomonkey.Params{nil, nil}, Times: 10000},
 	}).ApplyMethodSeq(reflect.TypeOf(clientv3.NewKV(testClientV3)), "Put", []gomonkey.OutputCell{
@@ -157,45 +157,107 @@ func TestCluster_GetLocalInstance(t *testing.T) {
 	}
 }
 
-func TestCluster_keepAlive(t *testing.T) {
-	testEtcdCluster, _ := testCluster.(*Cluster)
-	testCli, _ := testEtcdCluster.getClient()
-	testIns, _ := newInstance(testClusterName, "")
-	testIns2 := *testIns
-	testIns2.leaseID = 1
-	type args struct {
-		cli *clientv3.Client
-		ins *Instance
+func TestCluster_leaseLost(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	args := NewArgs(testClusterName, endpoints)
+	// 缩短心跳间隔，KeepAlive每隔ttl/3续期一次，续期时才能发现租约失效
+	args.HBInterval = time.Second
+	c, err := NewWithArgs(args)
+	if err != nil {
+		t.Fatalf("NewWithArgs() error = %v", err)
 	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "c1",
-			args: args{
-				cli: testCli,
-				ins: testIns,
-			},
-			wantErr: false,
-		}, {
-			name: "c2",
-			args: args{
-				cli: testCli,
-				ins: &testIns2,
-			},
-			wantErr: false,
-		},
+	cluster := c.(*Cluster)
+	defer cluster.Close()
+	ins, err := cluster.RegInstance(testCtx, "ins1")
+	if err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
 	}
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	wc, err := cluster.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	nextEvents(t, wc)
 
-	defer applyEtcd().Reset()
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := testEtcdCluster.keepAlive(tt.args.cli, tt.args.ins); (err != nil) != tt.wantErr {
-				t.Errorf("Cluster.keepAlive() error = %v, wantErr %v", err, tt.wantErr)
+	// 撤销租约模拟租约过期，心跳协程需要通知租约失效并重新注册
+	cli, _ := cluster.getClient()
+	leaseID := cluster.localInstance.getLease()
+	if _, err := cli.Revoke(testCtx, leaseID); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	want := map[base.EventType]bool{
+		base.EventTypeInstanceRemoved: true, base.EventTypeLeaseLost: true, base.EventTypeInstanceAdded: true,
+	}
+	for len(want) > 0 {
+		types, ids := nextEvents(t, wc)
+		for _, eventType := range types {
+			if eventType == base.EventTypeInstanceAdded && want[base.EventTypeLeaseLost] {
+				t.Errorf("InstanceAdded pushed before LeaseLost")
 			}
-		})
+			delete(want, eventType)
+		}
+		for _, id := range ids {
+			if id != ins.GetID() {
+				t.Errorf("got event of %v, want %v", id, ins.GetID())
+			}
+		}
+	}
+	// 实例节点写入成功后才会记录新的租约，可能晚于收到事件
+	deadline := time.Now().Add(time.Second)
+	for cluster.localInstance.getLease() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := cluster.localInstance.getLease(); got == 0 || got == leaseID {
+		t.Errorf("lease after re-register = %x, old lease %x", got, leaseID)
+	}
+
+	if err := cluster.Close(); err != nil {
+		t.Fatalf("Cluster.Close() error = %v", err)
+	}
+	if _, err := cluster.GetAllInstances(testCtx); err == nil {
+		t.Errorf("Cluster.GetAllInstances() after Close should fail")
+	}
+}
+
+func TestCluster_UnregInstance_leaseLost(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	args := NewArgs(testClusterName, endpoints)
+	args.HBInterval = time.Second
+	c, err := NewWithArgs(args)
+	if err != nil {
+		t.Fatalf("NewWithArgs() error = %v", err)
+	}
+	cluster := c.(*Cluster)
+	defer cluster.Close()
+	ins, err := cluster.RegInstance(testCtx, "ins1")
+	if err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	// 撤销租约，等待心跳协程发现租约失效，此时心跳协程会立即重新注册
+	cli, _ := cluster.getClient()
+	local := cluster.getLocalInstance()
+	if _, err := cli.Revoke(testCtx, local.getLease()); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for local.getLease() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 注销需要等待心跳协程退出，不能在删除节点后又被心跳重新写入
+	if err := cluster.UnregInstance(testCtx); err != nil {
+		t.Fatalf("Cluster.UnregInstance() error = %v", err)
+	}
+	if ins.IsValid() {
+		t.Errorf("Instance.IsValid() after UnregInstance = true")
+	}
+	rsp, err := cli.Get(testCtx, cluster.instancePrefix(), clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(rsp.Kvs) != 0 {
+		t.Errorf("instance nodes after UnregInstance = %v", rsp.Kvs)
 	}
 }
 
@@ -0,0 +1,36 @@
+// Package etcd 本文件实现实例下线管理
+package etcd
+
+import (
+	"context"
+	"errors"
+)
+
+// MarkDraining 将本地实例节点标记为下线中，节点内容变化会触发其他实例的Watch事件
+func (cluster *Cluster) MarkDraining(ctx context.Context) error {
+	return cluster.setDraining(ctx, true)
+}
+
+// UnmarkDraining 取消本地实例节点的下线中标记
+func (cluster *Cluster) UnmarkDraining(ctx context.Context) error {
+	return cluster.setDraining(ctx, false)
+}
+
+// setDraining 更新本地实例节点的下线中标记
+func (cluster *Cluster) setDraining(ctx context.Context, draining bool) error {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
+		return errors.New("no valid local instance. plz register first")
+	}
+	ins.setDraining(draining)
+	leaseID := ins.getLease()
+	if leaseID == 0 {
+		// 租约失效，只有心跳协程负责申请租约，这里只记录标记，心跳协程重新注册时会写入节点
+		return nil
+	}
+	cli, err := cluster.getClient()
+	if err != nil {
+		return err
+	}
+	return cluster.writeNode(ctx, cli, ins, leaseID)
+}
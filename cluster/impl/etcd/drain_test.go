@@ -0,0 +1,144 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCluster_MarkDraining(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	c1, err := New(testClusterName, endpoints)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := c1.(base.Drainer).MarkDraining(testCtx); err == nil {
+		t.Errorf("Cluster.MarkDraining() before register want error")
+	}
+	c2, _ := New(testClusterName, endpoints)
+	for i, c := range []base.Cluster{c1, c2} {
+		if _, err := c.RegInstance(testCtx, []string{"ins1", "ins2"}[i]); err != nil {
+			t.Fatalf("Cluster.RegInstance() error = %v", err)
+		}
+		defer c.UnregInstance(testCtx)
+	}
+
+	// 兼容旧版本写入的节点内容
+	cli, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("clientv3.New() error = %v", err)
+	}
+	defer cli.Close()
+	if _, err := cli.Put(testCtx, c2.(*Cluster).instancePrefix()+"legacy", "1"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	wc, err := c2.Watch(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	<-wc
+	if err := c1.(base.Drainer).MarkDraining(testCtx); err != nil {
+		t.Fatalf("Cluster.MarkDraining() error = %v", err)
+	}
+	select {
+	case <-wc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cluster.MarkDraining() did not trigger watch event")
+	}
+	all, err := c2.GetAllInstances(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.GetAllInstances() error = %v", err)
+	}
+	draining := map[string]bool{}
+	for _, ins := range all {
+		draining[ins.GetID()] = ins.IsDraining()
+	}
+	want := map[string]bool{
+		testClusterName + "_ins1":   true,
+		testClusterName + "_ins2":   false,
+		testClusterName + "_legacy": false,
+	}
+	for id, w := range want {
+		if got, ok := draining[id]; !ok || got != w {
+			t.Errorf("Cluster.GetAllInstances() %v draining = %v, %v, want %v", id, got, ok, w)
+		}
+	}
+
+	// 取消下线中标记
+	if err := c1.(base.Drainer).UnmarkDraining(testCtx); err != nil {
+		t.Fatalf("Cluster.UnmarkDraining() error = %v", err)
+	}
+	select {
+	case <-wc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cluster.UnmarkDraining() did not trigger watch event")
+	}
+	all, err = c2.GetAllInstances(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.GetAllInstances() error = %v", err)
+	}
+	for _, ins := range all {
+		if ins.IsDraining() {
+			t.Errorf("Cluster.UnmarkDraining() %v still draining", ins.GetID())
+		}
+	}
+}
+
+func TestCluster_MarkDraining_leaseLost(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	args := NewArgs(testClusterName, endpoints)
+	args.HBInterval = time.Second
+	c, err := NewWithArgs(args)
+	if err != nil {
+		t.Fatalf("NewWithArgs() error = %v", err)
+	}
+	cluster := c.(*Cluster)
+	defer cluster.Close()
+	if _, err := cluster.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	defer cluster.UnregInstance(testCtx)
+	cli, _ := cluster.getClient()
+	ins := cluster.getLocalInstance()
+	leaseID := ins.getLease()
+	isDraining := func() bool {
+		rsp, err := cli.Get(testCtx, cluster.instancePrefix()+"ins1")
+		if err != nil || len(rsp.Kvs) != 1 {
+			t.Fatalf("Get() instance node = %v, error = %v", rsp, err)
+		}
+		node := &Instance{}
+		decodeNode(node, rsp.Kvs[0].Value)
+		return node.IsDraining()
+	}
+
+	// 租约失效期间只记录标记，不能另外申请租约，否则节点会绑定到没有续期的租约上
+	ins.setLease(0)
+	if err := cluster.MarkDraining(testCtx); err != nil {
+		t.Fatalf("Cluster.MarkDraining() error = %v", err)
+	}
+	if got := ins.getLease(); got != 0 {
+		t.Errorf("Cluster.MarkDraining() granted lease %x while lease lost", got)
+	}
+	if isDraining() {
+		t.Errorf("Cluster.MarkDraining() wrote node while lease lost")
+	}
+
+	// 心跳协程重新注册时写入标记
+	ins.setLease(leaseID)
+	if _, err := cli.Revoke(testCtx, leaseID); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if lease := ins.getLease(); lease != 0 && lease != leaseID {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !isDraining() {
+		t.Errorf("instance node after re-register is not draining")
+	}
+}
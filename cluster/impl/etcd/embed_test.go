@@ -0,0 +1,58 @@
+package etcd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startTestEtcd 启动一个用于测试的内嵌etcd服务，返回client访问地址
+func startTestEtcd(t *testing.T) []string {
+	t.Helper()
+	return startTestEtcdWith(t, nil)
+}
+
+// startTestEtcdWith 启动一个用于测试的内嵌etcd服务，setup不为nil时可以在启动前修改配置，返回client访问地址
+func startTestEtcdWith(t *testing.T, setup func(cfg *embed.Config)) []string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "botgo-etcd")
+	if err != nil {
+		t.Fatalf("create temp dir failed. err:%v", err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	if setup != nil {
+		setup(cfg)
+	}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd failed. err:%v", err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		_ = os.RemoveAll(dir)
+	})
+	<-e.Server.ReadyNotify()
+	return []string{cfg.ACUrls[0].String()}
+}
+
+// freeURL 获取一个本地可用端口的url
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed. err:%v", err)
+	}
+	defer l.Close()
+	u, _ := url.Parse(fmt.Sprintf("http://%s", l.Addr().String()))
+	return *u
+}
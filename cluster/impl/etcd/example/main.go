@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -21,9 +22,19 @@ var (
 	}
 )
 
+// TODO etcd开启了TLS或者鉴权时在这里填写证书与账号，开启TLS时endpoints需要使用https地址，不需要的配置置空即可
+var (
+	caFile    = ""
+	certFile  = ""
+	keyFile   = ""
+	username  = ""
+	password  = ""
+	namespace = ""
+)
+
 func main() {
 	fmt.Printf("start\n")
-	cluster, err := etcd.New(clusterName, endpoints)
+	cluster, err := etcd.NewWithArgs(newArgs())
 	if err != nil {
 		fmt.Printf("new cluster failed. err:%v\n", err)
 		return
@@ -43,6 +54,20 @@ func main() {
 	waitExit(cluster)
 }
 
+func newArgs() *etcd.Args {
+	args := etcd.NewArgs(clusterName, endpoints)
+	if caFile != "" || certFile != "" {
+		args.TLS = &etcd.TLSConfig{
+			CAFile:   caFile,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		}
+	}
+	args.Username, args.Password = username, password
+	args.Namespace = namespace
+	return args
+}
+
 func startWatch(cluster base.Cluster) {
 	go func() {
 		defer func() {
@@ -64,7 +89,10 @@ func startWatch(cluster base.Cluster) {
 				return
 			}
 			for _, e := range wr.Events {
-				fmt.Printf("got event type:%v\n", e.GetType())
+				fmt.Printf("got event type:%v, revision:%v\n", e.GetType(), e.GetRevision())
+				if ins := e.GetInstance(); ins != nil {
+					fmt.Printf("event instance:%v, draining:%v\n", ins.GetID(), ins.IsDraining())
+				}
 				if e.GetType() == base.EventTypeInsChanged {
 					getAllInstance(cluster)
 				}
@@ -97,4 +125,8 @@ func waitExit(cluster base.Cluster) {
 	// 为了避免服务重启频繁触发集群重新调度，这里反注册也可以去掉，只依赖实例超时来删除实例
 	// 这样如果实例能够快速重启，那么其他实例甚至感觉不出来集群变化，避免了频发调度
 	_ = cluster.UnregInstance(ctx)
+	// 关闭etcd链接
+	if closer, ok := cluster.(io.Closer); ok {
+		_ = closer.Close()
+	}
 }
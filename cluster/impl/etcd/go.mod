@@ -2,10 +2,14 @@ module github.com/tencent-connect/botgo-plugins/cluster/impl/etcd
 
 go 1.15
 
+replace github.com/tencent-connect/botgo-plugins/cluster/base => ../../base
+
 require (
 	github.com/agiledragon/gomonkey/v2 v2.3.1
 	github.com/tencent-connect/botgo v0.0.0-20211122124126-a4936f507e42
 	github.com/tencent-connect/botgo-plugins/cluster/base v0.0.0-20211124073815-757ae5fa4913
 	go.etcd.io/etcd/api/v3 v3.5.1
+	go.etcd.io/etcd/client/pkg/v3 v3.5.1
 	go.etcd.io/etcd/client/v3 v3.5.1
+	go.etcd.io/etcd/server/v3 v3.5.1
 )
@@ -2,7 +2,9 @@ package etcd
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"sync"
 
 	"github.com/tencent-connect/botgo-plugins/cluster/base"
 	clientv3 "go.etcd.io/etcd/client/v3"
@@ -10,14 +12,24 @@ import (
 
 // Instance 实例，以id作为唯一标识
 type Instance struct {
+	// mu 保护id、draining和metadata，心跳协程写入节点时会读取，注销和标记下线时会修改
+	mu sync.RWMutex
 	// 实例id，需要保证唯一
 	id string
 	// ctx 生命周期控制ctx
 	ctx context.Context
 	// ctxCancel 用于反注册时销毁ctx
 	ctxCancel context.CancelFunc
-	// leaseID 租约id，用于keepalive
+	// hbDone 心跳协程退出后关闭，没有启动心跳时为nil
+	hbDone chan struct{}
+	// leaseMu 保护leaseID，心跳协程会在租约失效后重新申请租约
+	leaseMu sync.Mutex
+	// leaseID 租约id，用于keepalive，租约失效后为0
 	leaseID clientv3.LeaseID
+	// draining 是否正在下线
+	draining bool
+	// metadata 实例元数据
+	metadata base.Metadata
 }
 
 // newInstanceWithID 返回instance
@@ -54,12 +66,35 @@ func newInstance(clusterName string, id string) (*Instance, error) {
 
 // GetID 获取实例ID
 func (ins *Instance) GetID() string {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
 	return ins.id
 }
 
 // IsValid 是否是有效实例
 func (ins *Instance) IsValid() bool {
-	return ins.id != ""
+	return ins.GetID() != ""
+}
+
+// IsDraining 是否正在下线
+func (ins *Instance) IsDraining() bool {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	return ins.draining
+}
+
+// setDraining 设置是否正在下线
+func (ins *Instance) setDraining(draining bool) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.draining = draining
+}
+
+// GetMetadata 获取实例元数据
+func (ins *Instance) GetMetadata() base.Metadata {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	return ins.metadata
 }
 
 // cancel 停止
@@ -67,8 +102,67 @@ func (ins *Instance) cancel() {
 	ins.ctxCancel()
 }
 
+// waitHeartBeat 等待心跳协程退出，需要先调用cancel
+func (ins *Instance) waitHeartBeat() {
+	if ins.hbDone != nil {
+		<-ins.hbDone
+	}
+}
+
 // clear 清理ins
 func (ins *Instance) clear() {
+	ins.mu.Lock()
 	ins.id = ""
-	ins.leaseID = 0
+	ins.mu.Unlock()
+	ins.setLease(0)
+}
+
+// getLease 获取当前租约id
+func (ins *Instance) getLease() clientv3.LeaseID {
+	ins.leaseMu.Lock()
+	defer ins.leaseMu.Unlock()
+	return ins.leaseID
+}
+
+// setLease 设置当前租约id
+func (ins *Instance) setLease(leaseID clientv3.LeaseID) {
+	ins.leaseMu.Lock()
+	defer ins.leaseMu.Unlock()
+	ins.leaseID = leaseID
+}
+
+// nodeValue 实例节点内容
+type nodeValue struct {
+	// State 实例状态，为空表示正常，draining表示下线中
+	State string `json:"state,omitempty"`
+	// Metadata 实例元数据
+	Metadata base.Metadata `json:"metadata"`
+}
+
+// nodeStateDraining 下线中的实例状态
+const nodeStateDraining = "draining"
+
+// encodeNode 将实例信息编码为节点内容
+func encodeNode(ins *Instance) string {
+	ins.mu.RLock()
+	v := nodeValue{Metadata: ins.metadata}
+	if ins.draining {
+		v.State = nodeStateDraining
+	}
+	ins.mu.RUnlock()
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// decodeNode 从节点内容中解析实例信息，兼容旧版本写入的"1"
+func decodeNode(ins *Instance, value []byte) {
+	v := nodeValue{}
+	if err := json.Unmarshal(value, &v); err != nil {
+		// 旧版本节点内容没有实际意义，按照正常实例处理
+		return
+	}
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.draining = v.State == nodeStateDraining
+	ins.metadata = v.Metadata
 }
@@ -3,6 +3,9 @@ package etcd
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
 )
 
 var (
@@ -76,3 +79,53 @@ func Test_newInstance(t *testing.T) {
 		})
 	}
 }
+
+func Test_decodeNode(t *testing.T) {
+	metadata := base.Metadata{
+		Weight:    2,
+		Zone:      "zone-a",
+		MaxShards: 8,
+		StartTime: time.Unix(1640000000, 0).UTC(),
+		Labels:    map[string]string{"cores": "8"},
+	}
+	tests := []struct {
+		name  string
+		value string
+		want  *Instance
+	}{
+		{name: "legacy", value: "1", want: &Instance{}},
+		{name: "draining", value: `{"state":"draining"}`, want: &Instance{draining: true}},
+		{name: "metadata", value: encodeNode(&Instance{metadata: metadata}), want: &Instance{metadata: metadata}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := &Instance{}
+			decodeNode(got, []byte(tt.value))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeNode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCluster_metadata(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	args := NewArgs(testClusterName, endpoints)
+	args.Metadata = base.Metadata{Weight: 4, Version: "v1.0.0"}
+	c, err := NewWithArgs(args)
+	if err != nil {
+		t.Fatalf("NewWithArgs() error = %v", err)
+	}
+	if _, err := c.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	defer c.UnregInstance(testCtx)
+	all, err := c.GetAllInstances(testCtx)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("Cluster.GetAllInstances() = %v, %v", all, err)
+	}
+	got := all[0].GetMetadata()
+	if got.Weight != 4 || got.Version != "v1.0.0" || got.StartTime.IsZero() {
+		t.Errorf("Instance.GetMetadata() = %+v", got)
+	}
+}
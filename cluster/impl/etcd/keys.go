@@ -0,0 +1,103 @@
+// Package etcd 本文件定义集群在etcd中使用的key
+package etcd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 集群的所有节点都位于 KeyPrefix/ClusterName/ 下（设置了Namespace时KeyPrefix为其下的相对目录），按照子系统划分目录：
+//   instances/<id>   实例节点，id为注册时指定的实例id（默认为ip）
+//   shards/<分区id>  分区归属节点
+//   limiter/<桶id>   频控桶节点
+//   sessions/<分区id> 分区session节点
+//   election/        选主节点
+//   assignment       分区分配结果节点
+// 旧版本的实例节点key为 clusterName_id，开启 Args.LegacyCompat 时同时读写
+
+// clusterPrefix 集群根目录，以"/"结尾。设置了Namespace时client会为所有key加上Namespace（以"/"结尾），
+// 这里返回相对目录，避免出现 "/botgo//botgo/" 这样重复的前缀
+func (cluster *Cluster) clusterPrefix() string {
+	prefix := cluster.args.ClusterName + "/"
+	if root := strings.Trim(cluster.args.KeyPrefix, "/"); root != "" {
+		prefix = root + "/" + prefix
+	}
+	if cluster.args.Namespace != "" {
+		return prefix
+	}
+	return "/" + prefix
+}
+
+// instancePrefix 实例节点key前缀
+func (cluster *Cluster) instancePrefix() string {
+	return cluster.clusterPrefix() + "instances/"
+}
+
+// legacyInstancePrefix 旧版本实例节点key前缀，旧版本实例节点key为 clusterName_id，即实例的完整id
+func (cluster *Cluster) legacyInstancePrefix() string {
+	return cluster.args.ClusterName + "_"
+}
+
+// instancePrefixes 需要读取与监听的实例节点key前缀，开启兼容模式时包括旧版本的前缀
+func (cluster *Cluster) instancePrefixes() []string {
+	if cluster.args.LegacyCompat {
+		return []string{cluster.instancePrefix(), cluster.legacyInstancePrefix()}
+	}
+	return []string{cluster.instancePrefix()}
+}
+
+// instanceKeys 实例需要写入的节点key，开启兼容模式时同时写入旧版本的节点，让旧版本实例也能感知
+func (cluster *Cluster) instanceKeys(ins *Instance) []string {
+	id := strings.TrimPrefix(ins.GetID(), cluster.legacyInstancePrefix())
+	keys := []string{cluster.instancePrefix() + id}
+	if cluster.args.LegacyCompat {
+		keys = append(keys, ins.GetID())
+	}
+	return keys
+}
+
+// keyInstanceID 根据实例节点key获取实例的完整id（clusterName_id），不是实例节点时返回空字符串。
+// 旧版本的key中集群名称与实例id之间只有"_"分隔，无法区分集群 bot 的实例 2_ins1 与集群 bot_2 的实例 ins1，
+// 因此兼容模式只能用于没有其他集群名称以 clusterName_ 开头的场景
+func (cluster *Cluster) keyInstanceID(key string) string {
+	if strings.HasPrefix(key, cluster.instancePrefix()) {
+		id := strings.TrimPrefix(key, cluster.instancePrefix())
+		if id == "" || strings.Contains(id, "/") {
+			return ""
+		}
+		return cluster.legacyInstancePrefix() + id
+	}
+	if cluster.args.LegacyCompat && strings.HasPrefix(key, cluster.legacyInstancePrefix()) {
+		id := strings.TrimPrefix(key, cluster.legacyInstancePrefix())
+		if id == "" || strings.Contains(id, "/") {
+			return ""
+		}
+		return key
+	}
+	return ""
+}
+
+// shardKey 分区归属节点key
+func (cluster *Cluster) shardKey(shardID uint32) string {
+	return fmt.Sprintf("%sshards/%d", cluster.clusterPrefix(), shardID)
+}
+
+// limiterKey 频控桶节点key，节点内容为该桶下一个可用令牌的时间
+func (cluster *Cluster) limiterKey(bucket uint32) string {
+	return fmt.Sprintf("%slimiter/%d", cluster.clusterPrefix(), bucket)
+}
+
+// sessionKey 分区session节点key，节点内容为json格式的base.Session
+func (cluster *Cluster) sessionKey(shardID uint32) string {
+	return fmt.Sprintf("%ssessions/%d", cluster.clusterPrefix(), shardID)
+}
+
+// electionPrefix 选主节点key前缀，各实例在该前缀下创建绑定租约的节点，创建版本最小的为leader
+func (cluster *Cluster) electionPrefix() string {
+	return cluster.clusterPrefix() + "election"
+}
+
+// assignmentKey 分区分配结果节点key，节点内容为json格式的base.Assignment
+func (cluster *Cluster) assignmentKey() string {
+	return cluster.clusterPrefix() + "assignment"
+}
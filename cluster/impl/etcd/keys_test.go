@@ -0,0 +1,196 @@
+package etcd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCluster_keyInstanceID(t *testing.T) {
+	newCluster := func(compat bool) *Cluster {
+		args := NewArgs("bot", testEndPoints)
+		args.LegacyCompat = compat
+		c, _ := NewWithArgs(args)
+		return c.(*Cluster)
+	}
+	tests := []struct {
+		name   string
+		compat bool
+		key    string
+		want   string
+	}{
+		{name: "instance", key: "/botgo/bot/instances/ins1", want: "bot_ins1"},
+		{name: "other cluster", key: "/botgo/bot2/instances/ins1", want: ""},
+		{name: "other subsystem", key: "/botgo/bot/shards/1", want: ""},
+		{name: "nested", key: "/botgo/bot/instances/ins1/x", want: ""},
+		{name: "legacy ignored", key: "bot_ins1", want: ""},
+		{name: "legacy compat", compat: true, key: "bot_ins1", want: "bot_ins1"},
+		{name: "legacy empty id", compat: true, key: "bot_", want: ""},
+		{name: "legacy nested", compat: true, key: "bot_ins1/x", want: ""},
+		{name: "legacy other cluster", compat: true, key: "bot2_ins1", want: ""},
+		// 旧版本的key无法区分集群 bot 的实例 2_ins1 与集群 bot_2 的实例 ins1，因此文档要求这种情况下不能开启兼容模式
+		{name: "legacy ambiguous", compat: true, key: "bot_2_ins1", want: "bot_2_ins1"},
+		{name: "instance compat", compat: true, key: "/botgo/bot/instances/ins1", want: "bot_ins1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newCluster(tt.compat).keyInstanceID(tt.key); got != tt.want {
+				t.Errorf("Cluster.keyInstanceID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCluster_instanceKeys(t *testing.T) {
+	ins := &Instance{id: "bot_ins1"}
+	tests := []struct {
+		name   string
+		prefix string
+		compat bool
+		want   []string
+	}{
+		{name: "default", prefix: DftKeyPrefix, want: []string{"/botgo/bot/instances/ins1"}},
+		{name: "empty prefix", prefix: "", want: []string{"/botgo/bot/instances/ins1"}},
+		{name: "trailing slash", prefix: "/app/", want: []string{"/app/bot/instances/ins1"}},
+		{name: "compat", prefix: DftKeyPrefix, compat: true, want: []string{"/botgo/bot/instances/ins1", "bot_ins1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewArgs("bot", testEndPoints)
+			args.KeyPrefix, args.LegacyCompat = tt.prefix, tt.compat
+			c, _ := NewWithArgs(args)
+			got := c.(*Cluster).instanceKeys(ins)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Cluster.instanceKeys() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Cluster.instanceKeys() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCluster_clusterPrefix(t *testing.T) {
+	tests := []struct {
+		name          string
+		namespace     string
+		prefix        string
+		compat        bool
+		want          string
+		wantNamespace string
+		wantErr       bool
+	}{
+		{name: "default", want: "/botgo/bot/"},
+		{name: "trailing slash", prefix: "/app/", want: "/app/bot/"},
+		// 设置了Namespace时KeyPrefix为相对目录，不会与Namespace叠加出重复的前缀
+		{name: "namespace", namespace: "/botgo/", want: "bot/", wantNamespace: "/botgo/"},
+		{name: "namespace without slash", namespace: "/botgo", prefix: "/app", want: "app/bot/", wantNamespace: "/botgo/"},
+		{name: "namespace with legacy compat", namespace: "/botgo/", compat: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := NewArgs("bot", testEndPoints)
+			args.Namespace, args.KeyPrefix, args.LegacyCompat = tt.namespace, tt.prefix, tt.compat
+			c, err := NewWithArgs(args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewWithArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			cluster := c.(*Cluster)
+			if got := cluster.clusterPrefix(); got != tt.want {
+				t.Errorf("Cluster.clusterPrefix() = %v, want %v", got, tt.want)
+			}
+			if got := cluster.args.Namespace; got != tt.wantNamespace {
+				t.Errorf("Cluster namespace = %v, want %v", got, tt.wantNamespace)
+			}
+		})
+	}
+}
+
+func TestCluster_legacyCompat(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newCluster := func(name string, compat bool) *Cluster {
+		args := NewArgs(name, endpoints)
+		args.LegacyCompat = compat
+		c, err := NewWithArgs(args)
+		if err != nil {
+			t.Fatalf("NewWithArgs() error = %v", err)
+		}
+		t.Cleanup(func() { _ = c.(*Cluster).Close() })
+		return c.(*Cluster)
+	}
+	compat, upgraded := newCluster("bot", true), newCluster("bot", false)
+	// 其他集群名称以本集群名称开头，新布局下互不可见
+	other := newCluster("bot2", false)
+	if _, err := other.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	// 旧版本实例只写入 clusterName_id
+	cli, _ := compat.getClient()
+	if _, err := cli.Put(testCtx, "bot_old", "1"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	wc, err := compat.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	if types, ids := nextEvents(t, wc); !sameEvents(types,
+		[]base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged}, ids, []string{"bot_old"}) {
+		t.Errorf("snapshot events = %v %v", types, ids)
+	}
+
+	// 兼容模式的实例同时写入新旧两个节点，只推送一次新增事件
+	if _, err := compat.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	if rsp, err := cli.Get(testCtx, "bot_ins1"); err != nil || len(rsp.Kvs) != 1 {
+		t.Errorf("legacy node of compat instance = %v, error = %v", rsp, err)
+	}
+	if types, ids := nextEvents(t, wc); !sameEvents(types,
+		[]base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged}, ids, []string{"bot_ins1"}) {
+		t.Errorf("register events = %v %v", types, ids)
+	}
+	if _, err := upgraded.RegInstance(testCtx, "ins2"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	nextEvents(t, wc)
+
+	want := map[base.Cluster][]string{
+		compat:   {"bot_ins1", "bot_ins2", "bot_old"},
+		upgraded: {"bot_ins1", "bot_ins2"},
+		other:    {"bot2_ins1"},
+	}
+	for c, wantIDs := range want {
+		all, err := c.GetAllInstances(testCtx)
+		if err != nil {
+			t.Fatalf("Cluster.GetAllInstances() error = %v", err)
+		}
+		var ids []string
+		for _, ins := range all {
+			ids = append(ids, ins.GetID())
+		}
+		if !sameEvents(nil, nil, ids, wantIDs) {
+			t.Errorf("Cluster.GetAllInstances() of %v = %v, want %v", c.(*Cluster).args.ClusterName, ids, wantIDs)
+		}
+	}
+
+	// 两个节点都删除后才推送删除事件
+	if err := compat.UnregInstance(testCtx); err != nil {
+		t.Fatalf("Cluster.UnregInstance() error = %v", err)
+	}
+	if types, ids := nextEvents(t, wc); !sameEvents(types,
+		[]base.EventType{base.EventTypeInstanceRemoved, base.EventTypeInsChanged}, ids, []string{"bot_ins1"}) {
+		t.Errorf("unregister events = %v %v", types, ids)
+	}
+	if rsp, err := cli.Get(testCtx, "bot_ins1", clientv3.WithCountOnly()); err != nil || rsp.Count != 0 {
+		t.Errorf("legacy node after unregister = %v, error = %v", rsp, err)
+	}
+}
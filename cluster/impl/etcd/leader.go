@@ -0,0 +1,261 @@
+// Package etcd 本文件实现基于etcd选主的集中分区分配
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// leader 本地实例成为leader后持有的选主会话
+type leader struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+// Campaign 参与选主，选主节点绑定独立的会话租约，租约ttl与实例节点相同，进程退出或者心跳超时后自动失去leader身份
+func (cluster *Cluster) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
+		return nil, errors.New("no valid local instance. plz register first")
+	}
+	cluster.leaderMu.Lock()
+	isLeader := cluster.leader != nil
+	cluster.leaderMu.Unlock()
+	if isLeader {
+		return nil, errors.New("already leader")
+	}
+	cli, err := cluster.getClient()
+	if err != nil {
+		return nil, err
+	}
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(int(cluster.getTTL())))
+	if err != nil {
+		return nil, err
+	}
+	election := concurrency.NewElection(session, cluster.electionPrefix())
+	if err := election.Campaign(ctx, ins.GetID()); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	l := &leader{session: session, election: election}
+	cluster.leaderMu.Lock()
+	cluster.leader = l
+	cluster.leaderMu.Unlock()
+
+	lost := make(chan struct{})
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				cluster.fatal(panicError("LeaderSessionPanic", r))
+			}
+		}()
+		// 主动放弃或者租约失效后会话结束
+		<-session.Done()
+		cluster.leaderMu.Lock()
+		if cluster.leader == l {
+			cluster.leader = nil
+		}
+		cluster.leaderMu.Unlock()
+		close(lost)
+	}()
+	return lost, nil
+}
+
+// Resign 放弃leader身份，删除选主节点并关闭会话，其他实例可以立即当选
+func (cluster *Cluster) Resign(ctx context.Context) error {
+	cluster.leaderMu.Lock()
+	l := cluster.leader
+	cluster.leaderMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	err := l.election.Resign(ctx)
+	// 关闭会话会撤销租约，即使上面删除选主节点失败也能让出leader身份
+	_ = l.session.Close()
+	return err
+}
+
+// PublishAssignment 发布分区分配结果，通过事务确认本地实例的选主节点仍然存在，避免已经失去leader身份的实例覆盖新leader的结果
+func (cluster *Cluster) PublishAssignment(ctx context.Context, assignment *base.Assignment) error {
+	cluster.leaderMu.Lock()
+	l := cluster.leader
+	cluster.leaderMu.Unlock()
+	if l == nil {
+		return base.ErrNotLeader
+	}
+	data, err := json.Marshal(assignment)
+	if err != nil {
+		return err
+	}
+	key := cluster.assignmentKey()
+	rsp, err := l.session.Client().Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	modRevision := int64(0)
+	if len(rsp.Kvs) > 0 {
+		cur, err := decodeAssignment(rsp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		if assignment.Version <= cur.Version {
+			return fmt.Errorf("stale assignment version:%v, published:%v", assignment.Version, cur.Version)
+		}
+		modRevision = rsp.Kvs[0].ModRevision
+	}
+	txnRsp, err := l.session.Client().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(l.election.Key()), "=", l.election.Rev()),
+			clientv3.Compare(clientv3.ModRevision(key), "=", modRevision),
+		).
+		Then(clientv3.OpPut(key, string(data))).
+		Else(clientv3.OpGet(l.election.Key())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if txnRsp.Succeeded {
+		return nil
+	}
+	kvs := txnRsp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) == 0 || kvs[0].CreateRevision != l.election.Rev() {
+		return base.ErrNotLeader
+	}
+	return errors.New("assignment changed concurrently")
+}
+
+// GetAssignment 获取最新发布的分配结果
+func (cluster *Cluster) GetAssignment(ctx context.Context) (*base.Assignment, error) {
+	cli, err := cluster.getClient()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := cli.Get(ctx, cluster.assignmentKey())
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return nil, nil
+	}
+	return decodeAssignment(rsp.Kvs[0].Value)
+}
+
+// WatchAssignment 监听分配结果节点，先推送当前的分配结果，再从读取时的版本开始监听后续变化，ctx结束时关闭channel
+func (cluster *Cluster) WatchAssignment(ctx context.Context) (<-chan *base.Assignment, error) {
+	cli, err := cluster.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ac := make(chan *base.Assignment)
+	go func() {
+		defer func() {
+			// 关闭channel通知使用方watch已经结束
+			close(ac)
+			if r := recover(); r != nil {
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				cluster.fatal(panicError("WatchAssignmentPanic", r))
+			}
+		}()
+		cluster.doWatchAssignment(ctx, cli, ac)
+	}()
+	return ac, nil
+}
+
+// doWatchAssignment 监听分配结果并转投到ac。先推送当前的分配结果，再从读取时的版本开始监听后续变化；
+// 监听中断后从已经推送到的版本之后重新监听，需要的版本已经被压缩时重新推送当前的分配结果。ctx结束或者集群管理器关闭时返回
+func (cluster *Cluster) doWatchAssignment(ctx context.Context, cli *clientv3.Client, ac chan *base.Assignment) {
+	rev := int64(0)
+	for {
+		if rev == 0 {
+			var err error
+			if rev, err = cluster.pushAssignment(ctx, cli, ac); err != nil {
+				if ctx.Err() != nil || cluster.isClosed() {
+					return
+				}
+				log.Errorf("watch assignment get failed, retry later. err:%v", err)
+				if !waitRewatch(ctx) {
+					return
+				}
+				continue
+			}
+		}
+		switch cluster.watchAssignmentFrom(ctx, cli, ac, &rev) {
+		case watchStop:
+			return
+		case watchRelist:
+			rev = 0
+			continue
+		}
+		if !waitRewatch(ctx) {
+			return
+		}
+	}
+}
+
+// pushAssignment 读取并推送当前的分配结果，返回读取时的版本号
+func (cluster *Cluster) pushAssignment(ctx context.Context, cli *clientv3.Client, ac chan *base.Assignment) (int64, error) {
+	rsp, err := cli.Get(ctx, cluster.assignmentKey())
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp.Kvs) > 0 {
+		if assignment, err := decodeAssignment(rsp.Kvs[0].Value); err == nil {
+			select {
+			case ac <- assignment:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+	}
+	return rsp.Header.GetRevision(), nil
+}
+
+// watchAssignmentFrom 从rev之后监听分配结果节点，推送分配结果的同时更新rev，返回中断后的处理方式
+func (cluster *Cluster) watchAssignmentFrom(ctx context.Context, cli *clientv3.Client,
+	ac chan *base.Assignment, rev *int64) watchResult {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rch := cli.Watch(wctx, cluster.assignmentKey(), clientv3.WithRev(*rev+1), clientv3.WithProgressNotify())
+	for {
+		select {
+		case wrsp, ok := <-rch:
+			if !ok || wrsp.Err() != nil {
+				return cluster.watchInterrupted(ctx, wrsp, ok)
+			}
+			for _, ev := range wrsp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				assignment, err := decodeAssignment(ev.Kv.Value)
+				if err != nil {
+					continue
+				}
+				select {
+				case ac <- assignment:
+				case <-ctx.Done():
+					return watchStop
+				}
+			}
+			*rev = watchedRevision(wrsp, *rev)
+		case <-ctx.Done():
+			return watchStop
+		}
+	}
+}
+
+// decodeAssignment 解析分配结果节点内容
+func decodeAssignment(value []byte) (*base.Assignment, error) {
+	assignment := &base.Assignment{}
+	if err := json.Unmarshal(value, assignment); err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
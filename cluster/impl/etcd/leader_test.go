@@ -0,0 +1,85 @@
+package etcd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+func TestCluster_Campaign(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newRegCluster := func(id string) *Cluster {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if _, err := c.RegInstance(testCtx, id); err != nil {
+			t.Fatalf("Cluster.RegInstance() error = %v", err)
+		}
+		t.Cleanup(func() { _ = c.UnregInstance(testCtx) })
+		return c.(*Cluster)
+	}
+	c1, c2 := newRegCluster("ins1"), newRegCluster("ins2")
+
+	ac, err := c2.WatchAssignment(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.WatchAssignment() error = %v", err)
+	}
+	lost1, err := c1.Campaign(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.Campaign() error = %v", err)
+	}
+	if err := c2.PublishAssignment(testCtx, &base.Assignment{Version: 1}); !errors.Is(err, base.ErrNotLeader) {
+		t.Errorf("follower Cluster.PublishAssignment() error = %v, want %v", err, base.ErrNotLeader)
+	}
+	want := &base.Assignment{Version: 1, Leader: "ins1", ShardNum: 2, Shards: map[string][]uint32{"ins1": {0}, "ins2": {1}}}
+	if err := c1.PublishAssignment(testCtx, want); err != nil {
+		t.Fatalf("Cluster.PublishAssignment() error = %v", err)
+	}
+	if err := c1.PublishAssignment(testCtx, want); err == nil {
+		t.Errorf("Cluster.PublishAssignment() with stale version should fail")
+	}
+	select {
+	case got := <-ac:
+		if got.Version != want.Version || len(got.Shards["ins2"]) != 1 {
+			t.Errorf("Cluster.WatchAssignment() got %+v, want %+v", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Cluster.WatchAssignment() got no assignment")
+	}
+
+	// ins1放弃leader身份后ins2当选
+	lost2 := make(chan (<-chan struct{}), 1)
+	go func() {
+		lost, err := c2.Campaign(testCtx)
+		if err != nil {
+			t.Errorf("Cluster.Campaign() error = %v", err)
+		}
+		lost2 <- lost
+	}()
+	if err := c1.Resign(testCtx); err != nil {
+		t.Fatalf("Cluster.Resign() error = %v", err)
+	}
+	select {
+	case <-lost1:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("lost channel not closed after Resign")
+	}
+	select {
+	case <-lost2:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("ins2 not elected after ins1 resigned")
+	}
+	if err := c1.PublishAssignment(testCtx, &base.Assignment{Version: 2}); !errors.Is(err, base.ErrNotLeader) {
+		t.Errorf("resigned Cluster.PublishAssignment() error = %v, want %v", err, base.ErrNotLeader)
+	}
+	if err := c2.PublishAssignment(testCtx, &base.Assignment{Version: 2, Leader: "ins2"}); err != nil {
+		t.Fatalf("Cluster.PublishAssignment() error = %v", err)
+	}
+	got, err := c1.GetAssignment(testCtx)
+	if err != nil || got == nil || got.Leader != "ins2" || got.Version != 2 {
+		t.Errorf("Cluster.GetAssignment() = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,64 @@
+// Package etcd 本文件实现基于etcd的集群频控
+package etcd
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Acquire 获取指定桶的令牌，集群内所有实例共享同一份频控。
+// 桶节点保存下一个可用令牌的时间，通过事务比较修改版本号预约令牌，预约成功后等待到令牌可用的时间，
+// 令牌时间依赖各实例的本地时钟，实例之间的时钟偏差会直接影响频控精度
+func (cluster *Cluster) Acquire(ctx context.Context, bucket uint32, interval time.Duration) error {
+	cli, err := cluster.getClient()
+	if err != nil {
+		return err
+	}
+	key := cluster.limiterKey(bucket)
+	for {
+		at, err := cluster.reserve(ctx, cli, key, interval)
+		if err != nil {
+			return err
+		}
+		if !at.IsZero() {
+			return base.WaitUntil(ctx, at)
+		}
+		// 其他实例同时预约了令牌，重新读取后再次尝试
+	}
+}
+
+// reserve 尝试预约一个令牌，成功时返回令牌可用的时间，与其他实例冲突时返回零值
+func (cluster *Cluster) reserve(ctx context.Context, cli *clientv3.Client,
+	key string, interval time.Duration) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, cluster.args.EtcdTimeout)
+	defer cancel()
+	rsp, err := cli.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	now := time.Now()
+	at := now
+	var modRev int64
+	if len(rsp.Kvs) > 0 {
+		modRev = rsp.Kvs[0].ModRevision
+		if next, err := strconv.ParseInt(string(rsp.Kvs[0].Value), 10, 64); err == nil && now.UnixNano() < next {
+			at = time.Unix(0, next)
+		}
+	}
+	next := strconv.FormatInt(at.Add(interval).UnixNano(), 10)
+	txn, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRev)).
+		Then(clientv3.OpPut(key, next)).
+		Commit()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !txn.Succeeded {
+		return time.Time{}, nil
+	}
+	return at, nil
+}
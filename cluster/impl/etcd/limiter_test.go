@@ -0,0 +1,68 @@
+package etcd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+func TestCluster_Acquire(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	interval := 100 * time.Millisecond
+	var limiters []base.RateLimiter
+	for i := 0; i < 2; i++ {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		limiters = append(limiters, c.(base.RateLimiter))
+	}
+
+	// 两个实例并发获取同一个桶的令牌，令牌之间需要间隔interval
+	var mu sync.Mutex
+	var got []time.Time
+	var wg sync.WaitGroup
+	for _, l := range limiters {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(l base.RateLimiter) {
+				defer wg.Done()
+				if err := l.Acquire(testCtx, 1, interval); err != nil {
+					t.Errorf("Cluster.Acquire() error = %v", err)
+					return
+				}
+				mu.Lock()
+				got = append(got, time.Now())
+				mu.Unlock()
+			}(l)
+		}
+	}
+	wg.Wait()
+	if len(got) != 6 {
+		t.Fatalf("Cluster.Acquire() got %v tokens, want 6", len(got))
+	}
+	first, last := got[0], got[0]
+	for _, at := range got {
+		if at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	// 允许少量的定时器误差
+	if span := last.Sub(first); span < 5*interval-20*time.Millisecond {
+		t.Errorf("Cluster.Acquire() tokens span %v, want >= %v", span, 5*interval)
+	}
+
+	// 不同的桶互不影响
+	begin := time.Now()
+	if err := limiters[0].Acquire(testCtx, 2, time.Minute); err != nil {
+		t.Fatalf("Cluster.Acquire() error = %v", err)
+	}
+	if cost := time.Since(begin); cost > time.Second {
+		t.Errorf("Cluster.Acquire() other bucket cost %v", cost)
+	}
+}
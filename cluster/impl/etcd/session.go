@@ -0,0 +1,53 @@
+// Package etcd 本文件实现基于etcd的分区session存储
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+// LoadSession 读取分区session，session节点在集群内共享，分区迁移到其他实例后依然可以resume
+func (cluster *Cluster) LoadSession(ctx context.Context, shardID uint32) (*base.Session, error) {
+	cli, err := cluster.getClient()
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := cli.Get(ctx, cluster.sessionKey(shardID))
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Kvs) == 0 {
+		return nil, nil
+	}
+	session := &base.Session{}
+	if err := json.Unmarshal(rsp.Kvs[0].Value, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SaveSession 保存分区session，session节点不绑定实例租约，实例退出后其他实例依然可以读取
+func (cluster *Cluster) SaveSession(ctx context.Context, session *base.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	cli, err := cluster.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = cli.Put(ctx, cluster.sessionKey(session.ShardID), string(data))
+	return err
+}
+
+// DeleteSession 删除分区session
+func (cluster *Cluster) DeleteSession(ctx context.Context, shardID uint32) error {
+	cli, err := cluster.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = cli.Delete(ctx, cluster.sessionKey(shardID))
+	return err
+}
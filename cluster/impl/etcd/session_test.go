@@ -0,0 +1,38 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+func TestCluster_SessionStore(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	var stores []base.SessionStore
+	for i := 0; i < 2; i++ {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		stores = append(stores, c.(base.SessionStore))
+	}
+
+	if got, err := stores[0].LoadSession(testCtx, 1); err != nil || got != nil {
+		t.Fatalf("Cluster.LoadSession() = %v, %v, want nil", got, err)
+	}
+	want := &base.Session{ShardID: 1, ShardCount: 4, SessionID: "sid", LastSeq: 10}
+	if err := stores[0].SaveSession(testCtx, want); err != nil {
+		t.Fatalf("Cluster.SaveSession() error = %v", err)
+	}
+	// 其他实例可以读取到session
+	if got, err := stores[1].LoadSession(testCtx, 1); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Cluster.LoadSession() = %+v, %v, want %+v", got, err, want)
+	}
+	if err := stores[1].DeleteSession(testCtx, 1); err != nil {
+		t.Fatalf("Cluster.DeleteSession() error = %v", err)
+	}
+	if got, err := stores[0].LoadSession(testCtx, 1); err != nil || got != nil {
+		t.Errorf("Cluster.LoadSession() after delete = %v, %v, want nil", got, err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package etcd 本文件实现基于etcd租约的分区归属管理
+package etcd
+
+import (
+	"context"
+	"errors"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// AcquireShard 尝试获取分区归属，分区节点与本地实例节点共用租约，实例心跳超时后分区归属自动释放
+func (cluster *Cluster) AcquireShard(ctx context.Context, shardID uint32) (bool, error) {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
+		return false, errors.New("no valid local instance lease")
+	}
+	leaseID := ins.getLease()
+	if leaseID == 0 {
+		return false, errors.New("no valid local instance lease")
+	}
+	cli, err := cluster.getClient()
+	if err != nil {
+		return false, err
+	}
+	key := cluster.shardKey(shardID)
+	rsp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, ins.GetID(), clientv3.WithLease(leaseID))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if rsp.Succeeded {
+		return true, nil
+	}
+	kvs := rsp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) == 0 || string(kvs[0].Value) != ins.GetID() {
+		// 分区仍然归属其他实例
+		return false, nil
+	}
+	if clientv3.LeaseID(kvs[0].Lease) == leaseID {
+		return true, nil
+	}
+	// 本实例重新申请过租约，需要将分区节点绑定到新租约上，期间节点可能已经过期并被其他实例获取
+	rsp, err = cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", kvs[0].ModRevision)).
+		Then(clientv3.OpPut(key, ins.GetID(), clientv3.WithLease(leaseID))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return rsp.Succeeded, nil
+}
+
+// ReleaseShard 释放分区归属，只删除归属本地实例的分区节点
+func (cluster *Cluster) ReleaseShard(ctx context.Context, shardID uint32) error {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
+		return nil
+	}
+	cli, err := cluster.getClient()
+	if err != nil {
+		return err
+	}
+	key := cluster.shardKey(shardID)
+	_, err = cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", ins.GetID())).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	return err
+}
@@ -0,0 +1,77 @@
+package etcd
+
+import (
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestCluster_AcquireShard(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newRegCluster := func(id string) *Cluster {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		if _, err := c.RegInstance(testCtx, id); err != nil {
+			t.Fatalf("Cluster.RegInstance() error = %v", err)
+		}
+		t.Cleanup(func() { _ = c.UnregInstance(testCtx) })
+		return c.(*Cluster)
+	}
+	c1, c2 := newRegCluster("ins1"), newRegCluster("ins2")
+
+	steps := []struct {
+		name    string
+		cluster *Cluster
+		release bool
+		want    bool
+	}{
+		{name: "ins1 acquire", cluster: c1, want: true},
+		{name: "ins2 acquire owned shard", cluster: c2, want: false},
+		{name: "ins1 acquire again", cluster: c1, want: true},
+		{name: "ins2 release not owned shard", cluster: c2, release: true},
+		{name: "ins2 still can not acquire", cluster: c2, want: false},
+		{name: "ins1 release", cluster: c1, release: true},
+		{name: "ins2 acquire released shard", cluster: c2, want: true},
+	}
+	for _, tt := range steps {
+		if tt.release {
+			if err := tt.cluster.ReleaseShard(testCtx, 3); err != nil {
+				t.Fatalf("%s: Cluster.ReleaseShard() error = %v", tt.name, err)
+			}
+			continue
+		}
+		got, err := tt.cluster.AcquireShard(testCtx, 3)
+		if err != nil {
+			t.Fatalf("%s: Cluster.AcquireShard() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Cluster.AcquireShard() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// 本实例重新申请租约后，再次获取会将分区节点绑定到新租约上
+	ins := c2.getLocalInstance()
+	grant, err := c2.cli.Grant(testCtx, c2.getTTL())
+	if err != nil {
+		t.Fatalf("Grant() error = %v", err)
+	}
+	ins.setLease(grant.ID)
+	if got, err := c2.AcquireShard(testCtx, 3); err != nil || !got {
+		t.Errorf("Cluster.AcquireShard() after lease changed = %v, error = %v, want true", got, err)
+	}
+	rsp, err := c2.cli.Get(testCtx, c2.shardKey(3))
+	if err != nil || len(rsp.Kvs) != 1 || clientv3.LeaseID(rsp.Kvs[0].Lease) != grant.ID {
+		t.Errorf("shard node after lease changed = %v, error = %v, want lease %x", rsp, err, grant.ID)
+	}
+
+	// 分区节点不能被当作实例
+	all, err := c1.GetAllInstances(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.GetAllInstances() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Cluster.GetAllInstances() got %v instances, want 2", len(all))
+	}
+}
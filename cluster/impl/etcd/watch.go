@@ -0,0 +1,368 @@
+// Package etcd 本文件实现集群事件监听
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/log"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// watchResult watch中断后的处理方式
+type watchResult int
+
+const (
+	// watchStop ctx结束或者集群管理器已经关闭，结束监听
+	watchStop watchResult = iota
+	// watchResume 从已经推送的版本之后继续监听，期间的事件不会丢失
+	watchResume
+	// watchRelist 需要的版本已经被压缩，重新推送全部实例后再监听
+	watchRelist
+)
+
+// watchState 监听进度，实例节点与选主节点分别监听，各自记录已经推送到的版本
+type watchState struct {
+	// insRev 实例节点已经推送到的版本
+	insRev int64
+	// legacyRev 兼容模式下旧版本实例节点已经推送到的版本
+	legacyRev int64
+	// nodes 各实例当前的节点数，兼容模式下同一个实例有新旧两个节点，第一个节点创建时才推送新增事件，最后一个节点删除时才推送删除事件
+	nodes map[string]int
+	// leaderRev 选主节点已经推送到的版本
+	leaderRev int64
+	// leader 最近推送的leader实例id
+	leader string
+	// lostGen 已经推送过的本地实例租约失效次数
+	lostGen uint64
+}
+
+// doWatch 启动监听，并将结果转投到watchchan。先推送当前的全部实例，再从读取时的版本开始监听后续变化，
+// 保证不会遗漏两者之间的变化。监听中断后从已经推送到的版本之后重新监听；需要的版本已经被压缩时，
+// 重新推送带EventTypeWatchReset的全部实例并继续监听。ctx结束或者集群管理器关闭时返回。
+// lostGen为开始监听时的租约失效次数，之后任何时刻发生的租约失效都会推送EventTypeLeaseLost事件
+func (cluster *Cluster) doWatch(ctx context.Context, cli *clientv3.Client, wc chan *base.WatchResponse, lostGen uint64) {
+	var state *watchState
+	reset := false
+	for {
+		if state == nil {
+			var err error
+			if state, err = cluster.pushSnapshot(ctx, cli, wc, reset, lostGen); err != nil {
+				if ctx.Err() != nil || cluster.isClosed() {
+					return
+				}
+				log.Errorf("watch push snapshot failed, retry later. err:%v", err)
+				if !waitRewatch(ctx) {
+					return
+				}
+				continue
+			}
+			reset = true
+		}
+		switch cluster.watchFrom(ctx, cli, wc, state) {
+		case watchStop:
+			return
+		case watchRelist:
+			lostGen = state.lostGen
+			state = nil
+			continue
+		}
+		if !waitRewatch(ctx) {
+			return
+		}
+	}
+}
+
+// pushSnapshot 读取当前的全部实例以及leader并推送，返回读取时的监听进度。lostGen为已经推送过的租约失效次数，
+// 之后发生过租约失效时先推送EventTypeLeaseLost事件，保证其在快照中本地实例重新注册的事件之前
+func (cluster *Cluster) pushSnapshot(ctx context.Context, cli *clientv3.Client,
+	wc chan *base.WatchResponse, reset bool, lostGen uint64) (*watchState, error) {
+	state := &watchState{nodes: make(map[string]int), lostGen: lostGen}
+	var added []base.Event
+	rev := int64(0)
+	for _, prefix := range cluster.instancePrefixes() {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if rev > 0 {
+			// 各前缀读取同一个版本的数据
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		rsp, err := cli.Get(ctx, prefix, opts...)
+		if err != nil {
+			return nil, err
+		}
+		rev = rsp.Header.GetRevision()
+		for _, kv := range rsp.Kvs {
+			ins := cluster.kvInstance(kv.Key, kv.Value)
+			if ins == nil {
+				continue
+			}
+			state.nodes[ins.GetID()]++
+			if state.nodes[ins.GetID()] == 1 {
+				added = append(added, base.NewEvent(base.EventTypeInstanceAdded, ins, kv.ModRevision))
+			}
+		}
+	}
+	leader, err := cluster.getLeader(ctx, cli, rev)
+	if err != nil {
+		return nil, err
+	}
+	// 心跳协程先增加租约失效次数再重新写入实例节点，读取快照之后检查，快照中的重新注册不会早于租约失效事件
+	events := cluster.takeLeaseLost(state)
+	if reset {
+		events = append(events, base.NewEvent(base.EventTypeWatchReset, nil, rev))
+	}
+	events = append(events, added...)
+	if leader != "" {
+		events = append(events, cluster.leaderEvent(leader, rev))
+	}
+	// 启动watch时强制推送一次EventTypeInsChanged事件
+	events = append(events, base.NewEvent(base.EventTypeInsChanged, nil, rev))
+	if err := sendEvents(ctx, wc, events); err != nil {
+		return nil, err
+	}
+	state.insRev, state.legacyRev, state.leaderRev, state.leader = rev, rev, rev, leader
+	return state, nil
+}
+
+// watchFrom 从state记录的版本之后监听实例节点与选主节点的变化，推送事件的同时更新state，返回中断后的处理方式
+func (cluster *Cluster) watchFrom(ctx context.Context, cli *clientv3.Client,
+	wc chan *base.WatchResponse, state *watchState) watchResult {
+	// 退出时同时取消两个watch
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	insCh := watchInstances(wctx, cli, cluster.instancePrefix(), state.insRev)
+	// 没有开启兼容模式时为nil，不会被选中
+	var legacyCh clientv3.WatchChan
+	if cluster.args.LegacyCompat {
+		legacyCh = watchInstances(wctx, cli, cluster.legacyInstancePrefix(), state.legacyRev)
+	}
+	leaderCh := cli.Watch(wctx, cluster.electionPrefix()+"/", clientv3.WithPrefix(),
+		clientv3.WithRev(state.leaderRev+1), clientv3.WithProgressNotify())
+	// 先获取唤醒channel再比较失效次数，推送快照或者等待重新监听期间发生的租约失效也会立即推送
+	_, leaseLost := cluster.leaseLostState()
+	if sendEvents(ctx, wc, cluster.takeLeaseLost(state)) != nil {
+		return watchStop
+	}
+	for {
+		select {
+		case <-leaseLost:
+			_, leaseLost = cluster.leaseLostState()
+			if sendEvents(ctx, wc, cluster.takeLeaseLost(state)) != nil {
+				return watchStop
+			}
+		case rsp, ok := <-insCh:
+			if !ok || rsp.Err() != nil {
+				return cluster.watchInterrupted(ctx, rsp, ok)
+			}
+			if cluster.sendInstanceEvents(ctx, wc, rsp, state) != nil {
+				return watchStop
+			}
+			state.insRev = watchedRevision(rsp, state.insRev)
+		case rsp, ok := <-legacyCh:
+			if !ok || rsp.Err() != nil {
+				return cluster.watchInterrupted(ctx, rsp, ok)
+			}
+			if cluster.sendInstanceEvents(ctx, wc, rsp, state) != nil {
+				return watchStop
+			}
+			state.legacyRev = watchedRevision(rsp, state.legacyRev)
+		case rsp, ok := <-leaderCh:
+			if !ok || rsp.Err() != nil {
+				return cluster.watchInterrupted(ctx, rsp, ok)
+			}
+			if len(rsp.Events) > 0 {
+				cur, err := cluster.getLeader(ctx, cli, 0)
+				if err != nil {
+					log.Errorf("watch get leader failed. err:%v", err)
+					if ctx.Err() != nil {
+						return watchStop
+					}
+					return watchResume
+				}
+				if cur != state.leader {
+					state.leader = cur
+					events := []base.Event{cluster.leaderEvent(cur, rsp.Header.GetRevision())}
+					if sendEvents(ctx, wc, events) != nil {
+						return watchStop
+					}
+				}
+			}
+			state.leaderRev = watchedRevision(rsp, state.leaderRev)
+		case <-ctx.Done():
+			return watchStop
+		}
+	}
+}
+
+// watchInstances 从rev之后监听prefix下的实例节点。开启进度通知，长时间没有变化时也能推进版本，避免重新监听时需要的版本已经被压缩
+func watchInstances(ctx context.Context, cli *clientv3.Client, prefix string, rev int64) clientv3.WatchChan {
+	return cli.Watch(ctx, prefix, clientv3.WithPrefix(),
+		clientv3.WithRev(rev+1), clientv3.WithPrevKV(), clientv3.WithProgressNotify())
+}
+
+// sendInstanceEvents 推送实例节点变化对应的事件，ctx结束时返回错误
+func (cluster *Cluster) sendInstanceEvents(ctx context.Context, wc chan *base.WatchResponse,
+	rsp clientv3.WatchResponse, state *watchState) error {
+	events := cluster.instanceEvents(rsp, state)
+	if len(events) == 0 {
+		return nil
+	}
+	// 心跳协程先增加租约失效次数再重新写入实例节点，这里保证租约失效事件在本地实例重新注册的事件之前推送
+	events = append(cluster.takeLeaseLost(state), events...)
+	return sendEvents(ctx, wc, events)
+}
+
+// watchInterrupted watch中断时判断处理方式，ok为false表示watch channel已经关闭
+func (cluster *Cluster) watchInterrupted(ctx context.Context, rsp clientv3.WatchResponse, ok bool) watchResult {
+	if ctx.Err() != nil || cluster.isClosed() {
+		return watchStop
+	}
+	if ok && rsp.CompactRevision != 0 {
+		log.Errorf("watch revision compacted at %v, relist. err:%v", rsp.CompactRevision, rsp.Err())
+		return watchRelist
+	}
+	log.Errorf("watch interrupted, rewatch. err:%v", rsp.Err())
+	return watchResume
+}
+
+// watchedRevision 返回watch响应处理完成后已经推送到的版本：有事件时为最后一个事件的版本，进度通知时为响应头中的版本
+func watchedRevision(rsp clientv3.WatchResponse, rev int64) int64 {
+	if rsp.IsProgressNotify() && rsp.Header.GetRevision() > rev {
+		return rsp.Header.GetRevision()
+	}
+	for _, ev := range rsp.Events {
+		if ev.Kv.ModRevision > rev {
+			rev = ev.Kv.ModRevision
+		}
+	}
+	return rev
+}
+
+// waitRewatch 等待DftRewatchInterval后重新监听，ctx结束时返回false
+func waitRewatch(ctx context.Context) bool {
+	select {
+	case <-time.After(DftRewatchInterval):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// takeLeaseLost 本地实例租约失效次数超过state中已经推送过的次数时，更新state并返回租约失效事件，否则返回nil。
+// 多次失效合并为一个事件
+func (cluster *Cluster) takeLeaseLost(state *watchState) []base.Event {
+	gen, _ := cluster.leaseLostState()
+	if gen == state.lostGen {
+		return nil
+	}
+	state.lostGen = gen
+	return cluster.leaseLostEvents()
+}
+
+// leaseLostEvents 创建本地实例租约失效事件，本地实例已经注销时返回nil
+func (cluster *Cluster) leaseLostEvents() []base.Event {
+	ins := cluster.getLocalInstance()
+	if ins == nil {
+		return nil
+	}
+	return []base.Event{base.NewEvent(base.EventTypeLeaseLost, ins, 0)}
+}
+
+// getLeader 获取当前leader的实例id，选主节点中创建版本最小的为leader，没有leader时返回空字符串。
+// rev大于0时读取该版本的数据
+func (cluster *Cluster) getLeader(ctx context.Context, cli *clientv3.Client, rev int64) (string, error) {
+	opts := clientv3.WithFirstCreate()
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+	rsp, err := cli.Get(ctx, cluster.electionPrefix()+"/", opts...)
+	if err != nil {
+		return "", err
+	}
+	if len(rsp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(rsp.Kvs[0].Value), nil
+}
+
+// leaderEvent 创建leader变化事件，leader为空表示当前没有leader
+func (cluster *Cluster) leaderEvent(leader string, rev int64) base.Event {
+	var ins base.Instance
+	if leader != "" {
+		ins = &Instance{id: leader}
+	}
+	return base.NewEvent(base.EventTypeLeaderChanged, ins, rev)
+}
+
+// instanceEvents 将实例节点的变化转换为实例事件并更新各实例的节点数，有实例变化时最后附带一个EventTypeInsChanged事件
+func (cluster *Cluster) instanceEvents(rsp clientv3.WatchResponse, state *watchState) []base.Event {
+	var events []base.Event
+	for _, ev := range rsp.Events {
+		var ins *Instance
+		eventType := base.EventTypeUnknown
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			ins = cluster.kvInstance(ev.Kv.Key, ev.Kv.Value)
+			if ins == nil {
+				continue
+			}
+			eventType = base.EventTypeInstanceUpdated
+			if ev.IsCreate() {
+				state.nodes[ins.GetID()]++
+				if state.nodes[ins.GetID()] > 1 {
+					// 兼容模式下实例的另一个节点，实例已经存在
+					continue
+				}
+				eventType = base.EventTypeInstanceAdded
+			}
+		case clientv3.EventTypeDelete:
+			// 删除事件中没有节点内容，使用删除前的内容还原实例状态
+			var value []byte
+			if ev.PrevKv != nil {
+				value = ev.PrevKv.Value
+			}
+			ins = cluster.kvInstance(ev.Kv.Key, value)
+			if ins == nil {
+				continue
+			}
+			state.nodes[ins.GetID()]--
+			if state.nodes[ins.GetID()] > 0 {
+				// 兼容模式下实例还有另一个节点
+				continue
+			}
+			delete(state.nodes, ins.GetID())
+			eventType = base.EventTypeInstanceRemoved
+		default:
+			continue
+		}
+		events = append(events, base.NewEvent(eventType, ins, ev.Kv.ModRevision))
+	}
+	if len(events) > 0 {
+		events = append(events, base.NewEvent(base.EventTypeInsChanged, nil, rsp.Header.GetRevision()))
+	}
+	return events
+}
+
+// kvInstance 根据实例节点还原实例，节点key不是有效的实例节点时返回nil
+func (cluster *Cluster) kvInstance(key, value []byte) *Instance {
+	ins, err := newInstanceWithID(cluster.keyInstanceID(string(key)))
+	if err != nil {
+		return nil
+	}
+	decodeNode(ins, value)
+	return ins
+}
+
+// sendEvents 推送事件，没有事件时直接返回，ctx结束时返回错误
+func sendEvents(ctx context.Context, wc chan *base.WatchResponse, events []base.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	select {
+	case wc <- base.NewWatchRspWithEvents(events...):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
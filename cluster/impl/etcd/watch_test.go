@@ -0,0 +1,364 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	mvccpb "go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// nextEvents 读取下一个watch响应中的事件类型以及相关实例id
+func nextEvents(t *testing.T, wc base.WatchChan) ([]base.EventType, []string) {
+	t.Helper()
+	select {
+	case rsp, ok := <-wc:
+		if !ok {
+			t.Fatalf("watch chan closed")
+		}
+		var types []base.EventType
+		var ids []string
+		for _, ev := range rsp.Events {
+			types = append(types, ev.GetType())
+			if ev.GetInstance() != nil {
+				ids = append(ids, ev.GetInstance().GetID())
+			}
+			if ev.GetRevision() == 0 && ev.GetType() != base.EventTypeLeaseLost {
+				t.Errorf("event %v has no revision", ev.GetType())
+			}
+		}
+		return types, ids
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no watch response")
+	}
+	return nil, nil
+}
+
+func TestCluster_Watch_events(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newCluster := func() *Cluster {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		return c.(*Cluster)
+	}
+	c1, c2 := newCluster(), newCluster()
+	if _, err := c1.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	defer c1.UnregInstance(testCtx)
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	wc, err := c1.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	ins1, ins2 := testClusterName+"_ins1", testClusterName+"_ins2"
+
+	steps := []struct {
+		name      string
+		action    func() error
+		wantTypes []base.EventType
+		wantIDs   []string
+	}{
+		{
+			name:      "snapshot",
+			action:    func() error { return nil },
+			wantTypes: []base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged},
+			wantIDs:   []string{ins1},
+		}, {
+			name: "add",
+			action: func() error {
+				_, err := c2.RegInstance(testCtx, "ins2")
+				return err
+			},
+			wantTypes: []base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged},
+			wantIDs:   []string{ins2},
+		}, {
+			name:      "update",
+			action:    func() error { return c2.MarkDraining(testCtx) },
+			wantTypes: []base.EventType{base.EventTypeInstanceUpdated, base.EventTypeInsChanged},
+			wantIDs:   []string{ins2},
+		}, {
+			name: "leader",
+			action: func() error {
+				_, err := c2.Campaign(testCtx)
+				return err
+			},
+			wantTypes: []base.EventType{base.EventTypeLeaderChanged},
+			wantIDs:   []string{ins2},
+		}, {
+			name:      "remove",
+			action:    func() error { return c2.UnregInstance(testCtx) },
+			wantTypes: []base.EventType{base.EventTypeLeaderChanged, base.EventTypeInstanceRemoved, base.EventTypeInsChanged},
+			wantIDs:   []string{ins2},
+		},
+	}
+	for _, tt := range steps {
+		if err := tt.action(); err != nil {
+			t.Fatalf("%s: action error = %v", tt.name, err)
+		}
+		var gotTypes []base.EventType
+		var gotIDs []string
+		for len(gotTypes) < len(tt.wantTypes) {
+			types, ids := nextEvents(t, wc)
+			gotTypes, gotIDs = append(gotTypes, types...), append(gotIDs, ids...)
+		}
+		if !sameEvents(gotTypes, tt.wantTypes, gotIDs, tt.wantIDs) {
+			t.Errorf("%s: got events %v %v, want %v %v", tt.name, gotTypes, gotIDs, tt.wantTypes, tt.wantIDs)
+		}
+	}
+}
+
+// sameEvents 比较事件类型与实例id，实例节点与选主节点分别监听，两者事件的先后顺序不固定
+func sameEvents(types, wantTypes []base.EventType, ids, wantIDs []string) bool {
+	count := func(types []base.EventType) map[base.EventType]int {
+		m := make(map[base.EventType]int)
+		for _, t := range types {
+			m[t]++
+		}
+		return m
+	}
+	sorted := func(ids []string) []string {
+		ids = append([]string(nil), ids...)
+		sort.Strings(ids)
+		return ids
+	}
+	return reflect.DeepEqual(count(types), count(wantTypes)) && reflect.DeepEqual(sorted(ids), sorted(wantIDs))
+}
+
+// snapshotState 推送一次全部实例并返回监听进度
+func snapshotState(t *testing.T, c *Cluster) *watchState {
+	t.Helper()
+	cli, err := c.getClient()
+	if err != nil {
+		t.Fatalf("getClient() error = %v", err)
+	}
+	wc := make(chan *base.WatchResponse, 1)
+	state, err := c.pushSnapshot(testCtx, cli, wc, false, 0)
+	if err != nil {
+		t.Fatalf("Cluster.pushSnapshot() error = %v", err)
+	}
+	return state
+}
+
+func TestCluster_watchFrom(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	newCluster := func() *Cluster {
+		c, err := New(testClusterName, endpoints)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = c.(*Cluster).Close() })
+		return c.(*Cluster)
+	}
+	c1, c2 := newCluster(), newCluster()
+	if _, err := c1.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	cli, _ := c1.getClient()
+
+	// 从记录的版本之后重新监听，中断期间注册的实例不会丢失，也不需要重新推送全部实例
+	state := snapshotState(t, c1)
+	if _, err := c2.RegInstance(testCtx, "ins2"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(testCtx)
+	wc := make(chan *base.WatchResponse)
+	done := make(chan watchResult, 1)
+	go func() { done <- c1.watchFrom(ctx, cli, wc, state) }()
+	types, ids := nextEvents(t, wc)
+	if !sameEvents(types, []base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged},
+		ids, []string{testClusterName + "_ins2"}) {
+		t.Errorf("resumed events = %v %v", types, ids)
+	}
+	cancel()
+	if got := <-done; got != watchStop {
+		t.Errorf("Cluster.watchFrom() after cancel = %v, want %v", got, watchStop)
+	}
+	if state.insRev <= 0 {
+		t.Errorf("Cluster.watchFrom() did not track revision, state = %+v", state)
+	}
+
+	// 记录的版本已经被压缩，需要重新推送全部实例
+	state = snapshotState(t, c1)
+	if err := c2.UnregInstance(testCtx); err != nil {
+		t.Fatalf("Cluster.UnregInstance() error = %v", err)
+	}
+	// 压缩到最新版本，记录的版本之后的实例变化也被压缩
+	rsp, err := cli.Put(testCtx, "compact", "")
+	if err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if _, err := cli.Compact(testCtx, rsp.Header.Revision, clientv3.WithCompactPhysical()); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if got := c1.watchFrom(testCtx, cli, make(chan *base.WatchResponse, 1), state); got != watchRelist {
+		t.Errorf("Cluster.watchFrom() after compaction = %v, want %v", got, watchRelist)
+	}
+	rev := state.insRev
+	if got := c1.watchAssignmentFrom(testCtx, cli, make(chan *base.Assignment, 1), &rev); got != watchRelist {
+		t.Errorf("Cluster.watchAssignmentFrom() after compaction = %v, want %v", got, watchRelist)
+	}
+	wc = make(chan *base.WatchResponse, 1)
+	if _, err := c1.pushSnapshot(testCtx, cli, wc, true, 0); err != nil {
+		t.Fatalf("Cluster.pushSnapshot() error = %v", err)
+	}
+	types, ids = nextEvents(t, wc)
+	want := []base.EventType{base.EventTypeWatchReset, base.EventTypeInstanceAdded, base.EventTypeInsChanged}
+	if !reflect.DeepEqual(types, want) || !reflect.DeepEqual(ids, []string{testClusterName + "_ins1"}) {
+		t.Errorf("relist events = %v %v, want %v", types, ids, want)
+	}
+}
+
+func TestCluster_watchFrom_leaseLost(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	c, err := New(testClusterName, endpoints)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c1 := c.(*Cluster)
+	t.Cleanup(func() { _ = c1.Close() })
+	if _, err := c1.RegInstance(testCtx, "ins1"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	defer c1.UnregInstance(testCtx)
+	cli, _ := c1.getClient()
+	wantLost := func(name string, types []base.EventType, ids []string) {
+		t.Helper()
+		if len(types) == 0 || types[0] != base.EventTypeLeaseLost || ids[0] != testClusterName+"_ins1" {
+			t.Errorf("%s: events = %v %v, want %v first", name, types, ids, base.EventTypeLeaseLost)
+		}
+	}
+
+	// 推送快照之后、开始监听之前租约失效，监听开始时立即推送租约失效事件
+	state := snapshotState(t, c1)
+	c1.notifyLeaseLost()
+	ctx, cancel := context.WithCancel(testCtx)
+	wc := make(chan *base.WatchResponse)
+	done := make(chan watchResult, 1)
+	go func() { done <- c1.watchFrom(ctx, cli, wc, state) }()
+	types, ids := nextEvents(t, wc)
+	wantLost("between snapshot and watch", types, ids)
+	// 已经推送过的租约失效不会重复推送
+	c2, err := New(testClusterName, endpoints)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := c2.RegInstance(testCtx, "ins2"); err != nil {
+		t.Fatalf("Cluster.RegInstance() error = %v", err)
+	}
+	defer c2.UnregInstance(testCtx)
+	types, _ = nextEvents(t, wc)
+	if !sameEvents(types, []base.EventType{base.EventTypeInstanceAdded, base.EventTypeInsChanged}, nil, nil) {
+		t.Errorf("events after lease lost = %v", types)
+	}
+	cancel()
+	<-done
+
+	// 推送快照之前租约失效，租约失效事件在快照中的实例事件之前推送
+	gen, _ := c1.leaseLostState()
+	c1.notifyLeaseLost()
+	wc = make(chan *base.WatchResponse, 1)
+	if _, err := c1.pushSnapshot(testCtx, cli, wc, true, gen); err != nil {
+		t.Fatalf("Cluster.pushSnapshot() error = %v", err)
+	}
+	types, ids = nextEvents(t, wc)
+	wantLost("before snapshot", types, ids)
+}
+
+func TestCluster_Watch_close(t *testing.T) {
+	endpoints := startTestEtcd(t)
+	c, err := New(testClusterName, endpoints)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cluster := c.(*Cluster)
+	waitClosed := func(name string, wc base.WatchChan) {
+		t.Helper()
+		deadline := time.After(3 * time.Second)
+		for {
+			select {
+			case _, ok := <-wc:
+				if !ok {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("%s: watch chan not closed", name)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(testCtx)
+	wc, err := cluster.Watch(ctx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	nextEvents(t, wc)
+	cancel()
+	waitClosed("cancel", wc)
+
+	wc, err = cluster.Watch(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.Watch() error = %v", err)
+	}
+	ac, err := cluster.WatchAssignment(testCtx)
+	if err != nil {
+		t.Fatalf("Cluster.WatchAssignment() error = %v", err)
+	}
+	nextEvents(t, wc)
+	if err := cluster.Close(); err != nil {
+		t.Fatalf("Cluster.Close() error = %v", err)
+	}
+	waitClosed("close", wc)
+	select {
+	case _, ok := <-ac:
+		if ok {
+			t.Errorf("Cluster.WatchAssignment() got assignment after close")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("assignment chan not closed")
+	}
+}
+
+func Test_watchedRevision(t *testing.T) {
+	put := func(rev int64) *clientv3.Event {
+		return &clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{ModRevision: rev}}
+	}
+	tests := []struct {
+		name string
+		rsp  clientv3.WatchResponse
+		rev  int64
+		want int64
+	}{
+		{
+			name: "events",
+			rsp:  clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 9}, Events: []*clientv3.Event{put(5), put(7)}},
+			rev:  3,
+			want: 7,
+		}, {
+			name: "progress notify",
+			rsp:  clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 9}},
+			rev:  3,
+			want: 9,
+		}, {
+			name: "stale progress notify",
+			rsp:  clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 2}},
+			rev:  3,
+			want: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := watchedRevision(tt.rsp, tt.rev); got != tt.want {
+				t.Errorf("watchedRevision() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Package schedule 本文件实现调度器的管理http接口
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+// DftAdminTimeout 管理接口访问集群管理器的默认超时时间
+const DftAdminTimeout = 3 * time.Second
+
+// AdminStatus /status 接口的返回内容
+type AdminStatus struct {
+	// Scheduler 调度器运行状态
+	Scheduler Status `json:"scheduler"`
+	// Cluster 集群管理器中的所有实例
+	Cluster []AdminInstance `json:"cluster"`
+	// ClusterError 获取集群实例失败时的错误
+	ClusterError string `json:"cluster_error,omitempty"`
+}
+
+// AdminInstance 集群实例信息
+type AdminInstance struct {
+	// ID 实例id
+	ID string `json:"id"`
+	// Valid 是否是有效实例
+	Valid bool `json:"valid"`
+	// Draining 是否正在下线
+	Draining bool `json:"draining,omitempty"`
+	// Metadata 实例元数据
+	Metadata base.Metadata `json:"metadata"`
+}
+
+// NewAdminHandler 创建调度器的管理http接口，使用方可以挂载到自己的http服务上，包括：
+//
+//	GET  /healthz     调度协程是否正在运行
+//	GET  /readyz      调度协程正在运行，完成过调度，且本实例负责的分区都已建立链接
+//	GET  /status      调度器运行状态以及集群管理器中的所有实例
+//	POST /reschedule  立即执行一次调度检查
+//	POST /drain       实例下线前主动退出集群
+func NewAdminHandler(sched *Scheduler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		if !sched.running() {
+			http.Error(w, "scheduler not running", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	mux.HandleFunc("/readyz", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		if reason := notReadyReason(sched.Status()); reason != "" {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	mux.HandleFunc("/status", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sched.adminStatus(r.Context()))
+	}))
+	mux.HandleFunc("/reschedule", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := sched.Reschedule(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	mux.HandleFunc("/drain", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := sched.Drain(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	return mux
+}
+
+// adminStatus 获取调度器运行状态以及集群管理器中的所有实例
+func (sched *Scheduler) adminStatus(ctx context.Context) *AdminStatus {
+	status := &AdminStatus{Scheduler: sched.Status(), Cluster: []AdminInstance{}}
+	ctx, cancel := context.WithTimeout(ctx, DftAdminTimeout)
+	defer cancel()
+	insList, err := sched.args.Cluster.GetAllInstances(ctx)
+	if err != nil {
+		status.ClusterError = err.Error()
+		return status
+	}
+	for _, ins := range insList {
+		status.Cluster = append(status.Cluster, AdminInstance{
+			ID:       ins.GetID(),
+			Valid:    ins.IsValid(),
+			Draining: ins.IsDraining(),
+			Metadata: ins.GetMetadata(),
+		})
+	}
+	return status
+}
+
+// notReadyReason 根据运行状态判断是否就绪，未就绪时返回原因
+func notReadyReason(status Status) string {
+	if !status.Running {
+		return "scheduler not running"
+	}
+	if status.Draining {
+		return "instance draining"
+	}
+	if status.Fenced {
+		return "instance lease lost"
+	}
+	if status.MembershipVersion == "" {
+		return "scheduler not scheduled yet"
+	}
+	for _, shard := range status.Shards {
+		if shard.State != ShardStateConnected {
+			return "shard not connected"
+		}
+	}
+	return ""
+}
+
+// method 限制http方法
+func method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeJSON 输出json
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,104 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+func TestNewAdminHandler(t *testing.T) {
+	schedArgs := testArgs
+	// 本地实例不在实例列表中，不会分配分区
+	schedArgs.Cluster = &staticCluster{insList: []base.Instance{&mockInstance{id: "ins1"}}}
+	schedArgs.APProvider = &failingAPProvider{}
+	sched, err := New(&schedArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	handler := NewAdminHandler(sched)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// 调度器尚未启动
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: http.MethodGet, path: "/healthz", want: http.StatusServiceUnavailable},
+		{method: http.MethodGet, path: "/readyz", want: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/reschedule", want: http.StatusServiceUnavailable},
+		{method: http.MethodGet, path: "/reschedule", want: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, path: "/status", want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path).Code; got != tt.want {
+			t.Errorf("%s %s code = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+	w := do(http.MethodGet, "/status")
+	status := &AdminStatus{}
+	if err := json.NewDecoder(w.Body).Decode(status); err != nil {
+		t.Fatalf("GET /status decode error = %v", err)
+	}
+	if w.Code != http.StatusOK || len(status.Cluster) != 1 || status.Cluster[0].ID != "ins1" ||
+		status.Scheduler.InstanceID != "127.0.0.1" {
+		t.Errorf("GET /status = %v %+v", w.Code, status)
+	}
+
+	// 启动后完成调度即就绪
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for do(http.MethodGet, "/readyz").Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /readyz not ready after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := do(http.MethodGet, "/healthz").Code; got != http.StatusOK {
+		t.Errorf("GET /healthz code = %v, want 200", got)
+	}
+	if got := do(http.MethodPost, "/reschedule").Code; got != http.StatusAccepted {
+		t.Errorf("POST /reschedule code = %v, want 202", got)
+	}
+	if got := do(http.MethodPost, "/drain").Code; got != http.StatusOK {
+		t.Errorf("POST /drain code = %v, want 200", got)
+	}
+	if got := do(http.MethodGet, "/healthz").Code; got != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz after drain code = %v, want 503", got)
+	}
+}
+
+func Test_notReadyReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		status Status
+		want   bool
+	}{
+		{name: "not running", status: Status{MembershipVersion: "v"}, want: false},
+		{name: "not scheduled", status: Status{Running: true}, want: false},
+		{name: "no shards", status: Status{Running: true, MembershipVersion: "v"}, want: true},
+		{name: "fenced", status: Status{Running: true, MembershipVersion: "v", Fenced: true}, want: false},
+		{name: "connecting", status: Status{Running: true, MembershipVersion: "v",
+			Shards: []ShardStatus{{State: ShardStateConnected}, {State: ShardStateConnecting}}}, want: false},
+		{name: "connected", status: Status{Running: true, MembershipVersion: "v",
+			Shards: []ShardStatus{{State: ShardStateConnected}}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notReadyReason(tt.status) == ""; got != tt.want {
+				t.Errorf("notReadyReason() ready = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Package schedule 本文件实现bot gateway接入点信息的获取
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tencent-connect/botgo"
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/log"
+	"github.com/tencent-connect/botgo/openapi"
+	"github.com/tencent-connect/botgo/token"
+)
+
+const (
+	// DftAPCacheTTL 接入点信息默认缓存时间
+	DftAPCacheTTL = 10 * time.Second
+	// DftAPMinBackoff 获取接入点信息失败后的最小退避时间
+	DftAPMinBackoff = time.Second
+	// DftAPMaxBackoff 获取接入点信息失败后的最大退避时间
+	DftAPMaxBackoff = time.Minute
+	// DftAPMaxStale 获取接入点信息失败时，上次成功获取的结果最多可以继续使用的时间
+	DftAPMaxStale = 10 * time.Minute
+)
+
+// APProvider bot gateway接入点信息提供者
+type APProvider interface {
+	// GetAP 获取websocket接入点信息，包括接入地址、建议分区数以及链接频控信息。
+	// 获取失败时可以返回上次成功获取的接入点信息以及*StaleAPError
+	GetAP(ctx context.Context) (*dto.WebsocketAP, error)
+}
+
+// StaleAPError 获取接入点信息失败，返回的是上次成功获取的接入点信息。调度器会继续使用其中的接入地址和分区数调度，
+// 但是会按照获取失败上报监控，并且不再使用其中已经过期的频控信息刷新鉴权次数预算
+type StaleAPError struct {
+	// Err 获取失败的原因
+	Err error
+	// FetchedAt 返回的接入点信息的获取时间
+	FetchedAt time.Time
+}
+
+// Error 错误信息
+func (e *StaleAPError) Error() string {
+	return fmt.Sprintf("use stale ap fetched at %v, err:%v", e.FetchedAt, e.Err)
+}
+
+// Unwrap 获取失败的原因
+func (e *StaleAPError) Unwrap() error {
+	return e.Err
+}
+
+// NewOpenAPIProvider 创建通过openapi获取接入点信息的提供者，为调度器的默认实现，
+// 获取成功的结果会缓存DftAPCacheTTL，获取失败后按照指数退避，DftAPMaxStale内返回上次的结果以及*StaleAPError
+func NewOpenAPIProvider(botAppID uint64, botToken string) APProvider {
+	return &openAPIProvider{
+		api:      botgo.NewOpenAPI(token.BotToken(botAppID, botToken)).WithTimeout(3 * time.Second),
+		ttl:      DftAPCacheTTL,
+		maxStale: DftAPMaxStale,
+	}
+}
+
+// NewStaticAPProvider 创建返回固定接入点信息的提供者，用于测试或者对接本地模拟的gateway
+func NewStaticAPProvider(ap *dto.WebsocketAP) APProvider {
+	return &staticAPProvider{ap: *ap}
+}
+
+// openAPIProvider 通过openapi获取接入点信息
+type openAPIProvider struct {
+	api openapi.OpenAPI
+	ttl time.Duration
+	// maxStale 获取失败时缓存最多可以继续使用的时间
+	maxStale time.Duration
+
+	mu sync.Mutex
+	// ap 缓存的接入点信息
+	ap *dto.WebsocketAP
+	// fetchedAt 缓存的获取时间
+	fetchedAt time.Time
+	// expireAt 缓存过期时间
+	expireAt time.Time
+	// backoff 当前退避时间
+	backoff time.Duration
+	// nextTry 退避结束时间，在此之前不会再调用openapi
+	nextTry time.Time
+	// lastErr 最近一次失败的错误
+	lastErr error
+}
+
+// GetAP 获取接入点信息
+func (p *openAPIProvider) GetAP(ctx context.Context) (*dto.WebsocketAP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.ap != nil && now.Before(p.expireAt) {
+		return p.copyAP(), nil
+	}
+	if now.Before(p.nextTry) {
+		return p.fallback(now)
+	}
+	ap, err := p.api.WS(ctx, nil, "")
+	if err != nil {
+		log.Errorf("Open api ws failed. err:%v", err)
+		p.lastErr = err
+		p.backoff *= 2
+		if p.backoff < DftAPMinBackoff {
+			p.backoff = DftAPMinBackoff
+		}
+		if p.backoff > DftAPMaxBackoff {
+			p.backoff = DftAPMaxBackoff
+		}
+		p.nextTry = now.Add(p.backoff)
+		return p.fallback(now)
+	}
+	log.Infof("Get ap info:%+v", ap)
+	p.ap, p.fetchedAt, p.expireAt = ap, now, now.Add(p.ttl)
+	p.backoff, p.nextTry, p.lastErr = 0, time.Time{}, nil
+	return p.copyAP(), nil
+}
+
+// fallback 获取失败时使用上次成功获取的接入点信息，接入点信息很少变化，这样可以避免openapi抖动时无法调度，
+// 超过maxStale后不再使用，避免长时间基于过期的信息调度
+func (p *openAPIProvider) fallback(now time.Time) (*dto.WebsocketAP, error) {
+	if p.ap != nil && now.Sub(p.fetchedAt) < p.maxStale {
+		return p.copyAP(), &StaleAPError{Err: p.lastErr, FetchedAt: p.fetchedAt}
+	}
+	if p.lastErr != nil {
+		return nil, p.lastErr
+	}
+	return nil, errors.New("no ap available")
+}
+
+// copyAP 返回缓存的拷贝，避免调用方修改缓存
+func (p *openAPIProvider) copyAP() *dto.WebsocketAP {
+	ap := *p.ap
+	return &ap
+}
+
+// staticAPProvider 返回固定的接入点信息
+type staticAPProvider struct {
+	ap dto.WebsocketAP
+}
+
+// GetAP 获取接入点信息
+func (p *staticAPProvider) GetAP(ctx context.Context) (*dto.WebsocketAP, error) {
+	ap := p.ap
+	return &ap, nil
+}
@@ -0,0 +1,121 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/openapi"
+	"github.com/tencent-connect/botgo/token"
+)
+
+// mockOpenAPI 模拟openapi，只实现WS接口
+type mockOpenAPI struct {
+	openapi.OpenAPI
+	calls int
+	err   error
+}
+
+// WS 获取接入点信息
+func (m *mockOpenAPI) WS(ctx context.Context, params map[string]string, body string) (*dto.WebsocketAP, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &dto.WebsocketAP{URL: "wss://fake", Shards: uint32(m.calls)}, nil
+}
+
+func Test_openAPIProvider_GetAP(t *testing.T) {
+	api := &mockOpenAPI{err: errors.New("mock err")}
+	p := &openAPIProvider{api: api, ttl: time.Minute, maxStale: time.Hour}
+
+	// 首次失败，没有缓存，返回错误，退避期间不再调用openapi
+	if _, err := p.GetAP(context.Background()); err == nil {
+		t.Errorf("openAPIProvider.GetAP() want err")
+	}
+	if _, err := p.GetAP(context.Background()); err == nil || api.calls != 1 {
+		t.Errorf("openAPIProvider.GetAP() calls = %v during backoff, want 1", api.calls)
+	}
+
+	// 退避结束后成功获取并缓存
+	api.err = nil
+	p.nextTry = time.Time{}
+	ap, err := p.GetAP(context.Background())
+	if err != nil || ap.Shards != 2 {
+		t.Fatalf("openAPIProvider.GetAP() = %v, %v", ap, err)
+	}
+	ap.Shards = 100
+	if ap, _ = p.GetAP(context.Background()); ap.Shards != 2 || api.calls != 2 {
+		t.Errorf("openAPIProvider.GetAP() should return cached copy, got %v, calls %v", ap, api.calls)
+	}
+
+	// 缓存过期后获取失败，返回上次成功的结果以及StaleAPError
+	api.err = errors.New("mock err")
+	p.expireAt = time.Time{}
+	ap, err = p.GetAP(context.Background())
+	var staleErr *StaleAPError
+	if !errors.As(err, &staleErr) || !errors.Is(err, api.err) || ap == nil || ap.Shards != 2 {
+		t.Errorf("openAPIProvider.GetAP() = %v, %v, want cached ap with stale err", ap, err)
+	}
+	if p.backoff != DftAPMinBackoff {
+		t.Errorf("openAPIProvider.GetAP() backoff = %v, want %v", p.backoff, DftAPMinBackoff)
+	}
+
+	// 超过maxStale后不再沿用上次的结果
+	p.fetchedAt = time.Now().Add(-2 * time.Hour)
+	if ap, err = p.GetAP(context.Background()); ap != nil || err == nil || errors.As(err, &staleErr) {
+		t.Errorf("openAPIProvider.GetAP() = %v, %v, want err without ap", ap, err)
+	}
+}
+
+// staleAPProvider 返回沿用结果的接入点信息提供者
+type staleAPProvider struct {
+	ap dto.WebsocketAP
+}
+
+// GetAP 获取接入点信息
+func (p *staleAPProvider) GetAP(ctx context.Context) (*dto.WebsocketAP, error) {
+	ap := p.ap
+	return &ap, &StaleAPError{Err: errors.New("mock err"), FetchedAt: time.Now()}
+}
+
+func TestScheduler_getAP_stale(t *testing.T) {
+	metrics := &recordingMetrics{}
+	args := testArgs
+	args.Metrics = metrics
+	args.APProvider = &staleAPProvider{ap: dto.WebsocketAP{
+		Shards:            1,
+		SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 0},
+	}}
+	sched := &Scheduler{args: &args}
+	ap, stale, err := sched.getAP()
+	if ap == nil || !stale || err != nil {
+		t.Fatalf("Scheduler.getAP() = %v, %v, %v, want stale ap", ap, stale, err)
+	}
+	// 沿用的结果按照获取失败上报
+	if len(metrics.apFetch) != 1 || metrics.apFetch[0] == nil {
+		t.Errorf("Scheduler.getAP() observed %v, want one failure", metrics.apFetch)
+	}
+
+	// 沿用结果中的频控信息不用于刷新鉴权次数预算
+	sm := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap:       &dto.WebsocketAP{Shards: 1, SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 5}},
+	})
+	sched.sessionCtx = &botSessionCtx{sm: sm}
+	sched.refreshBudget(&shardInfo{ap: ap, apStale: stale})
+	if got := sm.IdentifyBudget().Remaining; got != 5 {
+		t.Errorf("Scheduler.refreshBudget() remaining = %v, want 5", got)
+	}
+}
+
+func Test_staticAPProvider_GetAP(t *testing.T) {
+	p := NewStaticAPProvider(&dto.WebsocketAP{URL: "ws://127.0.0.1:8080", Shards: 2})
+	ap, err := p.GetAP(context.Background())
+	if err != nil || ap.URL != "ws://127.0.0.1:8080" || ap.Shards != 2 {
+		t.Errorf("staticAPProvider.GetAP() = %v, %v", ap, err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package schedule 本文件实现基于选主的集中分区分配
+package schedule
+
+import (
+	"context"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/log"
+)
+
+// campaign 持续参与选主，当选后通知调度协程发布分配结果，失去leader身份后重新参与选主，ctx结束时放弃leader身份
+func (sched *Scheduler) campaign(ctx context.Context) {
+	for {
+		lost, err := sched.elector.Campaign(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("[Leader] campaign failed, err:%v", err)
+			select {
+			case <-time.After(DftRetryInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		log.Infof("[Leader] %v elected as leader", sched.localInstance.GetID())
+		sched.setLeader(true)
+		sched.triggerSchedule()
+		select {
+		case <-lost:
+			log.Errorf("[Leader] %v lost leadership", sched.localInstance.GetID())
+			sched.setLeader(false)
+		case <-ctx.Done():
+			sched.setLeader(false)
+			resignCtx, cancel := sched.getTimeoutCtx()
+			if err := sched.elector.Resign(resignCtx); err != nil {
+				log.Errorf("[Leader] resign failed, err:%v", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// setLeader 设置本地实例是否为leader
+func (sched *Scheduler) setLeader(leader bool) {
+	sched.stateMu.Lock()
+	defer sched.stateMu.Unlock()
+	sched.leader = leader
+}
+
+// isLeader 本地实例是否为leader
+func (sched *Scheduler) isLeader() bool {
+	sched.stateMu.RLock()
+	defer sched.stateMu.RUnlock()
+	return sched.leader
+}
+
+// setAssignment 记录收到的分配结果，只接受比当前更新的版本，返回是否更新
+func (sched *Scheduler) setAssignment(assignment *base.Assignment) bool {
+	sched.stateMu.Lock()
+	defer sched.stateMu.Unlock()
+	if sched.assignment != nil && assignment.Version <= sched.assignment.Version {
+		return false
+	}
+	sched.assignment = assignment
+	return true
+}
+
+// getAssignment 获取最近收到的分配结果，尚未收到时返回nil
+func (sched *Scheduler) getAssignment() *base.Assignment {
+	sched.stateMu.RLock()
+	defer sched.stateMu.RUnlock()
+	return sched.assignment
+}
+
+// assignedSharding 集中分配模式下的调度：leader先根据最新成员视图发布分配结果，
+// 各实例（包括leader自身）再按照收到的分配结果调整本地session
+func (sched *Scheduler) assignedSharding() error {
+	ctx, cancel := sched.getTimeoutCtx()
+	defer cancel()
+	insList, err := sched.args.Cluster.GetAllInstances(ctx)
+	if err != nil {
+		log.Errorf("get all instances failed, err:%v", err)
+		return err
+	}
+	view := newMembership(insList)
+	sched.stateMu.Lock()
+	sched.view = view
+	sched.stateMu.Unlock()
+	if sched.isLeader() {
+		if err := sched.publishAssignment(view); err != nil {
+			log.Errorf("publish assignment failed, err:%v", err)
+			return err
+		}
+	}
+	if sched.isDraining() {
+		// 正在下线，本地session由Drain负责关闭
+		return nil
+	}
+	shard, err := sched.assignedShard()
+	if err != nil {
+		log.Errorf("get assigned shard failed, err:%v", err)
+		return err
+	}
+	sched.refreshBudget(shard)
+	if sched.needReschedule(shard) {
+		if err := sched.reschedule(shard); err != nil {
+			log.Errorf("reschedule failed, err:%v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// publishAssignment 按照分配策略计算成员视图中所有实例的分区，与已发布的结果不同时发布新版本
+func (sched *Scheduler) publishAssignment(view *membership) error {
+	ctx, cancel := sched.getTimeoutCtx()
+	defer cancel()
+	ap, _, err := sched.getAP()
+	if err != nil {
+		return err
+	}
+	shardNum, err := sched.getMinShardNum(ap, uint32(len(view.instances)))
+	if err != nil {
+		return err
+	}
+	assignment := &base.Assignment{
+		Leader:   sched.localInstance.GetID(),
+		ShardNum: shardNum,
+		Shards:   sched.args.Strategy.Assign(view.instances, shardNum),
+	}
+	// 以集群中已发布的结果为准，本地收到的结果可能滞后
+	published, err := sched.elector.GetAssignment(ctx)
+	if err != nil {
+		return err
+	}
+	if published != nil {
+		if published.ShardNum == assignment.ShardNum && assignmentEqual(published.Shards, assignment.Shards) {
+			return nil
+		}
+		assignment.Version = published.Version
+	}
+	assignment.Version++
+	log.Infof("[Leader] publish assignment version:%v, shardNum:%v, view:%v",
+		assignment.Version, assignment.ShardNum, view)
+	return sched.elector.PublishAssignment(ctx, assignment)
+}
+
+// assignedShard 根据收到的分配结果获取本实例负责的分区，尚未收到分配结果或者没有分到分区时返回空分区信息
+func (sched *Scheduler) assignedShard() (*shardInfo, error) {
+	si := &shardInfo{}
+	assignment := sched.getAssignment()
+	if assignment == nil || len(assignment.Shards[sched.localInstance.GetID()]) == 0 {
+		return si, nil
+	}
+	var err error
+	if si.ap, si.apStale, err = sched.getAP(); err != nil {
+		return nil, err
+	}
+	si.shardNum = assignment.ShardNum
+	si.shardIDs = assignment.Shards[sched.localInstance.GetID()]
+	return si, nil
+}
+
+// assignmentEqual 两次分配结果中各实例的分区是否相同
+func assignmentEqual(a, b map[string][]uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, shardIDs := range a {
+		if !shardsEqual(shardIDs, b[id]) {
+			return false
+		}
+	}
+	return true
+}
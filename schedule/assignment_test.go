@@ -0,0 +1,153 @@
+package schedule
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+)
+
+// electorCluster 实现了base.LeaderElector的集群管理器
+type electorCluster struct {
+	staticCluster
+	// leader 本地实例是否可以当选
+	leader bool
+	mu     sync.Mutex
+	// published 最近发布的分配结果
+	published *base.Assignment
+	ac        chan *base.Assignment
+}
+
+// Campaign 可以当选时立即返回，否则阻塞到ctx结束
+func (m *electorCluster) Campaign(ctx context.Context) (<-chan struct{}, error) {
+	if !m.leader {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return make(chan struct{}), nil
+}
+
+// Resign 放弃leader身份
+func (m *electorCluster) Resign(ctx context.Context) error {
+	return nil
+}
+
+// PublishAssignment 发布分配结果
+func (m *electorCluster) PublishAssignment(ctx context.Context, assignment *base.Assignment) error {
+	m.mu.Lock()
+	m.published = assignment
+	m.mu.Unlock()
+	m.ac <- assignment
+	return nil
+}
+
+// GetAssignment 获取最新发布的分配结果
+func (m *electorCluster) GetAssignment(ctx context.Context) (*base.Assignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.published, nil
+}
+
+// WatchAssignment 监听分配结果
+func (m *electorCluster) WatchAssignment(ctx context.Context) (<-chan *base.Assignment, error) {
+	return m.ac, nil
+}
+
+func TestScheduler_centralAssignment(t *testing.T) {
+	tests := []struct {
+		name      string
+		leader    bool
+		published *base.Assignment
+		want      map[uint32]bool
+	}{
+		{
+			name:   "leader",
+			leader: true,
+			want:   map[uint32]bool{0: true, 2: true},
+		}, {
+			name: "follower",
+			published: &base.Assignment{Version: 3, Leader: "fakeip", ShardNum: 4,
+				Shards: map[string][]uint32{"127.0.0.1": {1, 3}, "fakeip": {0, 2}}},
+			want: map[uint32]bool{1: true, 3: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := &recordingWebSocket{shards: make(chan uint32, 10)}
+			cluster := &electorCluster{leader: tt.leader, ac: make(chan *base.Assignment, 1)}
+			cluster.insList = []base.Instance{&mockInstance{id: "fakeip"}, &mockInstance{id: "127.0.0.1"}}
+			if tt.published != nil {
+				cluster.published = tt.published
+				cluster.ac <- tt.published
+			}
+			args := NewArgs(cluster, testArgs.BotAppID, testArgs.BotToken, testArgs.Intent)
+			args.CentralAssignment = true
+			args.APProvider = NewStaticAPProvider(&dto.WebsocketAP{
+				URL:               "ws://127.0.0.1:8080",
+				Shards:            4,
+				SessionStartLimit: dto.SessionStartLimit{MaxConcurrency: 5},
+			})
+			sched, err := New(args)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			sched.wsFactory = ws
+			if err := sched.Start(context.Background()); err != nil {
+				t.Fatalf("Scheduler.Start() error = %v", err)
+			}
+			defer sched.Stop(context.Background())
+			got := make(map[uint32]bool)
+			for len(got) < len(tt.want) {
+				select {
+				case sid := <-ws.shards:
+					got[sid] = true
+				case <-time.After(5 * time.Second):
+					t.Fatalf("sessions not started, got shards %v", got)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("started shards = %v, want %v", got, tt.want)
+			}
+			status := sched.Status()
+			if status.Leader != tt.leader || status.AssignmentVersion == 0 {
+				t.Errorf("Scheduler.Status() leader = %v, assignment version = %v",
+					status.Leader, status.AssignmentVersion)
+			}
+			if published, _ := cluster.GetAssignment(context.Background()); tt.leader &&
+				(published.Version != 1 || published.Leader != "127.0.0.1" || published.ShardNum != 4) {
+				t.Errorf("published assignment = %+v", published)
+			}
+		})
+	}
+}
+
+func TestNew_centralAssignment(t *testing.T) {
+	schedArgs := testArgs
+	schedArgs.CentralAssignment = true
+	if _, err := New(&schedArgs); err == nil {
+		t.Errorf("New() with cluster not implementing base.LeaderElector should fail")
+	}
+}
+
+func Test_assignmentEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b map[string][]uint32
+		want bool
+	}{
+		{name: "same", a: map[string][]uint32{"a": {0, 1}, "b": {2}}, b: map[string][]uint32{"b": {2}, "a": {1, 0}}, want: true},
+		{name: "moved", a: map[string][]uint32{"a": {0, 1}, "b": {2}}, b: map[string][]uint32{"a": {0}, "b": {1, 2}}},
+		{name: "new instance", a: map[string][]uint32{"a": {0, 1}}, b: map[string][]uint32{"a": {0}, "b": {1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := assignmentEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("assignmentEqual() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Package schedule 本文件实现session重连的退避策略
+package schedule
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DftReconnectBackoff 默认的重连退避策略
+var DftReconnectBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+	ResetAfter: time.Minute,
+}
+
+// Backoff 重连退避策略，链接断开后等待时间从Initial开始按照Multiplier增长，最长不超过Max，
+// 链接保持超过ResetAfter后视为恢复稳定，下次断开重新从Initial开始。零值表示使用DftReconnectBackoff，
+// 否则除Jitter外的零值字段使用DftReconnectBackoff中的值
+type Backoff struct {
+	// Initial 首次重连的等待时间
+	Initial time.Duration
+	// Max 最长等待时间
+	Max time.Duration
+	// Multiplier 每次重连失败后等待时间的增长倍数，不能小于1
+	Multiplier float64
+	// Jitter 随机扰动比例，取值[0, 1]，为0时不做扰动，实际等待时间在 [d*(1-Jitter), d*(1+Jitter)] 内随机，
+	// 避免gateway故障恢复后所有分区同时重连
+	Jitter float64
+	// ResetAfter 链接保持超过该时间后重置退避
+	ResetAfter time.Duration
+}
+
+// withDefaults 使用默认值填充零值字段
+func (b Backoff) withDefaults() Backoff {
+	if b == (Backoff{}) {
+		return DftReconnectBackoff
+	}
+	if b.Initial <= 0 {
+		b.Initial = DftReconnectBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = DftReconnectBackoff.Max
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = DftReconnectBackoff.Multiplier
+	}
+	if b.Jitter < 0 {
+		b.Jitter = 0
+	}
+	if b.Jitter > 1 {
+		b.Jitter = 1
+	}
+	if b.ResetAfter <= 0 {
+		b.ResetAfter = DftReconnectBackoff.ResetAfter
+	}
+	return b
+}
+
+// next 根据上次的退避时间计算本次的退避时间，prev为0表示首次重连
+func (b Backoff) next(prev time.Duration) time.Duration {
+	if prev <= 0 {
+		return b.Initial
+	}
+	d := time.Duration(float64(prev) * b.Multiplier)
+	if d > b.Max || d < prev {
+		// d < prev 时说明发生了溢出
+		return b.Max
+	}
+	return d
+}
+
+// jitter 对退避时间做随机扰动
+func (b Backoff) jitter(d time.Duration) time.Duration {
+	delta := float64(d) * b.Jitter
+	return time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+}
@@ -0,0 +1,37 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_next(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}.withDefaults()
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	var prev time.Duration
+	for i, w := range want {
+		prev = b.next(prev)
+		if prev != w {
+			t.Errorf("Backoff.next() #%d = %v, want %v", i, prev, w)
+		}
+	}
+}
+
+func TestBackoff_withDefaults(t *testing.T) {
+	if got := (Backoff{}).withDefaults(); got != DftReconnectBackoff {
+		t.Errorf("Backoff.withDefaults() = %+v, want %+v", got, DftReconnectBackoff)
+	}
+	got := Backoff{Initial: time.Minute, Max: time.Second, Multiplier: 0.5}.withDefaults()
+	if got.Max != time.Minute || got.Multiplier != DftReconnectBackoff.Multiplier || got.Jitter != 0 {
+		t.Errorf("Backoff.withDefaults() = %+v", got)
+	}
+}
+
+func TestBackoff_jitter(t *testing.T) {
+	b := Backoff{Jitter: 0.5}.withDefaults()
+	for i := 0; i < 100; i++ {
+		if got := b.jitter(time.Second); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("Backoff.jitter() = %v, want in [500ms, 1500ms]", got)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package schedule 本文件实现鉴权（identify）次数预算管理
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tencent-connect/botgo/dto"
+)
+
+// DftBudgetRecheckInterval 预算耗尽且不知道重置时间时，重新检查预算的间隔
+const DftBudgetRecheckInterval = time.Minute
+
+// IdentifyBudget 鉴权次数预算，对应AP信息中的SessionStartLimit
+type IdentifyBudget struct {
+	// Total 预算总数，为0表示未知，不做限制
+	Total uint32
+	// Remaining 剩余可鉴权次数
+	Remaining uint32
+	// ResetAt 预算重置时间，为零值表示未知
+	ResetAt time.Time
+}
+
+// identifyBudget 跟踪剩余鉴权次数，预算耗尽时延迟鉴权到重置时间，避免频繁重连耗尽当天的鉴权次数导致机器人被限制
+type identifyBudget struct {
+	mu sync.Mutex
+	IdentifyBudget
+	// lastLimit 最近一次应用的服务端频控信息，AP信息有缓存，相同的信息不重复应用
+	lastLimit dto.SessionStartLimit
+}
+
+// newIdentifyBudget 根据AP信息中的频控信息创建预算
+func newIdentifyBudget(limit dto.SessionStartLimit) *identifyBudget {
+	b := &identifyBudget{}
+	b.update(limit)
+	return b
+}
+
+// update 使用服务端返回的最新频控信息刷新预算
+func (b *identifyBudget) update(limit dto.SessionStartLimit) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit == b.lastLimit {
+		return
+	}
+	b.lastLimit = limit
+	b.Total, b.Remaining = limit.Total, limit.Remaining
+	b.ResetAt = time.Time{}
+	if limit.ResetAfter > 0 {
+		// reset_after 单位为毫秒
+		b.ResetAt = time.Now().Add(time.Duration(limit.ResetAfter) * time.Millisecond)
+	}
+}
+
+// acquire 消耗一次鉴权预算，预算耗尽时阻塞等待到重置时间，ctx结束时返回错误
+func (b *identifyBudget) acquire(ctx context.Context, shardID uint32) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		wait, ok := b.tryAcquire()
+		if ok {
+			return nil
+		}
+		fmt.Printf("[ws/session][%v] identify budget exhausted, wait %v\n", shardID, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire 尝试消耗一次预算，失败时返回需要等待的时间
+func (b *identifyBudget) tryAcquire() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Total == 0 {
+		// 预算未知，不做限制
+		return 0, true
+	}
+	now := time.Now()
+	if !b.ResetAt.IsZero() && !now.Before(b.ResetAt) {
+		// 到达重置时间，恢复预算，下次重置时间等待刷新AP信息后得知
+		b.Remaining, b.ResetAt = b.Total, time.Time{}
+	}
+	if b.Remaining > 0 {
+		b.Remaining--
+		return 0, true
+	}
+	if b.ResetAt.IsZero() {
+		return DftBudgetRecheckInterval, false
+	}
+	return b.ResetAt.Sub(now), false
+}
+
+// refund 归还一次预算，用于已经消耗预算但是没有实际发送鉴权请求的情况，例如建立链接失败
+func (b *identifyBudget) refund() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Total > 0 && b.Remaining < b.Total {
+		b.Remaining++
+	}
+}
+
+// snapshot 获取当前预算
+func (b *identifyBudget) snapshot() IdentifyBudget {
+	if b == nil {
+		return IdentifyBudget{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.IdentifyBudget
+}
@@ -0,0 +1,65 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo/dto"
+)
+
+func Test_identifyBudget_acquire(t *testing.T) {
+	// 预算未知时不做限制
+	var nilBudget *identifyBudget
+	if err := nilBudget.acquire(context.Background(), 0); err != nil {
+		t.Errorf("identifyBudget.acquire() error = %v", err)
+	}
+	if err := newIdentifyBudget(dto.SessionStartLimit{}).acquire(context.Background(), 0); err != nil {
+		t.Errorf("identifyBudget.acquire() error = %v", err)
+	}
+
+	b := newIdentifyBudget(dto.SessionStartLimit{Total: 10, Remaining: 1, ResetAfter: 3600 * 1000})
+	if err := b.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("identifyBudget.acquire() error = %v", err)
+	}
+	if got := b.snapshot().Remaining; got != 0 {
+		t.Errorf("identifyBudget.snapshot().Remaining = %v, want 0", got)
+	}
+	// 归还后可以再次使用
+	b.refund()
+	if got := b.snapshot().Remaining; got != 1 {
+		t.Errorf("identifyBudget.refund() remaining = %v, want 1", got)
+	}
+	if err := b.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("identifyBudget.acquire() error = %v", err)
+	}
+	// 预算耗尽，需要等待到重置时间
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := b.acquire(ctx, 0); err != context.DeadlineExceeded {
+		t.Errorf("identifyBudget.acquire() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// 相同的频控信息（AP缓存）不会重置本地预算
+	b.update(dto.SessionStartLimit{Total: 10, Remaining: 1, ResetAfter: 3600 * 1000})
+	if got := b.snapshot().Remaining; got != 0 {
+		t.Errorf("identifyBudget.update() with same limit reset remaining to %v", got)
+	}
+
+	// 到达重置时间后恢复预算
+	b.mu.Lock()
+	b.ResetAt = time.Now().Add(-time.Second)
+	b.mu.Unlock()
+	if err := b.acquire(context.Background(), 0); err != nil {
+		t.Fatalf("identifyBudget.acquire() error = %v", err)
+	}
+	if got := b.snapshot(); got.Remaining != 9 || !got.ResetAt.IsZero() {
+		t.Errorf("identifyBudget.snapshot() = %+v, want remaining 9", got)
+	}
+	// 归还不会超过预算总数
+	b.refund()
+	b.refund()
+	if got := b.snapshot().Remaining; got != 10 {
+		t.Errorf("identifyBudget.refund() remaining = %v, want 10", got)
+	}
+}
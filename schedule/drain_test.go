@@ -0,0 +1,104 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+// drainerCluster 实现了base.Drainer的集群管理器
+type drainerCluster struct {
+	staticCluster
+	marked, unmarked, unregistered bool
+}
+
+// MarkDraining 将本地实例标记为下线中
+func (m *drainerCluster) MarkDraining(ctx context.Context) error {
+	m.marked = true
+	return nil
+}
+
+// UnmarkDraining 取消本地实例的下线中标记
+func (m *drainerCluster) UnmarkDraining(ctx context.Context) error {
+	m.unmarked = true
+	return nil
+}
+
+// UnregInstance 注销本地实例
+func (m *drainerCluster) UnregInstance(ctx context.Context) error {
+	m.unregistered = true
+	return nil
+}
+
+func TestScheduler_Drain(t *testing.T) {
+	cluster := &drainerCluster{}
+	cluster.insList = []base.Instance{&mockInstance{id: "ins1"}}
+	schedArgs := testArgs
+	schedArgs.Cluster = cluster
+	schedArgs.DrainDelay = 50 * time.Millisecond
+	sched, err := New(&schedArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+
+	begin := time.Now()
+	if err := sched.Drain(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Drain() error = %v", err)
+	}
+	if cost := time.Since(begin); cost < schedArgs.DrainDelay {
+		t.Errorf("Scheduler.Drain() returned after %v, want >= %v", cost, schedArgs.DrainDelay)
+	}
+	status := sched.Status()
+	if !cluster.marked || !cluster.unregistered || !status.Draining || status.Running {
+		t.Errorf("Scheduler.Drain() marked = %v, unregistered = %v, status = %+v",
+			cluster.marked, cluster.unregistered, status)
+	}
+}
+
+func TestScheduler_Drain_canceled(t *testing.T) {
+	cluster := &drainerCluster{}
+	cluster.insList = []base.Instance{&mockInstance{id: "ins1"}}
+	schedArgs := testArgs
+	schedArgs.Cluster = cluster
+	schedArgs.DrainDelay = time.Minute
+	sched, err := New(&schedArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+	defer sched.Stop(context.Background())
+
+	// 等待下线期间ctx结束，回滚下线中标记，不关闭session也不注销
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sched.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Scheduler.Drain() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	status := sched.Status()
+	if !cluster.marked || !cluster.unmarked || cluster.unregistered || status.Draining || !status.Running {
+		t.Errorf("Scheduler.Drain() marked = %v, unmarked = %v, unregistered = %v, status = %+v",
+			cluster.marked, cluster.unmarked, cluster.unregistered, status)
+	}
+}
+
+func TestScheduler_sharding_draining(t *testing.T) {
+	// mockCluster获取实例列表会失败，下线期间不再调度，不会访问集群管理器
+	sched, err := New(&testArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := sched.sharding(); err == nil {
+		t.Fatalf("Scheduler.sharding() want error")
+	}
+	sched.setDraining(true)
+	if err := sched.sharding(); err != nil {
+		t.Errorf("Scheduler.sharding() while draining error = %v", err)
+	}
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -46,6 +47,8 @@ func main() {
 	// 创建调度器参数
 	schedArgs := schedule.NewArgs(cluster, botAppID, botToken,
 		websocket.RegisterHandlers(websocket.ATMessageEventHandler(msgHandler)))
+	// 退出时注销本地实例，让其他实例尽快接手分区
+	schedArgs.UnregOnStop = true
 	// 创建调度器，默认会按照AP的shards进行分区，用户也可以自己指定 schedArgs.MinShardNum
 	sched, err := schedule.New(schedArgs)
 	if err != nil {
@@ -53,13 +56,13 @@ func main() {
 		return
 	}
 	// 启动调度
-	err = sched.Start()
+	err = sched.Start(context.Background())
 	if err != nil {
 		fmt.Printf("Start failed. err:%v\n", err)
 		return
 	}
 	// 挂起当前线程
-	waitExit(cluster)
+	waitExit(sched, cluster)
 }
 
 // msgHandler 消息处理
@@ -68,14 +71,19 @@ func msgHandler(event *dto.WSPayload, m *dto.WSATMessageData) error {
 	return nil
 }
 
-func waitExit(cluster base.Cluster) {
+func waitExit(sched *schedule.Scheduler, cluster base.Cluster) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 	fmt.Println("exit")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	// 为了避免服务重启频繁触发集群重新调度，这里反注册也可以去掉，只依赖实例超时来删除实例
-	// 这样如果实例能够快速重启，那么其他实例甚至感觉不出来集群变化，避免了频发调度
-	_ = cluster.UnregInstance(ctx)
+	// 先标记下线让其他实例接手分区，再关闭所有bot session并注销本地实例
+	if err := sched.Drain(ctx); err != nil {
+		fmt.Printf("drain failed. err:%v\n", err)
+	}
+	// 关闭etcd链接
+	if closer, ok := cluster.(io.Closer); ok {
+		_ = closer.Close()
+	}
 }
@@ -0,0 +1,58 @@
+// Package schedule 本文件实现致命错误的上报处理
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/tencent-connect/botgo/log"
+)
+
+// DftErrChanSize 致命错误channel默认缓冲长度
+const DftErrChanSize = 16
+
+// ErrCanNotIdentify 机器人被下架、封禁，或者开启Args.StopOnInvalidAuth时token、intent等鉴权参数错误，无法再建立链接，可以通过errors.Is判断
+var ErrCanNotIdentify = errors.New("can not identify")
+
+// DftOnFatal 默认的致命错误处理，打印日志后退出进程，与旧版本行为保持一致。
+// 多个机器人共用同一进程时，建议设置 Args.OnFatal 自行决定退出进程、重启组件还是只停用出错的机器人
+func DftOnFatal(err error) {
+	log.Errorf("[Fatal]err:%v, process exit", err)
+	os.Exit(-1)
+}
+
+// Errors 返回致命错误channel，上报致命错误时会同时写入该channel，channel写满后新的错误会被丢弃
+func (sched *Scheduler) Errors() <-chan error {
+	return sched.errChan
+}
+
+// fatal 上报致命错误
+func (sched *Scheduler) fatal(err error) {
+	select {
+	case sched.errChan <- err:
+	default:
+	}
+	onFatal := sched.args.OnFatal
+	if onFatal == nil {
+		onFatal = DftOnFatal
+	}
+	onFatal(err)
+}
+
+// fatal 上报致命错误，由调度器创建时会转交给调度器处理
+func (mgr *SessionManager) fatal(err error) {
+	onFatal := mgr.onFatal
+	if onFatal == nil {
+		onFatal = DftOnFatal
+	}
+	onFatal(err)
+}
+
+// panicError 将recover得到的panic信息转换为错误，附带调用堆栈
+func panicError(tag string, r interface{}) error {
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	return fmt.Errorf("[%s]panic:%v, stack:\n%s", tag, r, buf)
+}
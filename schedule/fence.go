@@ -0,0 +1,54 @@
+// Package schedule 本文件实现本地实例租约失效后的隔离
+package schedule
+
+import (
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/log"
+)
+
+// handleLocalEvents 根据本地实例相关的集群事件更新隔离状态。本地实例租约失效后，其他实例会认为本实例已经下线并接手分区，
+// 此时可能也无法访问集群管理器，因此不等待调度直接关闭本地session，直到本地实例重新注册才解除隔离，避免同一分区被两个实例同时消费。
+// 租约失效时实例节点可能已经删除，也可能还没有删除，重新注册分别对应本地实例的InstanceAdded与InstanceUpdated事件。
+// 返回本次是否因为租约失效关闭了session
+func (sched *Scheduler) handleLocalEvents(events []base.Event) bool {
+	lost := false
+	for _, ev := range events {
+		ins := ev.GetInstance()
+		if ins == nil || ins.GetID() != sched.localInstance.GetID() {
+			continue
+		}
+		switch ev.GetType() {
+		case base.EventTypeLeaseLost:
+			log.Errorf("[Fence] lease of local instance lost, stop sessions until re-registered")
+			sched.setFenced(true)
+			lost = true
+		case base.EventTypeInstanceAdded, base.EventTypeInstanceUpdated:
+			// 隔离期间本地实例节点被写入，说明已经使用新的租约重新注册
+			if sched.isFenced() {
+				log.Infof("[Fence] local instance re-registered")
+				sched.setFenced(false)
+			}
+		}
+	}
+	if lost {
+		// 同一批事件中可能已经重新注册，但是期间分区可能已经被其他实例接手，仍然需要先关闭session再重新调度
+		if err := sched.stopSessions(); err != nil {
+			log.Errorf("[Fence] stop sessions failed, err:%v", err)
+		}
+	}
+	return lost
+}
+
+// setFenced 设置本地实例是否处于隔离状态
+func (sched *Scheduler) setFenced(fenced bool) {
+	sched.stateMu.Lock()
+	defer sched.stateMu.Unlock()
+	sched.fenced = fenced
+}
+
+// isFenced 本地实例是否处于隔离状态
+func (sched *Scheduler) isFenced() bool {
+	sched.stateMu.RLock()
+	defer sched.stateMu.RUnlock()
+	return sched.fenced
+}
@@ -0,0 +1,161 @@
+package schedule
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+)
+
+// eventCluster 由测试推送集群事件的集群管理器
+type eventCluster struct {
+	staticCluster
+	wc chan *base.WatchResponse
+}
+
+// Watch 监听集群事件
+func (m *eventCluster) Watch(ctx context.Context) (base.WatchChan, error) {
+	return m.wc, nil
+}
+
+func TestScheduler_handleLocalEvents(t *testing.T) {
+	local := &mockInstance{id: "127.0.0.1"}
+	other := &mockInstance{id: "fakeip"}
+	tests := []struct {
+		name       string
+		fenced     bool
+		events     []base.Event
+		wantLost   bool
+		wantFenced bool
+	}{
+		{
+			name:       "local lease lost",
+			events:     []base.Event{base.NewEvent(base.EventTypeLeaseLost, local, 0)},
+			wantLost:   true,
+			wantFenced: true,
+		}, {
+			name:       "other instance ignored",
+			events:     []base.Event{base.NewEvent(base.EventTypeLeaseLost, other, 0)},
+			wantFenced: false,
+		}, {
+			name:       "re-registered",
+			fenced:     true,
+			events:     []base.Event{base.NewEvent(base.EventTypeInstanceAdded, local, 1)},
+			wantFenced: false,
+		}, {
+			name:   "lost and re-registered in one response",
+			fenced: false,
+			events: []base.Event{
+				base.NewEvent(base.EventTypeLeaseLost, local, 0),
+				base.NewEvent(base.EventTypeInstanceAdded, local, 2),
+				base.NewEvent(base.EventTypeInsChanged, nil, 2),
+			},
+			wantLost:   true,
+			wantFenced: false,
+		}, {
+			name:       "re-registered before node removed",
+			fenced:     true,
+			events:     []base.Event{base.NewEvent(base.EventTypeInstanceUpdated, local, 1)},
+			wantFenced: false,
+		}, {
+			name: "lost and re-registered before node removed in one response",
+			events: []base.Event{
+				base.NewEvent(base.EventTypeLeaseLost, local, 0),
+				base.NewEvent(base.EventTypeInstanceUpdated, local, 2),
+			},
+			wantLost:   true,
+			wantFenced: false,
+		}, {
+			name:       "updated without lease lost",
+			events:     []base.Event{base.NewEvent(base.EventTypeInstanceUpdated, local, 1)},
+			wantFenced: false,
+		}, {
+			name:       "other updated keeps fenced",
+			fenced:     true,
+			events:     []base.Event{base.NewEvent(base.EventTypeInstanceUpdated, other, 1)},
+			wantFenced: true,
+		}, {
+			name:       "other added keeps fenced",
+			fenced:     true,
+			events:     []base.Event{base.NewEvent(base.EventTypeInstanceAdded, other, 1)},
+			wantFenced: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched := &Scheduler{args: &testArgs, localInstance: local, fenced: tt.fenced}
+			if got := sched.handleLocalEvents(tt.events); got != tt.wantLost {
+				t.Errorf("Scheduler.handleLocalEvents() = %v, want %v", got, tt.wantLost)
+			}
+			if got := sched.isFenced(); got != tt.wantFenced {
+				t.Errorf("Scheduler.isFenced() = %v, want %v", got, tt.wantFenced)
+			}
+		})
+	}
+}
+
+func TestScheduler_sharding_fenced(t *testing.T) {
+	// mockCluster获取实例列表会失败，隔离期间不再调度，不会访问集群管理器
+	sched, err := New(&testArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	sched.setFenced(true)
+	if err := sched.sharding(); err != nil {
+		t.Errorf("Scheduler.sharding() while fenced error = %v", err)
+	}
+}
+
+func TestScheduler_fence(t *testing.T) {
+	ws := &recordingWebSocket{shards: make(chan uint32, 10)}
+	cluster := &eventCluster{wc: make(chan *base.WatchResponse, 1)}
+	cluster.insList = []base.Instance{&mockInstance{id: "127.0.0.1"}}
+	cluster.wc <- base.NewWatchRsp(base.EventTypeInsChanged)
+	args := NewArgs(cluster, testArgs.BotAppID, testArgs.BotToken, testArgs.Intent)
+	args.APProvider = NewStaticAPProvider(&dto.WebsocketAP{
+		URL:               "ws://127.0.0.1:8080",
+		Shards:            1,
+		SessionStartLimit: dto.SessionStartLimit{MaxConcurrency: 5},
+	})
+	sched, err := New(args)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	sched.wsFactory = ws
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+	defer sched.Stop(context.Background())
+	waitStatus := func(desc string, ok func(Status) bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if ok(sched.Status()) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%v, status = %+v", desc, sched.Status())
+	}
+	waitStatus("sessions not started", func(s Status) bool { return len(s.ShardIDs) == 1 })
+
+	local := &mockInstance{id: "127.0.0.1"}
+	cluster.wc <- base.NewWatchRspWithEvents(base.NewEvent(base.EventTypeLeaseLost, local, 0))
+	waitStatus("sessions not fenced", func(s Status) bool { return s.Fenced && len(s.ShardIDs) == 0 })
+
+	cluster.wc <- base.NewWatchRspWithEvents(
+		base.NewEvent(base.EventTypeInstanceAdded, local, 1),
+		base.NewEvent(base.EventTypeInsChanged, nil, 1),
+	)
+	waitStatus("sessions not restarted", func(s Status) bool { return !s.Fenced && len(s.ShardIDs) == 1 })
+
+	// 租约失效时实例节点还没有删除，重新注册只会推送InstanceUpdated事件
+	cluster.wc <- base.NewWatchRspWithEvents(base.NewEvent(base.EventTypeLeaseLost, local, 0))
+	waitStatus("sessions not fenced again", func(s Status) bool { return s.Fenced && len(s.ShardIDs) == 0 })
+	cluster.wc <- base.NewWatchRspWithEvents(
+		base.NewEvent(base.EventTypeInstanceUpdated, local, 2),
+		base.NewEvent(base.EventTypeInsChanged, nil, 2),
+	)
+	waitStatus("sessions not restarted after update", func(s Status) bool { return !s.Fenced && len(s.ShardIDs) == 1 })
+}
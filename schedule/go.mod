@@ -2,8 +2,11 @@ module github.com/tencent-connect/botgo-plugins/schedule
 
 go 1.15
 
+replace github.com/tencent-connect/botgo-plugins/cluster/base => ../cluster/base
+
 require (
 	github.com/agiledragon/gomonkey/v2 v2.2.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/tencent-connect/botgo v0.0.0-20220107114259-b63d73f6aab7
 	github.com/tencent-connect/botgo-plugins/cluster/base v0.0.0-20211124073815-757ae5fa4913
 )
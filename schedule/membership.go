@@ -0,0 +1,68 @@
+// Package schedule 本文件实现集群成员视图
+package schedule
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+// membership 集群成员视图，有效实例按照id排序去重，保证各实例在成员相同时看到完全一致的视图，
+// 不依赖集群管理器返回实例列表的顺序。下线中的实例不再分配分区，因此不在视图中
+type membership struct {
+	// instances 排序后的有效实例列表
+	instances []base.Instance
+	// version 成员视图指纹，由排序后的实例id计算得到，成员相同则指纹相同
+	version string
+}
+
+// newMembership 根据集群实例列表构造成员视图
+func newMembership(allIns []base.Instance) *membership {
+	m := &membership{}
+	seen := make(map[string]bool, len(allIns))
+	for _, ins := range allIns {
+		if !ins.IsValid() || ins.IsDraining() || seen[ins.GetID()] {
+			// 跳过无效、下线中以及重复的instance
+			continue
+		}
+		seen[ins.GetID()] = true
+		m.instances = append(m.instances, ins)
+	}
+	sort.SliceStable(m.instances, func(i, j int) bool {
+		return m.instances[i].GetID() < m.instances[j].GetID()
+	})
+	h := fnv.New64a()
+	for _, ins := range m.instances {
+		_, _ = h.Write([]byte(ins.GetID()))
+		// 分隔符，避免不同id拼接后结果相同
+		_, _ = h.Write([]byte{0})
+	}
+	m.version = fmt.Sprintf("%016x", h.Sum64())
+	return m
+}
+
+// contains 视图中是否包含指定实例
+func (m *membership) contains(id string) bool {
+	for _, ins := range m.instances {
+		if ins.GetID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// isSame 两个视图成员是否一致
+func (m *membership) isSame(other *membership) bool {
+	return other != nil && m.version == other.version && len(m.instances) == len(other.instances)
+}
+
+// String 输出视图信息
+func (m *membership) String() string {
+	ids := make([]string, 0, len(m.instances))
+	for _, ins := range m.instances {
+		ids = append(ids, ins.GetID())
+	}
+	return fmt.Sprintf("{version:%s, instances:%v}", m.version, ids)
+}
@@ -0,0 +1,73 @@
+package schedule
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+)
+
+func Test_newMembership(t *testing.T) {
+	insList := []base.Instance{
+		&mockInstance{id: "c"},
+		&mockInstance{id: ""},
+		&mockInstance{id: "a"},
+		&mockInstance{id: "b"},
+		&mockInstance{id: "a"},
+		&mockInstance{id: "d", draining: true},
+	}
+	view := newMembership(insList)
+	var ids []string
+	for _, ins := range view.instances {
+		ids = append(ids, ins.GetID())
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("newMembership() instances = %v, want %v", ids, want)
+	}
+	reordered := newMembership([]base.Instance{
+		&mockInstance{id: "b"},
+		&mockInstance{id: "c"},
+		&mockInstance{id: "a"},
+	})
+	if !view.isSame(reordered) {
+		t.Errorf("newMembership() version depends on instance order: %v, %v", view, reordered)
+	}
+	if view.isSame(newMembership(insList[:3])) {
+		t.Errorf("newMembership() different members got the same version")
+	}
+}
+
+// Test_calShard_cluster 模拟集群内每个实例看到顺序不同的实例列表，校验所有分区有且只有一个实例负责
+func Test_calShard_cluster(t *testing.T) {
+	const shardNum = 17
+	strategies := map[string]Strategy{
+		"modulo":     NewModuloStrategy(),
+		"rendezvous": NewRendezvousStrategy(),
+	}
+	r := rand.New(rand.NewSource(1))
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			args := testArgs
+			args.Strategy = strategy
+			args.APProvider = NewStaticAPProvider(&dto.WebsocketAP{Shards: shardNum})
+			allIns := newMockInsList(5)
+			assignment := make(map[string][]uint32)
+			for _, self := range allIns {
+				// 每个实例拿到的实例列表顺序都不相同
+				insList := append([]base.Instance(nil), allIns...)
+				r.Shuffle(len(insList), func(i, j int) {
+					insList[i], insList[j] = insList[j], insList[i]
+				})
+				sched := &Scheduler{args: &args, localInstance: self}
+				si, err := sched.calShard(newMembership(insList))
+				if err != nil {
+					t.Fatalf("Scheduler.calShard() error = %v", err)
+				}
+				assignment[self.GetID()] = si.shardIDs
+			}
+			checkAssignment(t, assignment, shardNum)
+		})
+	}
+}
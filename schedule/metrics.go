@@ -0,0 +1,67 @@
+// Package schedule 本文件定义调度与session的监控上报接口
+package schedule
+
+// Metrics 调度与session监控上报接口，通过Args.Metrics设置，默认不上报。
+// 实现方需要保证并发安全，并且不能阻塞调用方。Prometheus实现见 schedule/prometheus 模块。
+// 注意ws没有暴露心跳的发送与回包时间，因此无法上报心跳耗时
+type Metrics interface {
+	// ObserveSharding 一次调度检查完成，err不为nil表示调度失败
+	ObserveSharding(err error)
+	// ObserveReschedule 重新分区，incremental表示是否只增量调整增减的分区，shardCount为本实例负责的分区数
+	ObserveReschedule(incremental bool, shardCount int)
+	// ObserveAPFetch 获取接入点信息完成，err不为nil表示获取失败
+	ObserveAPFetch(err error)
+	// ObserveConnect 分区鉴权或者resume完成，err不为nil表示失败
+	ObserveConnect(shardID uint32, resume bool, err error)
+	// ObserveReconnect 分区链接断开，准备重连
+	ObserveReconnect(shardID uint32)
+	// ObserveEvents 分区收到事件，n为根据事件序号增量估算的事件数
+	ObserveEvents(shardID uint32, n uint32)
+	// ObserveShardState 分区链接状态变化
+	ObserveShardState(shardID uint32, state ShardState)
+	// ObserveIdentifyBudget 鉴权次数预算变化，包括刷新AP信息、鉴权消耗以及建立链接失败后归还预算
+	ObserveIdentifyBudget(budget IdentifyBudget)
+}
+
+// nopMetrics 不做任何上报的默认实现
+type nopMetrics struct{}
+
+// ObserveSharding 一次调度检查完成
+func (nopMetrics) ObserveSharding(err error) {}
+
+// ObserveReschedule 重新分区
+func (nopMetrics) ObserveReschedule(incremental bool, shardCount int) {}
+
+// ObserveAPFetch 获取接入点信息完成
+func (nopMetrics) ObserveAPFetch(err error) {}
+
+// ObserveConnect 分区鉴权或者resume完成
+func (nopMetrics) ObserveConnect(shardID uint32, resume bool, err error) {}
+
+// ObserveReconnect 分区链接断开
+func (nopMetrics) ObserveReconnect(shardID uint32) {}
+
+// ObserveEvents 分区收到事件
+func (nopMetrics) ObserveEvents(shardID uint32, n uint32) {}
+
+// ObserveShardState 分区链接状态变化
+func (nopMetrics) ObserveShardState(shardID uint32, state ShardState) {}
+
+// ObserveIdentifyBudget 鉴权次数预算变化
+func (nopMetrics) ObserveIdentifyBudget(budget IdentifyBudget) {}
+
+// metrics 获取监控上报接口，未设置时返回不做上报的默认实现
+func (sched *Scheduler) metrics() Metrics {
+	if sched.args == nil || sched.args.Metrics == nil {
+		return nopMetrics{}
+	}
+	return sched.args.Metrics
+}
+
+// getMetrics 获取监控上报接口，未设置时返回不做上报的默认实现
+func (mgr *SessionManager) getMetrics() Metrics {
+	if mgr.metrics == nil {
+		return nopMetrics{}
+	}
+	return mgr.metrics
+}
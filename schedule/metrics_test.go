@@ -0,0 +1,157 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/token"
+)
+
+// recordingMetrics 记录上报内容的Metrics
+type recordingMetrics struct {
+	nopMetrics
+	mu         sync.Mutex
+	sharding   []error
+	apFetch    []error
+	connects   []bool
+	reconnects int
+	events     uint32
+	states     []ShardState
+	budgets    []IdentifyBudget
+}
+
+// ObserveSharding 一次调度检查完成
+func (m *recordingMetrics) ObserveSharding(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sharding = append(m.sharding, err)
+}
+
+// ObserveAPFetch 获取接入点信息完成
+func (m *recordingMetrics) ObserveAPFetch(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apFetch = append(m.apFetch, err)
+}
+
+// ObserveConnect 分区鉴权或者resume完成
+func (m *recordingMetrics) ObserveConnect(shardID uint32, resume bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connects = append(m.connects, resume)
+}
+
+// ObserveReconnect 分区链接断开
+func (m *recordingMetrics) ObserveReconnect(shardID uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects++
+}
+
+// ObserveEvents 分区收到事件
+func (m *recordingMetrics) ObserveEvents(shardID uint32, n uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events += n
+}
+
+// ObserveShardState 分区链接状态变化
+func (m *recordingMetrics) ObserveShardState(shardID uint32, state ShardState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states = append(m.states, state)
+}
+
+// ObserveIdentifyBudget 鉴权次数预算变化
+func (m *recordingMetrics) ObserveIdentifyBudget(budget IdentifyBudget) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.budgets = append(m.budgets, budget)
+}
+
+func Test_sessionHolder_metrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	mgr.limiter = nil
+	mgr.metrics = metrics
+	holder := mgr.newHolder(1)
+	holder.ws = &resumableWebSocket{}
+
+	// 首次identify，之后resume
+	holder.connectAndListen()
+	holder.connectAndListen()
+	if !reflect.DeepEqual(metrics.connects, []bool{false, true}) {
+		t.Errorf("ObserveConnect() resume = %v, want [false true]", metrics.connects)
+	}
+	// 第一次链接收到10个事件，resume后seq没有变化
+	if metrics.events != 10 {
+		t.Errorf("ObserveEvents() total = %v, want 10", metrics.events)
+	}
+	want := []ShardState{ShardStateConnecting, ShardStateIdentifying, ShardStateConnected,
+		ShardStateConnecting, ShardStateResuming, ShardStateConnected}
+	if !reflect.DeepEqual(metrics.states, want) {
+		t.Errorf("ObserveShardState() states = %v, want %v", metrics.states, want)
+	}
+}
+
+func TestScheduler_sharding_metrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	schedArgs := testArgs
+	schedArgs.Metrics = metrics
+	schedArgs.Cluster = &staticCluster{insList: []base.Instance{&mockInstance{id: "127.0.0.1"}}}
+	schedArgs.APProvider = &failingAPProvider{}
+	sched, err := New(&schedArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := sched.sharding(); err == nil {
+		t.Fatalf("Scheduler.sharding() want error")
+	}
+	if len(metrics.sharding) != 1 || metrics.sharding[0] == nil || len(metrics.apFetch) != 1 || metrics.apFetch[0] == nil {
+		t.Errorf("Scheduler.sharding() metrics sharding = %v, apFetch = %v", metrics.sharding, metrics.apFetch)
+	}
+}
+
+// failingAPProvider 获取接入点信息总是失败
+type failingAPProvider struct{}
+
+// GetAP 获取接入点信息
+func (p *failingAPProvider) GetAP(ctx context.Context) (*dto.WebsocketAP, error) {
+	return nil, errors.New("ap failed")
+}
+
+func Test_sessionHolder_budgetRefund(t *testing.T) {
+	metrics := &recordingMetrics{}
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap: &dto.WebsocketAP{
+			Shards:            1,
+			SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 10},
+		},
+	})
+	mgr.limiter = nil
+	mgr.metrics = metrics
+	holder := mgr.newHolder(0)
+	ws := &flakyWebSocket{fail: true}
+	holder.ws = ws
+
+	// 建立链接失败时没有发送鉴权请求，归还预算
+	holder.connectAndListen()
+	want := []IdentifyBudget{{Total: 10, Remaining: 9}, {Total: 10, Remaining: 10}}
+	if !reflect.DeepEqual(metrics.budgets, want) {
+		t.Errorf("ObserveIdentifyBudget() budgets = %+v, want %+v", metrics.budgets, want)
+	}
+
+	// 发送了鉴权请求后才真正消耗预算
+	ws.fail = false
+	holder.connectAndListen()
+	if got := mgr.IdentifyBudget().Remaining; got != 9 {
+		t.Errorf("SessionManager.IdentifyBudget().Remaining = %v, want 9", got)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/tencent-connect/botgo-plugins/schedule/prometheus
+
+go 1.15
+
+replace github.com/tencent-connect/botgo-plugins/schedule => ../
+
+replace github.com/tencent-connect/botgo-plugins/cluster/base => ../../cluster/base
+
+require (
+	github.com/prometheus/client_golang v1.11.0
+	github.com/tencent-connect/botgo-plugins/schedule v0.0.0-00010101000000-000000000000
+)
@@ -0,0 +1,159 @@
+// Package prometheus schedule模块监控上报接口的Prometheus实现，单独作为一个模块，避免schedule模块强制依赖Prometheus
+package prometheus
+
+import (
+	"strconv"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/tencent-connect/botgo-plugins/schedule"
+)
+
+// DftNamespace 默认的指标命名空间
+const DftNamespace = "botgo"
+
+// shardStates 分区的所有链接状态，状态变化时当前状态置为1，其余状态置为0
+var shardStates = []schedule.ShardState{
+	schedule.ShardStateWaiting,
+	schedule.ShardStateConnecting,
+	schedule.ShardStateIdentifying,
+	schedule.ShardStateResuming,
+	schedule.ShardStateConnected,
+	schedule.ShardStateBackoff,
+	schedule.ShardStateStopped,
+}
+
+// Metrics schedule.Metrics的Prometheus实现
+type Metrics struct {
+	sharding    *prom.CounterVec
+	reschedules *prom.CounterVec
+	ownedShards prom.Gauge
+	apFetches   *prom.CounterVec
+	connects    *prom.CounterVec
+	reconnects  *prom.CounterVec
+	events      *prom.CounterVec
+	shardState  *prom.GaugeVec
+	budget      *prom.GaugeVec
+}
+
+// New 创建Prometheus监控上报，并将指标注册到reg，namespace为空时使用DftNamespace
+func New(namespace string, reg prom.Registerer) (*Metrics, error) {
+	if namespace == "" {
+		namespace = DftNamespace
+	}
+	m := &Metrics{
+		sharding: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "schedule", Name: "sharding_total",
+			Help: "Number of sharding checks, partitioned by result.",
+		}, []string{"result"}),
+		reschedules: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "schedule", Name: "reschedules_total",
+			Help: "Number of reschedules, partitioned by mode (incremental or full).",
+		}, []string{"mode"}),
+		ownedShards: prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace, Subsystem: "schedule", Name: "owned_shards",
+			Help: "Number of shards assigned to the local instance.",
+		}),
+		apFetches: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "schedule", Name: "ap_fetches_total",
+			Help: "Number of gateway ap fetches, partitioned by result.",
+		}, []string{"result"}),
+		connects: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "session", Name: "connects_total",
+			Help: "Number of identify and resume attempts, partitioned by shard, type and result.",
+		}, []string{"shard", "type", "result"}),
+		reconnects: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "session", Name: "reconnects_total",
+			Help: "Number of session reconnects, partitioned by shard.",
+		}, []string{"shard"}),
+		events: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace, Subsystem: "session", Name: "events_total",
+			Help: "Number of events received, estimated from sequence numbers, partitioned by shard.",
+		}, []string{"shard"}),
+		shardState: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace, Subsystem: "session", Name: "state",
+			Help: "Current session state of each shard, 1 for the current state and 0 for others.",
+		}, []string{"shard", "state"}),
+		budget: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace, Subsystem: "session", Name: "identify_budget",
+			Help: "Identify budget from the gateway session start limit, partitioned by kind (limit or remaining).",
+		}, []string{"kind"}),
+	}
+	collectors := []prom.Collector{m.sharding, m.reschedules, m.ownedShards, m.apFetches,
+		m.connects, m.reconnects, m.events, m.shardState, m.budget}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveSharding 一次调度检查完成
+func (m *Metrics) ObserveSharding(err error) {
+	m.sharding.WithLabelValues(result(err)).Inc()
+}
+
+// ObserveReschedule 重新分区
+func (m *Metrics) ObserveReschedule(incremental bool, shardCount int) {
+	mode := "full"
+	if incremental {
+		mode = "incremental"
+	}
+	m.reschedules.WithLabelValues(mode).Inc()
+	m.ownedShards.Set(float64(shardCount))
+}
+
+// ObserveAPFetch 获取接入点信息完成
+func (m *Metrics) ObserveAPFetch(err error) {
+	m.apFetches.WithLabelValues(result(err)).Inc()
+}
+
+// ObserveConnect 分区鉴权或者resume完成
+func (m *Metrics) ObserveConnect(shardID uint32, resume bool, err error) {
+	typ := "identify"
+	if resume {
+		typ = "resume"
+	}
+	m.connects.WithLabelValues(shard(shardID), typ, result(err)).Inc()
+}
+
+// ObserveReconnect 分区链接断开
+func (m *Metrics) ObserveReconnect(shardID uint32) {
+	m.reconnects.WithLabelValues(shard(shardID)).Inc()
+}
+
+// ObserveEvents 分区收到事件
+func (m *Metrics) ObserveEvents(shardID uint32, n uint32) {
+	m.events.WithLabelValues(shard(shardID)).Add(float64(n))
+}
+
+// ObserveShardState 分区链接状态变化
+func (m *Metrics) ObserveShardState(shardID uint32, state schedule.ShardState) {
+	sid := shard(shardID)
+	for _, s := range shardStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		m.shardState.WithLabelValues(sid, string(s)).Set(v)
+	}
+}
+
+// ObserveIdentifyBudget 鉴权次数预算变化
+func (m *Metrics) ObserveIdentifyBudget(budget schedule.IdentifyBudget) {
+	m.budget.WithLabelValues("limit").Set(float64(budget.Total))
+	m.budget.WithLabelValues("remaining").Set(float64(budget.Remaining))
+}
+
+// result 将错误转换为结果标签
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// shard 将分区id转换为标签
+func shard(shardID uint32) string {
+	return strconv.FormatUint(uint64(shardID), 10)
+}
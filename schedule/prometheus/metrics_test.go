@@ -0,0 +1,59 @@
+package prometheus
+
+import (
+	"errors"
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tencent-connect/botgo-plugins/schedule"
+)
+
+// 编译期检查是否实现了schedule.Metrics
+var _ schedule.Metrics = (*Metrics)(nil)
+
+func TestMetrics(t *testing.T) {
+	reg := prom.NewRegistry()
+	m, err := New("", reg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := New("", reg); err == nil {
+		t.Errorf("New() register twice want error")
+	}
+
+	m.ObserveSharding(nil)
+	m.ObserveSharding(errors.New("failed"))
+	m.ObserveReschedule(true, 3)
+	m.ObserveAPFetch(errors.New("failed"))
+	m.ObserveConnect(1, true, nil)
+	m.ObserveReconnect(1)
+	m.ObserveEvents(1, 5)
+	m.ObserveEvents(1, 2)
+	m.ObserveShardState(1, schedule.ShardStateConnecting)
+	m.ObserveShardState(1, schedule.ShardStateConnected)
+	m.ObserveIdentifyBudget(schedule.IdentifyBudget{Total: 1000, Remaining: 998})
+
+	tests := []struct {
+		name string
+		c    prom.Collector
+		want float64
+	}{
+		{name: "sharding failure", c: m.sharding.WithLabelValues("failure"), want: 1},
+		{name: "incremental reschedule", c: m.reschedules.WithLabelValues("incremental"), want: 1},
+		{name: "owned shards", c: m.ownedShards, want: 3},
+		{name: "ap fetch failure", c: m.apFetches.WithLabelValues("failure"), want: 1},
+		{name: "resume success", c: m.connects.WithLabelValues("1", "resume", "success"), want: 1},
+		{name: "reconnects", c: m.reconnects.WithLabelValues("1"), want: 1},
+		{name: "events", c: m.events.WithLabelValues("1"), want: 7},
+		{name: "connected", c: m.shardState.WithLabelValues("1", "connected"), want: 1},
+		{name: "connecting", c: m.shardState.WithLabelValues("1", "connecting"), want: 0},
+		{name: "budget limit", c: m.budget.WithLabelValues("limit"), want: 1000},
+		{name: "budget remaining", c: m.budget.WithLabelValues("remaining"), want: 998},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(tt.c); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
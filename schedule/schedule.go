@@ -6,16 +6,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"runtime"
 	"sync"
 	"time"
 
-	"github.com/tencent-connect/botgo"
 	"github.com/tencent-connect/botgo-plugins/cluster/base"
 	"github.com/tencent-connect/botgo/dto"
 	"github.com/tencent-connect/botgo/log"
 	"github.com/tencent-connect/botgo/token"
+	"github.com/tencent-connect/botgo/websocket"
 )
 
 const (
@@ -23,6 +21,10 @@ const (
 	DftWatchInterval = time.Minute
 	// MaxShardNum 最大分区数 10000
 	MaxShardNum = uint32(10000)
+	// DftRetryInterval 调度失败后的重试间隔
+	DftRetryInterval = time.Second
+	// DftDrainDelay 实例标记为下线中后，等待其他实例接手分区的默认时间
+	DftDrainDelay = 3 * time.Second
 )
 
 // Args 调度参数
@@ -42,8 +44,42 @@ type Args struct {
 	// 以支持单次调度失败时后续能够自动恢复，以及基础侧更新AP最小分区数的场景下能够自动按照最新
 	// 的AP最小分区数进行重新分区
 	WatchInterval time.Duration
+	// UnregOnStop Stop时是否注销本地实例，为了避免服务重启频繁触发集群重新调度，默认不注销，
+	// 只依赖实例超时来删除实例，这样如果实例能够快速重启，其他实例甚至感觉不到集群变化
+	UnregOnStop bool
 	// MinShardNum 最小分区数，不能超过MaxShardNum，调度时取MinShardNum和AP信息中的Shards的较大值作为分区总数
 	MinShardNum uint32
+	// ShardOwnership 是否开启分区归属检查，开启后Cluster需要实现base.ShardOwner接口，
+	// 启动分区session前需要先获取分区归属，避免调整分区期间同一分区被多个实例同时消费
+	ShardOwnership bool
+	// OnFatal 致命错误回调，例如机器人被封禁无法再鉴权、调度协程异常退出等，默认为DftOnFatal，
+	// 会直接退出进程。也可以通过Scheduler.Errors获取这些错误
+	OnFatal func(error)
+	// APProvider bot gateway接入点信息提供者，默认为NewOpenAPIProvider，
+	// 测试或者对接本地模拟gateway时可以使用NewStaticAPProvider
+	APProvider APProvider
+	// Strategy 分区分配策略，默认为NewModuloStrategy，如果希望实例数量变化时尽量少迁移分区，
+	// 可以使用NewRendezvousStrategy，实例规格不同时可以使用NewWeightedStrategy，注意集群内所有实例需要使用相同的策略
+	Strategy Strategy
+	// IdentifyLimiter 鉴权频控，默认当Cluster实现了base.RateLimiter接口时使用集群频控，
+	// 否则使用仅对当前进程生效的base.NewMemoryRateLimiter
+	IdentifyLimiter base.RateLimiter
+	// SessionStore 分区session存储，用于重新调度、分区迁移或者进程重启后resume，默认当Cluster实现了
+	// base.SessionStore接口时使用集群存储，否则使用仅在进程内有效的base.NewMemorySessionStore
+	SessionStore base.SessionStore
+	// ReconnectBackoff 分区session断开后的重连退避策略，零值表示使用DftReconnectBackoff
+	ReconnectBackoff Backoff
+	// Metrics 调度与session监控上报接口，默认不上报
+	Metrics Metrics
+	// DrainDelay Drain时将实例标记为下线中后，等待其他实例感知并接手分区的时间，之后才关闭本地session，
+	// 默认为DftDrainDelay
+	DrainDelay time.Duration
+	// CentralAssignment 是否开启集中分配，开启后Cluster需要实现base.LeaderElector接口，由选出的leader按照Strategy
+	// 计算所有实例的分区并发布带版本号的分配结果，其他实例只按照收到的分配结果启动或者停止分区，不再各自计算
+	CentralAssignment bool
+	// StopOnInvalidAuth 是否在token、intent等鉴权参数错误（IsInvalidAuth）时停止分区重连并上报ErrCanNotIdentify致命错误，
+	// 默认只在机器人下架、封禁（CanNotIdentify）时停止，其余错误都会按照ReconnectBackoff重连
+	StopOnInvalidAuth bool
 }
 
 // Scheduler 调度器对象，通过NewScheduler构造对象，提供调度接口
@@ -51,6 +87,34 @@ type Scheduler struct {
 	args          *Args
 	localInstance base.Instance
 	sessionCtx    *botSessionCtx
+	// view 最近一次调度使用的集群成员视图
+	view *membership
+	// owner 分区归属管理器，未开启分区归属检查时为nil
+	owner base.ShardOwner
+	// mu 保护Start和Stop
+	mu sync.Mutex
+	// cancel 用于通知调度协程退出
+	cancel context.CancelFunc
+	// done 调度协程退出后关闭
+	done chan struct{}
+	// errChan 致命错误channel
+	errChan chan error
+	// stateMu 保护view和sessionCtx，调度协程修改时加写锁，Status等查询接口加读锁
+	stateMu sync.RWMutex
+	// trigger 用于通知调度协程立即执行一次调度检查
+	trigger chan struct{}
+	// draining 本地实例是否正在下线，下线期间不再调整本地session，由stateMu保护
+	draining bool
+	// elector 选主管理器，未开启集中分配时为nil
+	elector base.LeaderElector
+	// leader 本地实例是否为leader，由stateMu保护
+	leader bool
+	// assignment 最近收到的分配结果，由stateMu保护
+	assignment *base.Assignment
+	// fenced 本地实例租约失效后处于隔离状态，重新注册前不启动session，由stateMu保护
+	fenced bool
+	// wsFactory 创建ws链接，为nil时使用websocket.ClientImpl，测试时替换，避免修改全局注册的实现
+	wsFactory websocket.WebSocket
 }
 
 // shardInfo bot分区信息
@@ -61,6 +125,8 @@ type shardInfo struct {
 	shardNum uint32
 	// ap bot gateway ap信息
 	ap *dto.WebsocketAP
+	// apStale ap是获取失败时沿用的上次结果，其中的频控信息已经过期
+	apStale bool
 }
 
 // botSessions 记录bot session相关的上下文信息
@@ -68,6 +134,7 @@ type botSessionCtx struct {
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 	si         *shardInfo
+	sm         *SessionManager
 	wg         sync.WaitGroup
 }
 
@@ -92,6 +159,29 @@ func New(args *Args) (*Scheduler, error) {
 		// 采用默认参数
 		localArgs.WatchInterval = DftWatchInterval
 	}
+	if localArgs.Strategy == nil {
+		localArgs.Strategy = NewModuloStrategy()
+	}
+	if localArgs.DrainDelay == 0 {
+		localArgs.DrainDelay = DftDrainDelay
+	}
+	if localArgs.APProvider == nil {
+		localArgs.APProvider = NewOpenAPIProvider(localArgs.BotAppID, localArgs.BotToken)
+	}
+	if localArgs.IdentifyLimiter == nil {
+		if limiter, ok := localArgs.Cluster.(base.RateLimiter); ok {
+			localArgs.IdentifyLimiter = limiter
+		} else {
+			localArgs.IdentifyLimiter = base.NewMemoryRateLimiter()
+		}
+	}
+	if localArgs.SessionStore == nil {
+		if store, ok := localArgs.Cluster.(base.SessionStore); ok {
+			localArgs.SessionStore = store
+		} else {
+			localArgs.SessionStore = base.NewMemorySessionStore()
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	ins, err := args.Cluster.GetLocalInstance(ctx)
@@ -99,67 +189,269 @@ func New(args *Args) (*Scheduler, error) {
 		return nil, fmt.Errorf("get local ins failed. err:%v", err)
 	}
 
+	var owner base.ShardOwner
+	if localArgs.ShardOwnership {
+		var ok bool
+		if owner, ok = localArgs.Cluster.(base.ShardOwner); !ok {
+			return nil, errors.New("cluster does not implement base.ShardOwner")
+		}
+	}
+	var elector base.LeaderElector
+	if localArgs.CentralAssignment {
+		var ok bool
+		if elector, ok = localArgs.Cluster.(base.LeaderElector); !ok {
+			return nil, errors.New("cluster does not implement base.LeaderElector")
+		}
+	}
+
 	return &Scheduler{
 		args:          &localArgs,
 		localInstance: ins,
+		owner:         owner,
+		elector:       elector,
+		errChan:       make(chan error, DftErrChanSize),
+		trigger:       make(chan struct{}, 1),
 	}, nil
 }
 
-// Start 启动调度协程监听北极星服务实例数量，并根据实例数量计算分区信息，启动对应bot session
-func (sched *Scheduler) Start() error {
+// Start 启动调度协程监听集群实例变化，并根据实例数量计算分区信息，启动对应bot session。
+// ctx结束或者调用Stop后，调度协程会关闭所有bot session并退出
+func (sched *Scheduler) Start(ctx context.Context) error {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	if sched.done != nil {
+		return errors.New("scheduler already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wc, err := sched.args.Cluster.Watch(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	var ac <-chan *base.Assignment
+	if sched.elector != nil {
+		if ac, err = sched.elector.WatchAssignment(ctx); err != nil {
+			cancel()
+			return err
+		}
+	}
+	done := make(chan struct{})
+	sched.cancel, sched.done = cancel, done
 	go func() {
 		defer func() {
+			close(done)
 			if r := recover(); r != nil {
-				buf := make([]byte, 4096)
-				buf = buf[:runtime.Stack(buf, false)]
-				log.Errorf("[ScheduleMain]err:%v, stack:\n%s", r, buf)
-				// 如果故障，则退出进程（通常不可能进入到这里）
-				os.Exit(-1)
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				sched.fatal(panicError("ScheduleMain", r))
 			}
 		}()
-		if err := sched.doSchedule(); err != nil {
-			panic(fmt.Sprintf("do schedule failed, err:%v", err))
+		if err := sched.doSchedule(ctx, wc, ac); err != nil {
+			sched.fatal(fmt.Errorf("do schedule failed, err:%w", err))
 		}
 	}()
 	return nil
 }
 
-// IsExitSchedule 始终返回false，用于测试打桩构造循环退出条件
-func (sched *Scheduler) IsExitSchedule() bool {
-	return false
+// Stop 停止调度，关闭所有bot session并等待链接关闭，如果设置了Args.UnregOnStop，还会注销本地实例。
+// ctx用于控制等待的超时时间，超时返回时调度协程仍会在后台继续完成退出
+func (sched *Scheduler) Stop(ctx context.Context) error {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	if sched.done == nil {
+		return nil
+	}
+	sched.cancel()
+	select {
+	case <-sched.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	sched.cancel, sched.done = nil, nil
+	// 调度协程异常退出时可能没有关闭session，这里再确认一次
+	if err := sched.stopSessions(); err != nil {
+		return err
+	}
+	if sched.args.UnregOnStop {
+		return sched.args.Cluster.UnregInstance(ctx)
+	}
+	return nil
 }
 
-func (sched *Scheduler) doSchedule() error {
-	ticker := time.NewTicker(sched.args.WatchInterval)
-	wc, err := sched.args.Cluster.Watch(context.Background())
-	if err != nil {
+// Reschedule 通知调度协程立即执行一次调度检查，重新拉取实例列表和AP信息，分区变化时调整bot session，
+// 不需要等待WatchInterval。调度检查是异步执行的，可以通过Status查看结果
+func (sched *Scheduler) Reschedule() error {
+	if !sched.running() {
+		return errors.New("scheduler not started")
+	}
+	sched.triggerSchedule()
+	return nil
+}
+
+// triggerSchedule 通知调度协程执行一次调度检查
+func (sched *Scheduler) triggerSchedule() {
+	select {
+	case sched.trigger <- struct{}{}:
+	default:
+		// 已经有待执行的调度检查
+	}
+}
+
+// Drain 实例下线前主动退出集群。集群管理器实现了base.Drainer时，先将本地实例标记为下线中，
+// 其他实例感知后接手本实例的分区（开启分区归属检查时会等待本实例释放分区），等待DrainDelay后
+// 再关闭本实例所有bot session，释放分区归属并注销本地实例；否则直接关闭session并注销。
+// 等待期间ctx结束时取消下线中标记，本实例恢复正常调度，并返回ctx的错误
+func (sched *Scheduler) Drain(ctx context.Context) error {
+	if drainer, ok := sched.args.Cluster.(base.Drainer); ok && sched.running() {
+		// 下线期间本地视图中没有本实例，不再调整本地session，避免在其他实例接手前关闭session
+		sched.setDraining(true)
+		if err := drainer.MarkDraining(ctx); err != nil {
+			sched.setDraining(false)
+			return err
+		}
+		log.Infof("[Drain] instance marked as draining, wait %v for peers to take over", sched.args.DrainDelay)
+		select {
+		case <-time.After(sched.args.DrainDelay):
+		case <-ctx.Done():
+			sched.cancelDrain(drainer)
+			return ctx.Err()
+		}
+	}
+	if err := sched.Stop(ctx); err != nil {
 		return err
 	}
+	if sched.args.UnregOnStop {
+		// Stop已经注销过本地实例
+		return nil
+	}
+	return sched.args.Cluster.UnregInstance(ctx)
+}
+
+// cancelDrain 下线中途取消，回滚集群中的下线中标记，并恢复本地调度
+func (sched *Scheduler) cancelDrain(drainer base.Drainer) {
+	// 调用方的ctx已经结束，回滚使用单独的超时
+	ctx, cancel := context.WithTimeout(context.Background(), sched.args.DrainDelay)
+	defer cancel()
+	if err := drainer.UnmarkDraining(ctx); err != nil {
+		// 标记没有清除时其他实例会继续接手本实例的分区，本实例仍处于下线中，不再调整本地session
+		log.Errorf("[Drain] unmark draining failed, instance stays draining: %v", err)
+		return
+	}
+	sched.setDraining(false)
+	log.Infof("[Drain] drain canceled, instance back to normal scheduling")
+	sched.triggerSchedule()
+}
+
+// setDraining 设置本地实例是否正在下线
+func (sched *Scheduler) setDraining(draining bool) {
+	sched.stateMu.Lock()
+	defer sched.stateMu.Unlock()
+	sched.draining = draining
+}
+
+// isDraining 本地实例是否正在下线
+func (sched *Scheduler) isDraining() bool {
+	sched.stateMu.RLock()
+	defer sched.stateMu.RUnlock()
+	return sched.draining
+}
+
+// running 调度协程是否正在运行
+func (sched *Scheduler) running() bool {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	return sched.done != nil
+}
+
+func (sched *Scheduler) doSchedule(ctx context.Context, wc base.WatchChan, ac <-chan *base.Assignment) error {
+	ticker := time.NewTicker(sched.args.WatchInterval)
+	defer ticker.Stop()
+	if sched.elector != nil {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer func() {
+				wg.Done()
+				if r := recover(); r != nil {
+					// 通常不可能进入到这里，交给使用方决定如何处理
+					sched.fatal(panicError("Campaign", r))
+				}
+			}()
+			sched.campaign(ctx)
+		}()
+		// 退出前等待放弃leader身份，避免其他实例等到租约超时才能当选
+		defer wg.Wait()
+	}
+	// retry 调度失败后的重试定时器
+	var retry <-chan time.Time
 	for {
-		if sched.IsExitSchedule() {
-			break
-		}
 		select {
+		case <-ctx.Done():
+			return sched.stopSessions()
+		case <-sched.trigger:
+		case assignment, ok := <-ac:
+			if !ok {
+				log.Errorf("assignment chan closed, rewatch later")
+				ac = nil
+				retry = time.After(DftRetryInterval)
+				continue
+			}
+			if !sched.setAssignment(assignment) {
+				continue
+			}
+			log.Infof("[Assignment] receive assignment version:%v from leader:%v", assignment.Version, assignment.Leader)
 		case wr, ok := <-wc:
-			if !ok || wr.Err != nil {
-				time.Sleep(time.Second)
-				// TODO 这里!ok场景是对端channel关闭，可以考虑退出进程重启
+			if !ok {
+				// 对端关闭了watch channel，稍后重新建立watch
+				log.Errorf("watch chan closed, rewatch later")
+				wc = nil
+				retry = time.After(DftRetryInterval)
 				continue
 			}
-			if err := sched.sharding(); err != nil {
-				time.Sleep(time.Second)
+			if wr.Err != nil {
+				log.Errorf("watch err:%v", wr.Err)
 				continue
 			}
+			sched.handleLocalEvents(wr.Events)
 		case <-ticker.C:
 			// 定时器到期，主动做一次sharding，里面会查询最新AP信息决定是否需要进行重新分区调度
-			if err := sched.sharding(); err != nil {
-				time.Sleep(time.Second)
+		case <-retry:
+			if wc == nil || (sched.elector != nil && ac == nil) {
+				// 重新watch成功后集群管理器会主动推送一次事件，触发sharding
+				var err error
+				if wc, ac, err = sched.rewatch(ctx, wc, ac); err != nil {
+					log.Errorf("rewatch failed, err:%v", err)
+					retry = time.After(DftRetryInterval)
+				} else {
+					retry = nil
+				}
 				continue
 			}
 		}
+		if wc != nil && (sched.elector == nil || ac != nil) {
+			retry = nil
+		}
+		if err := sched.sharding(); err != nil {
+			// 调度失败，稍后重试，避免等到下一次轮询才恢复
+			retry = time.After(DftRetryInterval)
+		}
 	}
+}
 
-	return nil
+// rewatch 重新建立已经关闭的实例监听以及分配结果监听
+func (sched *Scheduler) rewatch(ctx context.Context, wc base.WatchChan,
+	ac <-chan *base.Assignment) (base.WatchChan, <-chan *base.Assignment, error) {
+	var err error
+	if wc == nil {
+		if wc, err = sched.args.Cluster.Watch(ctx); err != nil {
+			return nil, ac, err
+		}
+	}
+	if ac == nil && sched.elector != nil {
+		if ac, err = sched.elector.WatchAssignment(ctx); err != nil {
+			return wc, nil, err
+		}
+	}
+	return wc, ac, nil
 }
 
 func (sched *Scheduler) getTimeoutCtx() (context.Context, context.CancelFunc) {
@@ -167,7 +459,21 @@ func (sched *Scheduler) getTimeoutCtx() (context.Context, context.CancelFunc) {
 }
 
 // sharding 计算分区，根据情况启动或者停止bot session
-func (sched *Scheduler) sharding() error {
+func (sched *Scheduler) sharding() (err error) {
+	defer func() {
+		sched.metrics().ObserveSharding(err)
+	}()
+	if sched.isFenced() {
+		// 租约失效，等待本地实例重新注册
+		return nil
+	}
+	if sched.elector != nil {
+		return sched.assignedSharding()
+	}
+	if sched.isDraining() {
+		// 正在下线，本地session由Drain负责关闭
+		return nil
+	}
 	ctx, cancel := sched.getTimeoutCtx()
 	defer cancel()
 	insList, err := sched.args.Cluster.GetAllInstances(ctx)
@@ -175,22 +481,43 @@ func (sched *Scheduler) sharding() error {
 		log.Errorf("get all instances failed, err:%v", err)
 		return err
 	}
-	shard, err := sched.calShard(insList)
+	view := newMembership(insList)
+	shard, err := sched.calShard(view)
 	if err != nil {
 		log.Errorf("calculate shard failed, err:%v", err)
 		return err
 	}
+	sched.refreshBudget(shard)
 	if sched.needReschedule(shard) {
+		// 调整分区前再次确认成员视图，避免基于已经过期的视图启动session
+		if err := sched.confirmView(view); err != nil {
+			log.Errorf("confirm view failed, err:%v", err)
+			return err
+		}
 		if err := sched.reschedule(shard); err != nil {
 			log.Errorf("reschedule failed, err:%v", err)
 			return err
 		}
 	}
+	sched.stateMu.Lock()
+	sched.view = view
+	sched.stateMu.Unlock()
 	return nil
 }
 
-func (sched *Scheduler) isSelf(ins base.Instance) bool {
-	return sched.localInstance.GetID() == ins.GetID()
+// confirmView 重新拉取实例列表，确认视图与集群当前的成员一致，不一致说明集群成员正在变化，
+// 此时各实例的视图可能不同，计算出的分区可能重复或者遗漏，需要放弃本次调度等待重试
+func (sched *Scheduler) confirmView(view *membership) error {
+	ctx, cancel := sched.getTimeoutCtx()
+	defer cancel()
+	insList, err := sched.args.Cluster.GetAllInstances(ctx)
+	if err != nil {
+		return err
+	}
+	if latest := newMembership(insList); !latest.isSame(view) {
+		return fmt.Errorf("membership changed. view:%v, latest:%v", view, latest)
+	}
+	return nil
 }
 
 func (s *shardInfo) isValid() bool {
@@ -234,6 +561,17 @@ func (sched *Scheduler) needReschedule(si *shardInfo) bool {
 }
 
 func (sched *Scheduler) reschedule(si *shardInfo) error {
+	if sched.canRebalance(si) {
+		// 分区总数和接入点不变，只增量调整增减的分区，避免中断仍然由本实例负责的分区
+		log.Infof("[Rebalance] old:%v. new:%v", sched.sessionCtx.si.shardIDs, si.shardIDs)
+		sched.sessionCtx.sm.updateShards(si.shardIDs)
+		sched.stateMu.Lock()
+		sched.sessionCtx.si = si
+		sched.stateMu.Unlock()
+		sched.metrics().ObserveReschedule(true, len(si.shardIDs))
+		return nil
+	}
+
 	// 先停止旧bot session
 	if err := sched.stopSessions(); err != nil {
 		log.Errorf("Stop sessions failed. err:%v", err)
@@ -245,21 +583,51 @@ func (sched *Scheduler) reschedule(si *shardInfo) error {
 		log.Errorf("Start sessions failed. err:%v", err)
 		return err
 	}
+	sched.metrics().ObserveReschedule(false, len(si.shardIDs))
 	return nil
 }
 
-// getAP 获取bot websocket gateway信息
-func (sched *Scheduler) getAP() (*dto.WebsocketAP, error) {
-	botToken := token.BotToken(sched.args.BotAppID, sched.args.BotToken)
-	openAPI := botgo.NewOpenAPI(botToken).WithTimeout(3 * time.Second)
-	ctx := context.Background()
-	ap, err := openAPI.WS(ctx, nil, "")
-	if err != nil {
-		log.Errorf("Open api ws failed. err:%v", err)
-		return nil, err
+// canRebalance 是否可以增量调整分区，分区总数或者接入点变化时，所有分区都需要重新建立链接
+func (sched *Scheduler) canRebalance(si *shardInfo) bool {
+	if sched.sessionCtx == nil || !si.isValid() {
+		return false
 	}
-	log.Infof("Get ap info:%+v", ap)
-	return ap, nil
+	old := sched.sessionCtx.si
+	return old.shardNum == si.shardNum && old.ap.URL == si.ap.URL
+}
+
+// IdentifyBudget 获取当前剩余的鉴权次数预算，没有运行中的bot session时返回零值
+func (sched *Scheduler) IdentifyBudget() IdentifyBudget {
+	sched.stateMu.RLock()
+	sessionCtx := sched.sessionCtx
+	sched.stateMu.RUnlock()
+	if sessionCtx == nil {
+		return IdentifyBudget{}
+	}
+	return sessionCtx.sm.IdentifyBudget()
+}
+
+// refreshBudget 使用最新的AP信息刷新鉴权次数预算，沿用的过期AP信息不用于刷新
+func (sched *Scheduler) refreshBudget(si *shardInfo) {
+	if sched.sessionCtx == nil || si.ap == nil || si.apStale {
+		return
+	}
+	sched.sessionCtx.sm.budget.update(si.ap.SessionStartLimit)
+	sched.sessionCtx.sm.observeBudget()
+}
+
+// getAP 获取bot websocket gateway信息，stale表示获取失败，返回的是APProvider沿用的上次结果
+func (sched *Scheduler) getAP() (ap *dto.WebsocketAP, stale bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ap, err = sched.args.APProvider.GetAP(ctx)
+	sched.metrics().ObserveAPFetch(err)
+	var staleErr *StaleAPError
+	if errors.As(err, &staleErr) && ap != nil {
+		log.Errorf("Get ap failed, use ap fetched at %v. err:%v", staleErr.FetchedAt, staleErr.Err)
+		return ap, true, nil
+	}
+	return ap, false, err
 }
 
 func (sched *Scheduler) getMinShardNum(ap *dto.WebsocketAP, validInsNum uint32) (uint32, error) {
@@ -272,60 +640,32 @@ func (sched *Scheduler) getMinShardNum(ap *dto.WebsocketAP, validInsNum uint32)
 	return ap.Shards, nil
 }
 
-func (sched *Scheduler) calShard(allIns []base.Instance) (*shardInfo, error) {
+func (sched *Scheduler) calShard(view *membership) (*shardInfo, error) {
 	si := &shardInfo{}
-	// 过滤有效实例，获取实例idx和数量
-	selfIdx, validInsNum := sched.countValidIns(allIns)
-	if selfIdx < 0 || validInsNum <= 0 {
+	if !view.contains(sched.localInstance.GetID()) {
 		return si, nil
 	}
 
 	// 获取Bot Gateway的AP链接点信息
 	var err error
-	si.ap, err = sched.getAP()
+	si.ap, si.apStale, err = sched.getAP()
 	if err != nil {
 		log.Errorf("Call getAP failed. err:%v", err)
 		return nil, err
 	}
-	minShardNum, err := sched.getMinShardNum(si.ap, validInsNum)
+	minShardNum, err := sched.getMinShardNum(si.ap, uint32(len(view.instances)))
 	if err != nil {
 		log.Errorf("getMinShardNum failed. err:%v", err)
 		return nil, err
 	}
 	si.shardNum = minShardNum
-	// 计算当前实例需要处理的分区id列表
-	round := minShardNum / validInsNum
-	for i := uint32(0); i < round; i++ {
-		// 将id一轮一轮的加入到列表中
-		si.shardIDs = append(si.shardIDs, i*validInsNum+uint32(selfIdx))
-	}
-	// 处理余数
-	tmp := minShardNum % validInsNum
-	if tmp != 0 && tmp > uint32(selfIdx) {
-		si.shardIDs = append(si.shardIDs, round*validInsNum+uint32(selfIdx))
-	}
-	log.Infof("cal shard:%v", si)
+	// 按照分配策略计算当前实例需要处理的分区id列表
+	assignment := sched.args.Strategy.Assign(view.instances, minShardNum)
+	si.shardIDs = assignment[sched.localInstance.GetID()]
+	log.Infof("cal shard:%v, view:%v", si, view)
 	return si, nil
 }
 
-// countValidIns 计算有效实例，返回自己在有效实例中的idx和有效实例总数
-func (sched *Scheduler) countValidIns(allIns []base.Instance) (int, uint32) {
-	var validInsNum uint32
-	selfIdx := -1
-	for _, ins := range allIns {
-		log.Debugf("[Instance] %v", ins.GetID())
-		if !ins.IsValid() {
-			// 跳过无效instance
-			continue
-		}
-		if sched.isSelf(ins) {
-			selfIdx = int(validInsNum)
-		}
-		validInsNum++
-	}
-	return selfIdx, validInsNum
-}
-
 func (sched *Scheduler) stopSessions() error {
 	if sched.sessionCtx == nil {
 		return nil
@@ -333,7 +673,9 @@ func (sched *Scheduler) stopSessions() error {
 
 	sched.sessionCtx.cancelFunc()
 	sched.sessionCtx.wg.Wait()
+	sched.stateMu.Lock()
 	sched.sessionCtx = nil
+	sched.stateMu.Unlock()
 	return nil
 }
 
@@ -350,34 +692,40 @@ func (sched *Scheduler) startSessions(si *shardInfo) error {
 		si:  si,
 	}
 	sessionCtx.ctx, sessionCtx.cancelFunc = context.WithCancel(sessionCtx.ctx)
+	token := token.BotToken(sched.args.BotAppID, sched.args.BotToken)
+	sessionCtx.sm = NewSessionManager(sessionCtx.ctx, token, &sched.args.Intent, si)
+	sessionCtx.sm.owner = sched.owner
+	sessionCtx.sm.onFatal = sched.fatal
+	sessionCtx.sm.limiter = sched.args.IdentifyLimiter
+	sessionCtx.sm.store = sched.args.SessionStore
+	sessionCtx.sm.backoff = sched.args.ReconnectBackoff.withDefaults()
+	sessionCtx.sm.metrics = sched.args.Metrics
+	sessionCtx.sm.wsFactory = sched.wsFactory
+	sessionCtx.sm.stopOnInvalidAuth = sched.args.StopOnInvalidAuth
+	sessionCtx.sm.observeBudget()
+	sched.stateMu.Lock()
 	sched.sessionCtx = sessionCtx
+	sched.stateMu.Unlock()
 	sched.sessionCtx.wg.Add(1)
 	// 启动bot服务协程
 	go func() {
 		defer func() {
 			sessionCtx.wg.Done()
 			if r := recover(); r != nil {
-				buf := make([]byte, 4096)
-				buf = buf[:runtime.Stack(buf, false)]
-				log.Errorf("[RunBot]err:%v, stack:\n%s", r, buf)
-				// 如果故障，则退出进程（通常不可能进入到这里）
-				os.Exit(-1)
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				sched.fatal(panicError("RunBot", r))
 			}
 		}()
-		err := sched.runBot(sessionCtx.ctx, si)
-		if err != nil {
-			if err != context.Canceled {
-				panic(fmt.Sprintf("Run bot failed. shard:%+v, err:%v", si, err))
-			}
+		err := sched.runBot(sessionCtx.sm, si)
+		if err != nil && err != context.Canceled {
+			sched.fatal(fmt.Errorf("run bot failed. shard:%+v, err:%w", si, err))
 		}
 	}()
 	return nil
 }
 
-func (sched *Scheduler) runBot(ctx context.Context, si *shardInfo) error {
+func (sched *Scheduler) runBot(sm *SessionManager, si *shardInfo) error {
 	log.Infof("[BotStart] shard:%v", si)
-	token := token.BotToken(sched.args.BotAppID, sched.args.BotToken)
-	sm := NewSessionManager(ctx, token, &sched.args.Intent, si)
 	if err := sm.Start(); err != nil {
 		log.Errorf("session start failed. err:%v", err)
 		return err
@@ -9,10 +9,9 @@ import (
 	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
-	"github.com/tencent-connect/botgo"
 	"github.com/tencent-connect/botgo-plugins/cluster/base"
 	"github.com/tencent-connect/botgo/dto"
-	"github.com/tencent-connect/botgo/token"
+	"github.com/tencent-connect/botgo/websocket"
 )
 
 var testArgs = Args{
@@ -21,6 +20,7 @@ var testArgs = Args{
 	BotToken:      "Bot appid.token",
 	Intent:        dto.IntentGuildAtMessage,
 	WatchInterval: time.Minute,
+	Strategy:      NewModuloStrategy(),
 }
 
 var testScheduler = &Scheduler{
@@ -107,13 +107,49 @@ func TestScheduler_Start(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := testScheduler.Start(); (err != nil) != tt.wantErr {
+			sched := &Scheduler{
+				args:          &testArgs,
+				localInstance: &mockInstance{id: "127.0.0.1"},
+			}
+			if err := sched.Start(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("Scheduler.Start() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if err := sched.Start(context.Background()); err == nil {
+				t.Errorf("Scheduler.Start() twice should fail")
+			}
+			if err := sched.Stop(context.Background()); err != nil {
+				t.Errorf("Scheduler.Stop() error = %v", err)
+			}
 		})
 	}
 }
 
+func TestScheduler_Stop(t *testing.T) {
+	sched := &Scheduler{
+		args:          &testArgs,
+		localInstance: &mockInstance{id: "127.0.0.1"},
+	}
+	// 未启动时Stop直接返回
+	if err := sched.Stop(context.Background()); err != nil {
+		t.Errorf("Scheduler.Stop() error = %v", err)
+	}
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+	// 模拟已经启动的bot session，Stop需要等待其关闭
+	_ = sched.startSessions(&shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap:       &dto.WebsocketAP{URL: "wss://fake", Shards: 1},
+	})
+	if err := sched.Stop(context.Background()); err != nil {
+		t.Errorf("Scheduler.Stop() error = %v", err)
+	}
+	if sched.sessionCtx != nil {
+		t.Errorf("Scheduler.Stop() sessions not stopped")
+	}
+}
+
 func TestScheduler_doSchedule(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -126,13 +162,14 @@ func TestScheduler_doSchedule(t *testing.T) {
 	}
 
 	defer gomonkey.ApplyFunc(time.Sleep, func(time.Duration) {
-	}).ApplyMethodSeq(reflect.TypeOf(testScheduler), "IsExitSchedule", []gomonkey.OutputCell{
-		{Values: gomonkey.Params{false}, Times: 1},
-		{Values: gomonkey.Params{true}, Times: 10000},
 	}).Reset()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := testScheduler.doSchedule(); (err != nil) != tt.wantErr {
+			ctx, cancel := context.WithCancel(context.Background())
+			wc, _ := testScheduler.args.Cluster.Watch(ctx)
+			// ctx结束后调度循环退出
+			cancel()
+			if err := testScheduler.doSchedule(ctx, wc, nil); (err != nil) != tt.wantErr {
 				t.Errorf("Scheduler.doSchedule() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -165,10 +202,44 @@ func TestScheduler_startSessions(t *testing.T) {
 			if err := testScheduler.startSessions(tt.args.si); (err != nil) != tt.wantErr {
 				t.Errorf("Scheduler.startSessions() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			// 关闭session并等待协程退出，避免影响后续用例
+			_ = testScheduler.stopSessions()
 		})
 	}
 }
 
+func TestScheduler_reschedule(t *testing.T) {
+	ap := &dto.WebsocketAP{URL: "wss://fake", Shards: 4}
+	sched := &Scheduler{
+		args:          &testArgs,
+		localInstance: &mockInstance{id: "127.0.0.1"},
+	}
+	if err := sched.reschedule(&shardInfo{shardIDs: []uint32{0, 1}, shardNum: 4, ap: ap}); err != nil {
+		t.Fatalf("Scheduler.reschedule() error = %v", err)
+	}
+	sm := sched.sessionCtx.sm
+
+	// 分区总数不变，增量调整分区，不重建session manager
+	if err := sched.reschedule(&shardInfo{shardIDs: []uint32{1, 2}, shardNum: 4, ap: ap}); err != nil {
+		t.Fatalf("Scheduler.reschedule() error = %v", err)
+	}
+	if sched.sessionCtx.sm != sm {
+		t.Errorf("Scheduler.reschedule() should rebalance on the same session manager")
+	}
+	if !reflect.DeepEqual(sched.sessionCtx.si.shardIDs, []uint32{1, 2}) {
+		t.Errorf("Scheduler.reschedule() shards = %v, want %v", sched.sessionCtx.si.shardIDs, []uint32{1, 2})
+	}
+
+	// 分区总数变化，需要重建所有session
+	if err := sched.reschedule(&shardInfo{shardIDs: []uint32{1}, shardNum: 5, ap: ap}); err != nil {
+		t.Fatalf("Scheduler.reschedule() error = %v", err)
+	}
+	if sched.sessionCtx.sm == sm {
+		t.Errorf("Scheduler.reschedule() should restart sessions when shard num changed")
+	}
+	_ = sched.stopSessions()
+}
+
 func TestScheduler_calShard(t *testing.T) {
 	type args struct {
 		allIns []base.Instance
@@ -179,6 +250,7 @@ func TestScheduler_calShard(t *testing.T) {
 		want    *shardInfo
 		wantErr bool
 	}{
+		// 成员视图按照实例id排序后再计算分区，与实例列表的返回顺序无关，127.0.0.1总是排在fakeip之前
 		{
 			name: "case1", args: args{}, want: &shardInfo{}, wantErr: false,
 		}, {
@@ -191,7 +263,7 @@ func TestScheduler_calShard(t *testing.T) {
 				&mockInstance{id: "fakeip1"},
 				&mockInstance{id: "fakeip2"},
 				&mockInstance{id: "127.0.0.1"},
-			}}, want: &shardInfo{shardIDs: []uint32{2}, shardNum: 5}, wantErr: false,
+			}}, want: &shardInfo{shardIDs: []uint32{0, 3}, shardNum: 5}, wantErr: false,
 		}, {
 			name: "case4", args: args{allIns: []base.Instance{
 				&mockInstance{id: "127.0.0.1"},
@@ -205,21 +277,21 @@ func TestScheduler_calShard(t *testing.T) {
 				&mockInstance{id: "127.0.0.1"},
 				&mockInstance{id: "fakeip6"},
 			}},
-			want: &shardInfo{shardIDs: []uint32{1, 4}, shardNum: 5}, wantErr: false,
+			want: &shardInfo{shardIDs: []uint32{0, 3}, shardNum: 5}, wantErr: false,
 		}, {
 			name: "case6", args: args{allIns: []base.Instance{
 				&mockInstance{id: "fakeip5"},
 				&mockInstance{id: "127.0.0.1"},
 				&mockInstance{id: "fakeip6"},
 			}},
-			want: &shardInfo{shardIDs: []uint32{1}, shardNum: 2}, wantErr: false,
+			want: &shardInfo{shardIDs: []uint32{0}, shardNum: 2}, wantErr: false,
 		}, {
 			name: "case7", args: args{allIns: []base.Instance{
 				&mockInstance{id: "fakeip5"},
 				&mockInstance{id: "fakeip6"},
 				&mockInstance{id: "127.0.0.1"},
 			}},
-			want: &shardInfo{shardIDs: nil, shardNum: 2}, wantErr: false,
+			want: &shardInfo{shardIDs: []uint32{0}, shardNum: 2}, wantErr: false,
 		}, {
 			name: "case8", args: args{allIns: []base.Instance{
 				&mockInstance{id: "127.0.0.1"},
@@ -238,22 +310,22 @@ func TestScheduler_calShard(t *testing.T) {
 				&mockInstance{id: "fakeip5"},
 				&mockInstance{id: "127.0.0.1"},
 			}},
-			want: &shardInfo{shardIDs: []uint32{2}, shardNum: 3}, wantErr: false,
+			want: &shardInfo{shardIDs: []uint32{0}, shardNum: 3}, wantErr: false,
 		},
 	}
 
-	botToken := token.BotToken(testArgs.BotAppID, testArgs.BotToken)
-	openAPI := botgo.NewOpenAPI(botToken).WithTimeout(3 * time.Second)
-	defer gomonkey.ApplyMethodSeq(reflect.TypeOf(openAPI), "WS", []gomonkey.OutputCell{
-		{Values: gomonkey.Params{&dto.WebsocketAP{}, nil}, Times: 1},
-		{Values: gomonkey.Params{&dto.WebsocketAP{Shards: 5}, nil}, Times: 3},
-		{Values: gomonkey.Params{&dto.WebsocketAP{Shards: 2}, nil}, Times: 3},
-		{Values: gomonkey.Params{&dto.WebsocketAP{Shards: 1}, nil}, Times: 1},
-		{Values: gomonkey.Params{&dto.WebsocketAP{Shards: 3}, nil}, Times: 1},
-	}).Reset()
+	schedArgs := testArgs
+	schedArgs.APProvider = &mockAPProvider{aps: []*dto.WebsocketAP{
+		{},
+		{Shards: 5}, {Shards: 5}, {Shards: 5},
+		{Shards: 2}, {Shards: 2}, {Shards: 2},
+		{Shards: 1},
+		{Shards: 3},
+	}}
+	sched := &Scheduler{args: &schedArgs, localInstance: testScheduler.localInstance}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := testScheduler.calShard(tt.args.allIns)
+			got, err := sched.calShard(newMembership(tt.args.allIns))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Scheduler.calShard() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -265,9 +337,26 @@ func TestScheduler_calShard(t *testing.T) {
 	}
 }
 
+// mockAPProvider 按顺序返回接入点信息，用完后一直返回最后一个
+type mockAPProvider struct {
+	aps []*dto.WebsocketAP
+	idx int
+}
+
+// GetAP 获取接入点信息
+func (m *mockAPProvider) GetAP(ctx context.Context) (*dto.WebsocketAP, error) {
+	ap := m.aps[m.idx]
+	if m.idx < len(m.aps)-1 {
+		m.idx++
+	}
+	return ap, nil
+}
+
 // mockInstance 模拟服务实例信息
 type mockInstance struct {
-	id string
+	id       string
+	draining bool
+	metadata base.Metadata
 }
 
 // GetName 获取名称
@@ -280,6 +369,16 @@ func (m *mockInstance) IsValid() bool {
 	return m.id != ""
 }
 
+// IsDraining 是否正在下线
+func (m *mockInstance) IsDraining() bool {
+	return m.draining
+}
+
+// GetMetadata 获取实例元数据
+func (m *mockInstance) GetMetadata() base.Metadata {
+	return m.metadata
+}
+
 func Test_shardsEqual(t *testing.T) {
 	type args struct {
 		a []uint32
@@ -352,3 +451,116 @@ func TestNewArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestScheduler_fatal(t *testing.T) {
+	var got error
+	args := testArgs
+	args.OnFatal = func(err error) {
+		got = err
+	}
+	sched := &Scheduler{
+		args:    &args,
+		errChan: make(chan error, 1),
+	}
+	wantErr := errors.New("mock fatal")
+	sched.fatal(wantErr)
+	// channel写满后丢弃新的错误，不能阻塞
+	sched.fatal(errors.New("dropped"))
+	if got == nil || got.Error() != "dropped" {
+		t.Errorf("Scheduler.fatal() OnFatal got %v", got)
+	}
+	if err := <-sched.Errors(); err != wantErr {
+		t.Errorf("Scheduler.Errors() = %v, want %v", err, wantErr)
+	}
+}
+
+// staticCluster 固定实例列表的集群
+type staticCluster struct {
+	mockCluster
+	insList []base.Instance
+}
+
+// GetAllInstances 获取所有实例的列表
+func (m *staticCluster) GetAllInstances(ctx context.Context) ([]base.Instance, error) {
+	return m.insList, nil
+}
+
+// recordingWebSocket 记录创建链接的分区id
+type recordingWebSocket struct {
+	MockBotWebSocket
+	shards chan uint32
+}
+
+// New 创建一个新的ws实例
+func (m *recordingWebSocket) New(session dto.Session) websocket.WebSocket {
+	select {
+	case m.shards <- session.Shards.ShardID:
+	default:
+	}
+	return &MockBotWebSocket{}
+}
+
+func TestScheduler_endToEnd(t *testing.T) {
+	ws := &recordingWebSocket{shards: make(chan uint32, 10)}
+	args := NewArgs(&staticCluster{insList: []base.Instance{
+		&mockInstance{id: "fakeip"},
+		&mockInstance{id: "127.0.0.1"},
+	}}, testArgs.BotAppID, testArgs.BotToken, testArgs.Intent)
+	args.APProvider = NewStaticAPProvider(&dto.WebsocketAP{
+		URL:               "ws://127.0.0.1:8080",
+		Shards:            4,
+		SessionStartLimit: dto.SessionStartLimit{MaxConcurrency: 5},
+	})
+	sched, err := New(args)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	sched.wsFactory = ws
+	if err := sched.Start(context.Background()); err != nil {
+		t.Fatalf("Scheduler.Start() error = %v", err)
+	}
+	// 模拟的链接会立即断开重连，这里只关心启动过哪些分区
+	got := make(map[uint32]bool)
+	for len(got) < 2 {
+		select {
+		case sid := <-ws.shards:
+			got[sid] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sessions not started, got shards %v", got)
+		}
+	}
+	if !reflect.DeepEqual(got, map[uint32]bool{0: true, 2: true}) {
+		t.Errorf("started shards = %v, want [0 2]", got)
+	}
+	if err := sched.Stop(context.Background()); err != nil {
+		t.Errorf("Scheduler.Stop() error = %v", err)
+	}
+}
+
+// limiterCluster 实现了base.RateLimiter的集群管理器
+type limiterCluster struct {
+	mockCluster
+	recordingLimiter
+}
+
+func TestNew_identifyLimiter(t *testing.T) {
+	// 集群管理器实现了频控时默认使用集群频控
+	cluster := &limiterCluster{}
+	schedArgs := testArgs
+	schedArgs.Cluster = cluster
+	sched, err := New(&schedArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if sched.args.IdentifyLimiter != base.RateLimiter(cluster) {
+		t.Errorf("New() IdentifyLimiter = %T, want cluster limiter", sched.args.IdentifyLimiter)
+	}
+	// 否则使用进程内频控
+	sched, err = New(&testArgs)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if sched.args.IdentifyLimiter == nil {
+		t.Errorf("New() IdentifyLimiter is nil")
+	}
+}
@@ -3,18 +3,26 @@ package schedule
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
-	"os"
-	"runtime"
+	"sync"
 	"time"
 
+	wss "github.com/gorilla/websocket"
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
 	"github.com/tencent-connect/botgo/dto"
 	"github.com/tencent-connect/botgo/errs"
 	"github.com/tencent-connect/botgo/token"
 	"github.com/tencent-connect/botgo/websocket"
 )
 
+const (
+	// DftShardAcquireInterval 分区归属被其他实例持有时，重新尝试获取的间隔
+	DftShardAcquireInterval = time.Second
+	// DftIdentifyInterval gateway的鉴权频控窗口，每个频控桶在窗口内只允许鉴权一次
+	DftIdentifyInterval = 5 * time.Second
+)
+
 // canNotResumeErrSet 不能进行 resume 操作的错误码
 var canNotResumeErrSet = map[int]bool{
 	errs.CodeConnCloseCantResume: true,
@@ -25,12 +33,46 @@ var canNotIdentifyErrSet = map[int]bool{
 	errs.CodeConnCloseCantIdentify: true,
 }
 
+// invalidAuthCloseCodes token、intent等鉴权参数错误的websocket关闭码，修改配置前重连也无法恢复
+var invalidAuthCloseCodes = map[int]bool{
+	4004: true, // 鉴权失败，token错误
+	4012: true, // 协议版本错误
+	4013: true, // intent无效
+	4014: true, // intent无权限
+}
+
 // sessionHolder 持有并维护session和对应websocket
 type sessionHolder struct {
 	session dto.Session
 	ws      websocket.WebSocket
 	mgr     *SessionManager
+	// ctx session协程中等待分区归属、鉴权预算、频控令牌以及重连退避时使用，stop时cancel
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu 保护ws、stopped、connected和running，stop与session协程并发
+	mu sync.Mutex
+	// stopped 是否已经停止，停止后不再重连
 	stopped bool
+	// connected ws是否已经建立了链接，ws在Connect成功前没有底层链接，不能Close
+	connected bool
+	// running 是否有正在运行的session协程，停止后由最后退出的一方保存session并释放分区归属
+	running bool
+	// owned 是否已经持有分区归属
+	owned bool
+	// restored 是否已经从存储中恢复过session
+	restored bool
+	// saveMu 保护saved，ws事件处理协程中的逐条保存与session协程、stop可能并发
+	saveMu sync.Mutex
+	// saved 最近一次保存到存储的session
+	saved base.Session
+	// retry 最近一次重连的退避时间，为0表示尚未退避
+	retry time.Duration
+	// connectedAt 最近一次链接建立成功的时间，用于判断链接是否已经稳定
+	connectedAt time.Time
+	// statusMu 保护status，状态查询与session协程并发
+	statusMu sync.Mutex
+	// status 分区链接状态
+	status ShardStatus
 }
 
 // SessionManager session manager 实现，支持指定si
@@ -42,49 +84,176 @@ type SessionManager struct {
 	intents *dto.Intent
 	// holderChan 用于接收待建立ws链接的session
 	holderChan chan *sessionHolder
+	// mu 保护holders和si，调度协程会在Start运行期间增量调整分区
+	mu sync.Mutex
+	// started 是否已经启动
+	started bool
+	// owner 分区归属管理器，为nil时不做分区归属检查
+	owner base.ShardOwner
+	// onFatal 致命错误回调，为nil时使用DftOnFatal
+	onFatal func(error)
+	// budget 鉴权次数预算，为nil时不做限制
+	budget *identifyBudget
+	// limiter 鉴权频控，默认为进程内频控，为nil时不做限制
+	limiter base.RateLimiter
+	// store session存储，为nil时不保存session
+	store base.SessionStore
+	// backoff 重连退避策略
+	backoff Backoff
+	// metrics 监控上报接口，为nil时不上报
+	metrics Metrics
+	// acquireInterval 分区归属被其他实例持有时，重新尝试获取的间隔
+	acquireInterval time.Duration
+	// wg 等待所有session协程退出
+	wg sync.WaitGroup
+	// wsFactory 创建ws链接，为nil时使用wsClient，使用方注册了其他ws实现时使用websocket.ClientImpl
+	wsFactory websocket.WebSocket
+	// stopOnInvalidAuth 鉴权参数错误时是否停止重连
+	stopOnInvalidAuth bool
 }
 
 // NewSessionManager 新建SessionManager，如果要关闭session，可以Cancel该ctx
 func NewSessionManager(ctx context.Context, token *token.Token,
 	intents *dto.Intent, si *shardInfo) *SessionManager {
-	return &SessionManager{
-		ctx:     ctx,
-		token:   token,
-		intents: intents,
-		si:      si,
+	mgr := &SessionManager{
+		ctx:        ctx,
+		token:      token,
+		intents:    intents,
+		si:         si,
+		holderChan: newHolderChan(si),
+		limiter:    base.NewMemoryRateLimiter(),
+		backoff:    DftReconnectBackoff,
+
+		acquireInterval: DftShardAcquireInterval,
+	}
+	if si.ap != nil {
+		mgr.budget = newIdentifyBudget(si.ap.SessionStartLimit)
+	}
+	return mgr
+}
+
+// newWebSocket 创建分区的ws链接
+func (mgr *SessionManager) newWebSocket(session dto.Session) websocket.WebSocket {
+	if mgr.wsFactory != nil {
+		return mgr.wsFactory.New(session)
+	}
+	if useWSClient() {
+		return (&wsClient{}).New(session)
+	}
+	return websocket.ClientImpl.New(session)
+}
+
+// IdentifyBudget 获取当前剩余的鉴权次数预算
+func (mgr *SessionManager) IdentifyBudget() IdentifyBudget {
+	return mgr.budget.snapshot()
+}
+
+// observeBudget 上报当前的鉴权次数预算，未跟踪预算时不上报
+func (mgr *SessionManager) observeBudget() {
+	if mgr.budget == nil {
+		return
+	}
+	mgr.getMetrics().ObserveIdentifyBudget(mgr.budget.snapshot())
+}
+
+// newHolderChan 按照分区总数初始化holderChan，保证增量调整分区后也不会阻塞
+func newHolderChan(si *shardInfo) chan *sessionHolder {
+	size := int(si.shardNum)
+	if size < len(si.shardIDs) {
+		size = len(si.shardIDs)
 	}
+	return make(chan *sessionHolder, size)
 }
 
-// Start 会按照传入的si分区信息启动对应session链接
+// Start 会按照传入的si分区信息启动对应session链接，各个session并发建立链接，
+// 鉴权频率由limiter按照 shard_id % max_concurrency 分桶控制，每个桶每DftIdentifyInterval鉴权一次
 func (mgr *SessionManager) Start() error {
-	startInterval := calcInterval(mgr.si.ap.SessionStartLimit.MaxConcurrency)
-	fmt.Printf("[ws/session] will start %d/%d sessions and per session start interval is %s\n",
-		len(mgr.si.shardIDs), mgr.si.shardNum, startInterval)
 	// 按照shards数量初始化，用于启动连接的管理
-	mgr.holderChan = make(chan *sessionHolder, len(mgr.si.shardIDs))
+	mgr.mu.Lock()
+	fmt.Printf("[ws/session] will start %d/%d sessions and average identify interval is %s\n",
+		len(mgr.si.shardIDs), mgr.si.shardNum, calcInterval(mgr.si.ap.SessionStartLimit.MaxConcurrency))
+	if mgr.holderChan == nil {
+		mgr.holderChan = newHolderChan(mgr.si)
+	}
 	for _, sid := range mgr.si.shardIDs {
 		holder := mgr.newHolder(sid)
 		mgr.holders = append(mgr.holders, holder)
 		mgr.holderChan <- holder
 	}
+	mgr.started = true
+	mgr.mu.Unlock()
 	// 监听ctx以及holderChannel
 	for {
 		select {
 		case h := <-mgr.holderChan:
-			time.Sleep(time.Millisecond * 100)
 			h.start()
-			time.Sleep(startInterval)
 		case <-mgr.ctx.Done():
-			// ctx cancel，关闭所有session链接
-			for _, h := range mgr.holders {
+			// ctx cancel，关闭所有session链接，并等待session协程保存session、释放分区归属后退出
+			mgr.mu.Lock()
+			holders := mgr.holders
+			mgr.mu.Unlock()
+			for _, h := range holders {
 				h.stop()
 			}
+			mgr.wg.Wait()
 			return nil
 		}
 	}
 }
 
+// updateShards 增量调整分区，只关闭不再负责的分区session，并启动新增分区的session，
+// 未变化分区的session（包括session id和LastSeq）保持不变
+func (mgr *SessionManager) updateShards(shardIDs []uint32) {
+	mgr.mu.Lock()
+	si := *mgr.si
+	si.shardIDs = shardIDs
+	mgr.si = &si
+	if !mgr.started {
+		// 尚未启动，Start时会按照最新分区启动session
+		mgr.mu.Unlock()
+		return
+	}
+	keep := make(map[uint32]bool, len(shardIDs))
+	for _, sid := range shardIDs {
+		keep[sid] = true
+	}
+	var holders, added, removed []*sessionHolder
+	for _, h := range mgr.holders {
+		sid := h.session.Shards.ShardID
+		if !keep[sid] {
+			fmt.Printf("[ws/session][%v] shard removed, closing\n", sid)
+			removed = append(removed, h)
+			continue
+		}
+		delete(keep, sid)
+		holders = append(holders, h)
+	}
+	for _, sid := range shardIDs {
+		if !keep[sid] {
+			continue
+		}
+		fmt.Printf("[ws/session][%v] shard added, starting\n", sid)
+		h := mgr.newHolder(sid)
+		holders = append(holders, h)
+		added = append(added, h)
+	}
+	mgr.holders = holders
+	mgr.mu.Unlock()
+
+	for _, h := range removed {
+		h.stop()
+	}
+	for _, h := range added {
+		select {
+		case mgr.holderChan <- h:
+		case <-mgr.ctx.Done():
+			return
+		}
+	}
+}
+
 func (mgr *SessionManager) newHolder(sid uint32) *sessionHolder {
+	ctx, cancel := context.WithCancel(mgr.ctx)
 	return &sessionHolder{
 		session: dto.Session{
 			URL:     mgr.si.ap.URL,
@@ -96,87 +265,404 @@ func (mgr *SessionManager) newHolder(sid uint32) *sessionHolder {
 				ShardCount: mgr.si.shardNum,
 			},
 		},
-		mgr: mgr,
+		mgr:    mgr,
+		ctx:    ctx,
+		cancel: cancel,
+		status: ShardStatus{ShardID: sid, State: ShardStateWaiting},
 	}
 }
 
+// stop 停止session，中断session协程中的等待并关闭已经建立的链接。session协程仍在运行时，
+// 由其退出时保存session并释放分区归属，否则直接在这里完成
 func (holder *sessionHolder) stop() {
+	if !holder.markStopped() {
+		return
+	}
+	holder.setState(ShardStateStopped, nil)
+	holder.disconnect()
+	holder.mu.Lock()
+	running := holder.running
+	holder.mu.Unlock()
+	if !running {
+		holder.cleanup()
+	}
+}
+
+// cleanup 停止后保存最新的seq并释放分区归属，接手的实例可以从保存的seq开始resume
+func (holder *sessionHolder) cleanup() {
+	holder.saveSession(holder.session.ID, holder.session.LastSeq)
+	// 链接关闭后释放分区归属，让接手的实例尽快启动
+	holder.releaseShard()
+}
+
+// acquireShard 获取分区归属，未配置分区归属管理器时始终返回true。
+// 每次建立链接前都重新确认，本地实例租约失效或者重新申请租约后，分区可能已经归属其他实例
+func (holder *sessionHolder) acquireShard() bool {
+	owner := holder.mgr.owner
+	if owner == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(holder.ctx, time.Second)
+	defer cancel()
+	sid := holder.session.Shards.ShardID
+	ok, err := owner.AcquireShard(ctx, sid)
+	if err != nil {
+		fmt.Printf("[ws/session][%v] acquire shard err %+v\n", sid, err)
+		holder.setState(ShardStateWaiting, err)
+		return false
+	}
+	if !ok {
+		fmt.Printf("[ws/session][%v] shard is owned by other instance, waiting\n", sid)
+		// 分区已经归属其他实例，停止时不能再释放
+		holder.owned = false
+		holder.setState(ShardStateWaiting, nil)
+		return false
+	}
+	holder.owned = true
+	return true
+}
+
+// releaseShard 释放持有的分区归属
+func (holder *sessionHolder) releaseShard() {
+	owner := holder.mgr.owner
+	if owner == nil || !holder.owned {
+		return
+	}
+	// mgr.ctx可能已经cancel，这里使用独立的ctx
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := owner.ReleaseShard(ctx, holder.session.Shards.ShardID); err != nil {
+		fmt.Printf("[ws/session][%v] release shard err %+v\n", holder.session.Shards.ShardID, err)
+	}
+	holder.owned = false
+}
+
+// markStopped 标记为已经停止，并中断session协程中的等待，返回是否为首次标记
+func (holder *sessionHolder) markStopped() bool {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	if holder.stopped {
+		return false
+	}
 	holder.stopped = true
-	if holder.ws != nil {
-		holder.ws.Close()
+	holder.cancel()
+	return true
+}
+
+// isStopped 是否已经停止
+func (holder *sessionHolder) isStopped() bool {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	return holder.stopped
+}
+
+// setConnected 设置ws是否已经建立了链接，已经停止时不能再标记为已经建立链接，返回是否设置成功
+func (holder *sessionHolder) setConnected(connected bool) bool {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	if connected && holder.stopped {
+		return false
+	}
+	holder.connected = connected
+	return true
+}
+
+// disconnect 关闭已经建立的链接，ws在Connect成功前没有底层链接，Close会panic，因此只关闭Connect成功的链接
+func (holder *sessionHolder) disconnect() {
+	holder.mu.Lock()
+	ws, connected := holder.ws, holder.connected
+	holder.connected = false
+	holder.mu.Unlock()
+	if connected {
+		ws.Close()
 	}
 }
 
+// finish 本次session协程结束，返回是否已经停止，已经停止时由调用方保存session并释放分区归属
+func (holder *sessionHolder) finish() bool {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	holder.running = false
+	return holder.stopped
+}
+
 func (holder *sessionHolder) start() {
+	holder.mu.Lock()
 	if holder.stopped {
+		holder.mu.Unlock()
 		return
 	}
-	holder.ws = websocket.ClientImpl.New(holder.session)
+	holder.running = true
+	holder.mu.Unlock()
+	holder.mgr.wg.Add(1)
 	go func() {
 		defer func() {
+			holder.mgr.wg.Done()
 			if r := recover(); r != nil {
-				buf := make([]byte, 4096)
-				buf = buf[:runtime.Stack(buf, false)]
-				fmt.Printf("[SessionServe]err:%v, stack:\n%s\n", r, buf)
-				// 如果故障，则退出进程（通常不可能进入到这里）
-				os.Exit(-1)
+				// 通常不可能进入到这里，交给使用方决定如何处理
+				holder.mgr.fatal(panicError("SessionServe", r))
 			}
 		}()
+		// ws内部持有的是session的拷贝，需要在创建ws前恢复session
+		holder.restoreSession()
+		ws := holder.mgr.newWebSocket(holder.session)
+		if n, ok := ws.(dispatchNotifier); ok {
+			// 每个事件处理完成后保存最新的seq
+			n.setDispatchHook(holder.saveSession)
+		}
+		holder.mu.Lock()
+		holder.ws = ws
+		holder.mu.Unlock()
 		holder.serve()
 	}()
 }
 
 func (holder *sessionHolder) connectAndListen() {
+	holder.connectedAt = time.Time{}
+	holder.setState(ShardStateConnecting, nil)
+	// 没有session id时需要identify，先等待鉴权频控，再消耗鉴权预算，预算耗尽时等待到重置时间再建立链接。
+	// 等待频控期间停止时还没有消耗预算，不需要归还
+	identify := holder.session.ID == ""
+	if identify {
+		if err := holder.acquireIdentifyToken(); err != nil {
+			return
+		}
+		if err := holder.mgr.budget.acquire(holder.ctx, holder.session.Shards.ShardID); err != nil {
+			return
+		}
+		holder.mgr.observeBudget()
+	}
 	if err := holder.ws.Connect(); err != nil {
 		fmt.Printf("[ws/session][%v] Connect err %+v\n", holder.session.Shards.ShardID, err)
+		holder.setState(ShardStateConnecting, err)
+		if identify {
+			// 没有发送鉴权请求，归还预算
+			holder.refundBudget()
+		}
+		return
+	}
+	if !holder.setConnected(true) {
+		// 建立链接期间已经停止，stop不会关闭该链接
+		holder.ws.Close()
+		if identify {
+			holder.refundBudget()
+		}
 		return
 	}
 	var err error
-	// 如果 session id 不为空，则执行的是 resume 操作，如果为空，则执行的是 identify 操作
+	// 如果 session id 不为空，则执行的是 resume 操作，如果为空，则执行的是 identify 操作，
+	// resume 不消耗鉴权预算，因此优先 resume
+	state := ShardStateIdentifying
 	if holder.session.ID != "" {
+		state = ShardStateResuming
+		holder.setState(state, nil)
 		err = holder.ws.Resume()
 	} else {
 		// 初次鉴权
+		holder.setState(state, nil)
 		err = holder.ws.Identify()
 	}
+	holder.mgr.getMetrics().ObserveConnect(holder.session.Shards.ShardID, state == ShardStateResuming, err)
 	if err != nil {
 		fmt.Printf("[ws/session][%v] Identify/Resume err %+v\n", holder.session.Shards.ShardID, err)
+		holder.setState(state, err)
+		holder.disconnect()
 		return
 	}
 	fmt.Printf("[ws/session][%v] connected\n", holder.session.Shards.ShardID)
-	if err := holder.ws.Listening(); err != nil {
+	holder.connectedAt = time.Now()
+	holder.setState(ShardStateConnected, nil)
+	err = holder.ws.Listening()
+	// Listening返回前ws已经关闭了链接
+	holder.setConnected(false)
+	// 同步链接上最新的 session id 与 seq，重连时用于 resume。不支持逐条回调的ws实现只在这里保存
+	holder.syncSession()
+	holder.saveSession(holder.session.ID, holder.session.LastSeq)
+	if err != nil {
 		fmt.Printf("[ws/session][%v] Listening err %+v\n", holder.session.Shards.ShardID, err)
+		holder.setState(ShardStateConnected, err)
 		// 对于不能够进行重连的session，需要清空 session id 与 seq
 		if canNotResume(err) {
-			currentSession := holder.ws.Session()
-			currentSession.ID = ""
-			currentSession.LastSeq = 0
+			holder.session.ID = ""
+			holder.session.LastSeq = 0
+			holder.setSession("", 0)
+			holder.deleteSession()
 		}
-		if CanNotIdentify(err) {
-			msg := fmt.Sprintf("can not identify because server return %+v, so process exit", err)
-			panic(msg) // 当机器人被下架，或者封禁，将不能再连接，所以 panic
+		if holder.mgr.canNotReconnect(err) {
+			// 当机器人被下架，或者封禁，将不能再连接，停止重连并上报致命错误
+			holder.markStopped()
+			holder.mgr.fatal(fmt.Errorf("shard %v %w because server return %+v",
+				holder.session.Shards.ShardID, ErrCanNotIdentify, err))
 		}
 		return
 	}
 }
 
+// refundBudget 归还已经消耗但没有实际用于鉴权的预算
+func (holder *sessionHolder) refundBudget() {
+	holder.mgr.budget.refund()
+	holder.mgr.observeBudget()
+}
+
+// acquireIdentifyToken 获取鉴权令牌，gateway按照 shard_id % max_concurrency 对分区分桶，
+// 每个桶在DftIdentifyInterval内只允许鉴权一次，频控是机器人维度的，因此需要集群内所有实例共享
+func (holder *sessionHolder) acquireIdentifyToken() error {
+	limiter := holder.mgr.limiter
+	if limiter == nil {
+		return nil
+	}
+	holder.mgr.mu.Lock()
+	maxConcurrency := holder.mgr.si.ap.SessionStartLimit.MaxConcurrency
+	holder.mgr.mu.Unlock()
+	if maxConcurrency == 0 {
+		maxConcurrency = 1
+	}
+	sid := holder.session.Shards.ShardID
+	err := limiter.Acquire(holder.ctx, sid%maxConcurrency, DftIdentifyInterval)
+	if err != nil {
+		fmt.Printf("[ws/session][%v] acquire identify token err %+v\n", sid, err)
+	}
+	return err
+}
+
+// syncSession 从ws同步session id与seq，ws内部持有的是session的拷贝。
+// 只在Listening返回后调用，监听期间ws的事件处理协程会修改session
+func (holder *sessionHolder) syncSession() {
+	current := holder.ws.Session()
+	if current == nil {
+		return
+	}
+	holder.session.ID = current.ID
+	holder.session.LastSeq = current.LastSeq
+	holder.setSession(current.ID, current.LastSeq)
+}
+
+// restoreSession 从存储中恢复session，分区总数一致时才能resume，只在首次建立链接前恢复一次
+func (holder *sessionHolder) restoreSession() {
+	store := holder.mgr.store
+	if store == nil || holder.restored || holder.session.ID != "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(holder.ctx, time.Second)
+	defer cancel()
+	sid := holder.session.Shards.ShardID
+	saved, err := store.LoadSession(ctx, sid)
+	if err != nil {
+		fmt.Printf("[ws/session][%v] load session err %+v\n", sid, err)
+		return
+	}
+	holder.restored = true
+	if saved == nil || saved.SessionID == "" || saved.ShardCount != holder.session.Shards.ShardCount {
+		return
+	}
+	fmt.Printf("[ws/session][%v] restored session %v, seq %v\n", sid, saved.SessionID, saved.LastSeq)
+	holder.session.ID = saved.SessionID
+	holder.session.LastSeq = saved.LastSeq
+	// 恢复的seq之前的事件已经上报过，这里直接更新状态，不计入事件数
+	holder.statusMu.Lock()
+	holder.status.SessionID, holder.status.LastSeq = saved.SessionID, saved.LastSeq
+	holder.statusMu.Unlock()
+	holder.saveMu.Lock()
+	holder.saved = *saved
+	holder.saveMu.Unlock()
+}
+
+// saveSession 将最新的session id与seq同步到状态并保存到存储，与上次保存的内容相同时跳过。
+// 监听期间在ws的事件处理协程中逐条调用，不能访问holder.session中会变化的字段
+func (holder *sessionHolder) saveSession(sessionID string, lastSeq uint32) {
+	if sessionID == "" {
+		return
+	}
+	holder.setSession(sessionID, lastSeq)
+	store := holder.mgr.store
+	if store == nil {
+		return
+	}
+	session := base.Session{
+		ShardID:    holder.session.Shards.ShardID,
+		ShardCount: holder.session.Shards.ShardCount,
+		SessionID:  sessionID,
+		LastSeq:    lastSeq,
+	}
+	holder.saveMu.Lock()
+	defer holder.saveMu.Unlock()
+	if session == holder.saved {
+		return
+	}
+	// mgr.ctx可能已经cancel，这里使用独立的ctx
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := store.SaveSession(ctx, &session); err != nil {
+		fmt.Printf("[ws/session][%v] save session err %+v\n", session.ShardID, err)
+		return
+	}
+	holder.saved = session
+}
+
+// deleteSession 删除存储中已经失效的session
+func (holder *sessionHolder) deleteSession() {
+	store := holder.mgr.store
+	if store == nil {
+		return
+	}
+	holder.saveMu.Lock()
+	defer holder.saveMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := store.DeleteSession(ctx, holder.session.Shards.ShardID); err != nil {
+		fmt.Printf("[ws/session][%v] delete session err %+v\n", holder.session.Shards.ShardID, err)
+		return
+	}
+	holder.saved = base.Session{}
+}
+
+// serve 获取分区归属并建立链接，链接断开后等待一段时间，再将session放回holderChan重新建立链接。
+// 所有等待都会在stop时中断，停止后保存session并释放分区归属
 func (holder *sessionHolder) serve() {
-	holder.connectAndListen()
-	if !holder.stopped {
-		fmt.Printf("[ws/session][%v] reconnecting\n", holder.session.Shards.ShardID)
-		// 稍微sleep 100ms再尝试重连
-		time.Sleep(time.Millisecond * 100)
-		// 将 session 放到 session chan 中，用于启动新的连接，当前连接退出
-		holder.mgr.holderChan <- holder
+	var wait time.Duration
+	if holder.acquireShard() && !holder.isStopped() {
+		holder.connectAndListen()
+		wait = holder.nextRetry()
+		if !holder.isStopped() {
+			holder.setState(ShardStateBackoff, nil)
+			holder.mgr.getMetrics().ObserveReconnect(holder.session.Shards.ShardID)
+		}
 	} else {
+		// 分区仍由其他实例持有，等待其释放或者租约过期后再尝试
+		wait = holder.mgr.acquireInterval
+	}
+	if !holder.isStopped() {
+		fmt.Printf("[ws/session][%v] reconnecting after %v\n", holder.session.Shards.ShardID, wait)
+		select {
+		case <-time.After(wait):
+		case <-holder.ctx.Done():
+		}
+	}
+	if holder.finish() {
 		fmt.Printf("[ws/session][%v] exiting\n", holder.session.Shards.ShardID)
+		holder.cleanup()
+		return
+	}
+	// 将 session 放到 session chan 中，用于启动新的连接，当前连接退出。ctx结束时由stop保存session并释放分区归属
+	select {
+	case holder.mgr.holderChan <- holder:
+	case <-holder.ctx.Done():
+	}
+}
+
+// nextRetry 计算下次重连前的等待时间，链接保持超过ResetAfter后重新从Initial开始退避
+func (holder *sessionHolder) nextRetry() time.Duration {
+	backoff := holder.mgr.backoff.withDefaults()
+	if !holder.connectedAt.IsZero() && time.Since(holder.connectedAt) >= backoff.ResetAfter {
+		holder.retry = 0
 	}
+	holder.retry = backoff.next(holder.retry)
+	return backoff.jitter(holder.retry)
 }
 
 // canNotResume 是否是不能够 resume 的错误
 func canNotResume(err error) bool {
-	e := errs.Error(err)
-	if flag, ok := canNotResumeErrSet[e.Code()]; ok {
+	if flag, ok := canNotResumeErrSet[errCode(err)]; ok {
 		return flag
 	}
 	return false
@@ -184,16 +670,51 @@ func canNotResume(err error) bool {
 
 // CanNotIdentify 是否是不能够 identify 的错误
 func CanNotIdentify(err error) bool {
-	e := errs.Error(err)
-	if flag, ok := canNotIdentifyErrSet[e.Code()]; ok {
+	if flag, ok := canNotIdentifyErrSet[errCode(err)]; ok {
 		return flag
 	}
 	return false
 }
 
-// calcInterval 根据并发要求，计算连接启动间隔
+// IsInvalidAuth 是否是token、intent等鉴权参数错误（关闭码4004、4012、4013、4014），修改配置前重连也无法恢复。
+// 优先根据错误链中的 *websocket.CloseError 的关闭码判断，分区默认使用的ws实现会保留CloseError；
+// botgo默认的ws实现将这些关闭错误转换为 errs.CodeConnCloseCantResume 错误码，只保留了错误信息，此时从错误信息中解析关闭码
+func IsInvalidAuth(err error) bool {
+	var closeErr *wss.CloseError
+	if errors.As(err, &closeErr) {
+		return invalidAuthCloseCodes[closeErr.Code]
+	}
+	var sdkErr *errs.Err
+	if !errors.As(err, &sdkErr) || sdkErr.Code() != errs.CodeConnCloseCantResume {
+		return false
+	}
+	// 错误信息为 *websocket.CloseError 的 Error()，格式为 websocket: close 4004: reason
+	var code int
+	if _, err := fmt.Sscanf(sdkErr.Text(), "websocket: close %d", &code); err != nil {
+		return false
+	}
+	return invalidAuthCloseCodes[code]
+}
+
+// errCode 获取错误链中的sdk错误码，没有sdk错误时与 errs.Error 一致返回未知错误码
+func errCode(err error) int {
+	var sdkErr *errs.Err
+	if errors.As(err, &sdkErr) {
+		return sdkErr.Code()
+	}
+	return errs.Error(err).Code()
+}
+
+// canNotReconnect 是否需要停止分区重连，开启stopOnInvalidAuth时鉴权参数错误也会停止重连
+func (mgr *SessionManager) canNotReconnect(err error) bool {
+	return CanNotIdentify(err) || (mgr.stopOnInvalidAuth && IsInvalidAuth(err))
+}
+
+// calcInterval 根据并发要求，计算平均每次鉴权的间隔
 func calcInterval(maxConcurrency uint32) time.Duration {
 	// maxConcurrency 代表的是每 5s 可以连多少个请求
-	f := math.Round(5 / float64(maxConcurrency))
-	return time.Duration(f) * time.Second
+	if maxConcurrency == 0 {
+		maxConcurrency = 1
+	}
+	return DftIdentifyInterval / time.Duration(maxConcurrency)
 }
@@ -2,11 +2,16 @@ package schedule
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
-	"github.com/agiledragon/gomonkey/v2"
+	wss "github.com/gorilla/websocket"
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
 	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/errs"
 	"github.com/tencent-connect/botgo/token"
 	"github.com/tencent-connect/botgo/websocket"
 )
@@ -26,7 +31,6 @@ var testIntent = dto.IntentGuildAtMessage
 
 func Test_SessionManager_Start(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
-	count := 0
 	type fields struct {
 		ctx        context.Context
 		token      *token.Token
@@ -52,14 +56,8 @@ func Test_SessionManager_Start(t *testing.T) {
 		},
 	}
 
-	defer gomonkey.ApplyFunc(time.Sleep, func(d time.Duration) {
-		count++
-		// 第一次循环后，则关闭session mgr
-		if count == 1 {
-			cancel()
-		}
-	}).Reset()
-	websocket.Register(&MockBotWebSocket{})
+	// 建立链接后关闭session mgr，Start需要停止所有session并等待session协程退出
+	time.AfterFunc(50*time.Millisecond, cancel)
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mgr := &SessionManager{
@@ -73,10 +71,20 @@ func Test_SessionManager_Start(t *testing.T) {
 			if err := mgr.Start(); (err != nil) != tt.wantErr {
 				t.Errorf("SessionManager.Start() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			for _, h := range mgr.holders {
+				if h.getStatus().State != ShardStateStopped {
+					t.Errorf("SessionManager.Start() shard %v not stopped", h.session.Shards.ShardID)
+				}
+			}
 		})
 	}
 }
 
+func init() {
+	// 未指定wsFactory的用例统一使用模拟的ws，需要替换实现的用例通过wsFactory注入，不修改全局注册
+	websocket.Register(&MockBotWebSocket{})
+}
+
 // MockBotWebSocket 需要实现的接口
 type MockBotWebSocket struct{}
 
@@ -118,3 +126,593 @@ func (m *MockBotWebSocket) Write(message *dto.WSPayload) error {
 // Close 关闭连接
 func (m *MockBotWebSocket) Close() {
 }
+
+func Test_SessionManager_updateShards(t *testing.T) {
+	si := &shardInfo{
+		shardIDs: []uint32{0, 1},
+		shardNum: 4,
+		ap:       testShardInfo.ap,
+	}
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, si)
+	h0, h1 := mgr.newHolder(0), mgr.newHolder(1)
+	mgr.holders = []*sessionHolder{h0, h1}
+	mgr.started = true
+
+	mgr.updateShards([]uint32{1, 2, 3})
+
+	var got []uint32
+	for _, h := range mgr.holders {
+		got = append(got, h.session.Shards.ShardID)
+	}
+	if !reflect.DeepEqual(got, []uint32{1, 2, 3}) {
+		t.Errorf("updateShards() holders = %v, want %v", got, []uint32{1, 2, 3})
+	}
+	if !h0.isStopped() {
+		t.Errorf("updateShards() removed shard not stopped")
+	}
+	if h1.isStopped() || mgr.holders[0] != h1 {
+		t.Errorf("updateShards() unchanged shard should keep its holder")
+	}
+	if len(mgr.holderChan) != 2 {
+		t.Errorf("updateShards() enqueued %v holders, want 2", len(mgr.holderChan))
+	}
+	if !reflect.DeepEqual(si.shardIDs, []uint32{0, 1}) {
+		t.Errorf("updateShards() should not modify the original shard info")
+	}
+}
+
+// mockShardOwner 模拟分区归属管理器
+type mockShardOwner struct {
+	allow    bool
+	released []uint32
+}
+
+// AcquireShard 获取分区归属
+func (m *mockShardOwner) AcquireShard(ctx context.Context, shardID uint32) (bool, error) {
+	return m.allow, nil
+}
+
+// ReleaseShard 释放分区归属
+func (m *mockShardOwner) ReleaseShard(ctx context.Context, shardID uint32) error {
+	m.released = append(m.released, shardID)
+	return nil
+}
+
+// countingWebSocket 记录Connect次数的ws
+type countingWebSocket struct {
+	MockBotWebSocket
+	connects int
+}
+
+// Connect 连接到 wss 地址
+func (m *countingWebSocket) Connect() error {
+	m.connects++
+	return nil
+}
+
+func Test_sessionHolder_serve_shardOwner(t *testing.T) {
+	owner := &mockShardOwner{}
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	mgr.owner = owner
+	mgr.acquireInterval = time.Millisecond
+	mgr.backoff = Backoff{Initial: time.Millisecond}
+	// 同一分区多次鉴权，不做频控
+	mgr.limiter = nil
+	holder := mgr.newHolder(1)
+	ws := &countingWebSocket{}
+	holder.ws = ws
+
+	// 分区被其他实例持有，不能建立链接
+	holder.serve()
+	if ws.connects != 0 || holder.owned {
+		t.Errorf("sessionHolder.serve() connected without shard ownership")
+	}
+	if len(mgr.holderChan) != 1 {
+		t.Errorf("sessionHolder.serve() should retry later")
+	}
+	<-mgr.holderChan
+
+	owner.allow = true
+	holder.serve()
+	if ws.connects != 1 || !holder.owned {
+		t.Errorf("sessionHolder.serve() connects = %v, owned = %v", ws.connects, holder.owned)
+	}
+	<-mgr.holderChan
+
+	// 重连前重新确认分区归属，例如本地实例租约失效期间分区已经被其他实例接手
+	owner.allow = false
+	holder.serve()
+	if ws.connects != 1 || holder.owned {
+		t.Errorf("sessionHolder.serve() reconnect connects = %v, owned = %v, want 1, false", ws.connects, holder.owned)
+	}
+	<-mgr.holderChan
+	owner.allow = true
+	holder.serve()
+	if ws.connects != 2 || !holder.owned {
+		t.Errorf("sessionHolder.serve() connects = %v, owned = %v", ws.connects, holder.owned)
+	}
+	<-mgr.holderChan
+
+	holder.stop()
+	if !reflect.DeepEqual(owner.released, []uint32{1}) || holder.owned {
+		t.Errorf("sessionHolder.stop() released = %v, want [1]", owner.released)
+	}
+}
+
+// bannedWebSocket 模拟机器人被封禁的ws
+type bannedWebSocket struct {
+	MockBotWebSocket
+	session dto.Session
+}
+
+// Session 拉取 session 信息
+func (m *bannedWebSocket) Session() *dto.Session {
+	return &m.session
+}
+
+// Listening 监听websocket事件
+func (m *bannedWebSocket) Listening() error {
+	return errs.New(errs.CodeConnCloseCantIdentify, "banned")
+}
+
+func Test_sessionHolder_serve_canNotIdentify(t *testing.T) {
+	var fatalErr error
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	mgr.onFatal = func(err error) {
+		fatalErr = err
+	}
+	holder := mgr.newHolder(1)
+	holder.ws = &bannedWebSocket{}
+
+	holder.serve()
+	if !errors.Is(fatalErr, ErrCanNotIdentify) {
+		t.Errorf("sessionHolder.serve() fatal err = %v, want %v", fatalErr, ErrCanNotIdentify)
+	}
+	if !holder.isStopped() || len(mgr.holderChan) != 0 {
+		t.Errorf("sessionHolder.serve() should not reconnect after can not identify")
+	}
+}
+
+// resumableWebSocket 记录identify/resume次数的ws，Listening返回后session id为sid
+type resumableWebSocket struct {
+	MockBotWebSocket
+	session          dto.Session
+	identify, resume int
+}
+
+// Session 拉取 session 信息
+func (m *resumableWebSocket) Session() *dto.Session {
+	m.session.ID = "sid"
+	m.session.LastSeq = 10
+	return &m.session
+}
+
+// Identify 鉴权连接
+func (m *resumableWebSocket) Identify() error {
+	m.identify++
+	return nil
+}
+
+// Resume 重连
+func (m *resumableWebSocket) Resume() error {
+	m.resume++
+	return nil
+}
+
+func Test_sessionHolder_connectAndListen_preferResume(t *testing.T) {
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap: &dto.WebsocketAP{
+			Shards:            1,
+			SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 10},
+		},
+	})
+	holder := mgr.newHolder(0)
+	ws := &resumableWebSocket{}
+	holder.ws = ws
+
+	holder.connectAndListen()
+	holder.connectAndListen()
+	if ws.identify != 1 || ws.resume != 1 {
+		t.Errorf("connectAndListen() identify = %v, resume = %v, want 1, 1", ws.identify, ws.resume)
+	}
+	if holder.session.ID != "sid" || holder.session.LastSeq != 10 {
+		t.Errorf("connectAndListen() session not synced: %+v", holder.session)
+	}
+	if got := mgr.IdentifyBudget().Remaining; got != 9 {
+		t.Errorf("SessionManager.IdentifyBudget().Remaining = %v, want 9", got)
+	}
+}
+
+// dialWebSocket 模拟botgo的ws，Connect成功前没有底层链接，此时Close会panic
+type dialWebSocket struct {
+	MockBotWebSocket
+	connects int
+}
+
+// Connect 连接到 wss 地址
+func (m *dialWebSocket) Connect() error {
+	m.connects++
+	return nil
+}
+
+// Close 关闭连接
+func (m *dialWebSocket) Close() {
+	if m.connects == 0 {
+		panic("close before connect")
+	}
+}
+
+func Test_sessionHolder_stop_beforeConnect(t *testing.T) {
+	// 鉴权预算耗尽，session协程等待到重置时间才会建立链接
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap: &dto.WebsocketAP{
+			Shards:            1,
+			SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 0, ResetAfter: 3600 * 1000},
+		},
+	})
+	owner := &mockShardOwner{allow: true}
+	mgr.owner = owner
+	holder := mgr.newHolder(0)
+	ws := &dialWebSocket{}
+	holder.ws = ws
+	holder.running = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		holder.serve()
+	}()
+	for holder.getStatus().State != ShardStateConnecting {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 等待期间停止，不能关闭尚未建立的链接，session协程需要立即退出并释放分区归属
+	holder.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("sessionHolder.serve() still waiting after stop")
+	}
+	if ws.connects != 0 || len(mgr.holderChan) != 0 {
+		t.Errorf("sessionHolder.serve() connects = %v, requeued = %v after stop", ws.connects, len(mgr.holderChan))
+	}
+	if !reflect.DeepEqual(owner.released, []uint32{0}) {
+		t.Errorf("sessionHolder.serve() released = %v, want [0]", owner.released)
+	}
+}
+
+// recordingLimiter 记录获取令牌的桶
+type recordingLimiter struct {
+	buckets   []uint32
+	intervals []time.Duration
+}
+
+// Acquire 获取令牌
+func (l *recordingLimiter) Acquire(ctx context.Context, bucket uint32, interval time.Duration) error {
+	l.buckets = append(l.buckets, bucket)
+	l.intervals = append(l.intervals, interval)
+	return nil
+}
+
+func Test_sessionHolder_connectAndListen_identifyLimiter(t *testing.T) {
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{6},
+		shardNum: 8,
+		ap: &dto.WebsocketAP{
+			Shards:            8,
+			SessionStartLimit: dto.SessionStartLimit{MaxConcurrency: 4},
+		},
+	})
+	limiter := &recordingLimiter{}
+	mgr.limiter = limiter
+	holder := mgr.newHolder(6)
+	holder.ws = &resumableWebSocket{}
+
+	// 首次identify需要获取令牌，之后resume不需要
+	holder.connectAndListen()
+	holder.connectAndListen()
+	if !reflect.DeepEqual(limiter.buckets, []uint32{2}) {
+		t.Errorf("connectAndListen() acquire buckets = %v, want [2]", limiter.buckets)
+	}
+	if !reflect.DeepEqual(limiter.intervals, []time.Duration{DftIdentifyInterval}) {
+		t.Errorf("connectAndListen() acquire intervals = %v", limiter.intervals)
+	}
+}
+
+// blockingLimiter 一直阻塞到ctx结束的频控
+type blockingLimiter struct {
+	waiting chan struct{}
+}
+
+// Acquire 获取令牌
+func (l *blockingLimiter) Acquire(ctx context.Context, bucket uint32, interval time.Duration) error {
+	close(l.waiting)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func Test_sessionHolder_connectAndListen_stopWhileLimited(t *testing.T) {
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{0},
+		shardNum: 1,
+		ap: &dto.WebsocketAP{
+			Shards:            1,
+			SessionStartLimit: dto.SessionStartLimit{Total: 10, Remaining: 10, MaxConcurrency: 1},
+		},
+	})
+	limiter := &blockingLimiter{waiting: make(chan struct{})}
+	mgr.limiter = limiter
+	holder := mgr.newHolder(0)
+	ws := &countingWebSocket{}
+	holder.ws = ws
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		holder.connectAndListen()
+	}()
+
+	// 等待频控期间停止，不建立链接，也没有消耗鉴权预算
+	<-limiter.waiting
+	holder.stop()
+	<-done
+	if ws.connects != 0 {
+		t.Errorf("connectAndListen() connects = %v after stop, want 0", ws.connects)
+	}
+	if got := mgr.IdentifyBudget().Remaining; got != 10 {
+		t.Errorf("IdentifyBudget().Remaining = %v, want 10", got)
+	}
+}
+
+// blockingWebSocket Listening阻塞直到Close，记录identify的分区
+type blockingWebSocket struct {
+	MockBotWebSocket
+	session    dto.Session
+	closed     chan struct{}
+	identified chan uint32
+}
+
+// New 创建ws
+func (m *blockingWebSocket) New(session dto.Session) websocket.WebSocket {
+	return &blockingWebSocket{session: session, closed: make(chan struct{}), identified: m.identified}
+}
+
+// Identify 鉴权连接，记录鉴权的分区
+func (m *blockingWebSocket) Identify() error {
+	m.identified <- m.session.Shards.ShardID
+	return nil
+}
+
+// Listening 监听websocket事件
+func (m *blockingWebSocket) Listening() error {
+	<-m.closed
+	return errors.New("closed")
+}
+
+// Close 关闭连接
+func (m *blockingWebSocket) Close() {
+	close(m.closed)
+}
+
+func Test_SessionManager_Start_concurrentIdentify(t *testing.T) {
+	identified := make(chan uint32, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	si := &shardInfo{
+		shardIDs: []uint32{0, 1, 2, 3, 4, 5, 6, 7},
+		shardNum: 8,
+		ap: &dto.WebsocketAP{
+			Shards:            8,
+			SessionStartLimit: dto.SessionStartLimit{MaxConcurrency: 4},
+		},
+	}
+	mgr := NewSessionManager(ctx, &token.Token{}, &testIntent, si)
+	mgr.wsFactory = &blockingWebSocket{identified: identified}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = mgr.Start()
+	}()
+
+	// 4个频控桶可以立即并发鉴权，同一个桶内的第二个分区需要等待下一个频控窗口
+	buckets := map[uint32]bool{}
+	timeout := time.After(time.Second)
+	for i := 0; i < 4; i++ {
+		select {
+		case sid := <-identified:
+			buckets[sid%4] = true
+		case <-timeout:
+			t.Fatalf("SessionManager.Start() identified %v shards in 1s, want 4", i)
+		}
+	}
+	if len(buckets) != 4 {
+		t.Errorf("SessionManager.Start() identified buckets = %v, want 4 different buckets", buckets)
+	}
+	select {
+	case sid := <-identified:
+		t.Errorf("SessionManager.Start() shard %v identified in the same window", sid)
+	case <-time.After(200 * time.Millisecond):
+	}
+	cancel()
+	<-done
+}
+
+func Test_calcInterval(t *testing.T) {
+	tests := []struct {
+		maxConcurrency uint32
+		want           time.Duration
+	}{
+		{maxConcurrency: 0, want: 5 * time.Second},
+		{maxConcurrency: 1, want: 5 * time.Second},
+		{maxConcurrency: 3, want: 5 * time.Second / 3},
+		{maxConcurrency: 10, want: 500 * time.Millisecond},
+		{maxConcurrency: 16, want: 312500 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		if got := calcInterval(tt.maxConcurrency); got != tt.want {
+			t.Errorf("calcInterval(%v) = %v, want %v", tt.maxConcurrency, got, tt.want)
+		}
+	}
+}
+
+// cantResumeWebSocket resume后Listening返回不能resume的错误
+type cantResumeWebSocket struct {
+	resumableWebSocket
+}
+
+// Listening 监听websocket事件
+func (m *cantResumeWebSocket) Listening() error {
+	return errs.New(errs.CodeConnCloseCantResume, "can not resume")
+}
+
+func Test_sessionHolder_sessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := base.NewMemorySessionStore()
+	si := &shardInfo{
+		shardIDs: []uint32{1},
+		shardNum: 2,
+		ap:       &dto.WebsocketAP{Shards: 2},
+	}
+	mgr := NewSessionManager(ctx, &token.Token{}, &testIntent, si)
+	mgr.store = store
+
+	// 分区总数不一致的session不能resume
+	_ = store.SaveSession(ctx, &base.Session{ShardID: 1, ShardCount: 4, SessionID: "old", LastSeq: 3})
+	holder := mgr.newHolder(1)
+	holder.restoreSession()
+	if holder.session.ID != "" {
+		t.Errorf("sessionHolder.restoreSession() restored session with different shard count")
+	}
+
+	// 从存储中恢复session后优先resume，并保存最新的seq
+	_ = store.SaveSession(ctx, &base.Session{ShardID: 1, ShardCount: 2, SessionID: "old", LastSeq: 3})
+	holder = mgr.newHolder(1)
+	holder.restoreSession()
+	if holder.session.ID != "old" || holder.session.LastSeq != 3 {
+		t.Fatalf("sessionHolder.restoreSession() session = %+v", holder.session)
+	}
+	ws := &resumableWebSocket{}
+	holder.ws = ws
+	holder.connectAndListen()
+	if ws.identify != 0 || ws.resume != 1 {
+		t.Errorf("connectAndListen() identify = %v, resume = %v, want 0, 1", ws.identify, ws.resume)
+	}
+	want := &base.Session{ShardID: 1, ShardCount: 2, SessionID: "sid", LastSeq: 10}
+	if got, _ := store.LoadSession(ctx, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("connectAndListen() saved session = %+v, want %+v", got, want)
+	}
+
+	// 不能resume的session需要从存储中删除
+	holder.ws = &cantResumeWebSocket{}
+	holder.connectAndListen()
+	if got, _ := store.LoadSession(ctx, 1); got != nil {
+		t.Errorf("connectAndListen() saved session = %+v, want nil", got)
+	}
+	if holder.session.ID != "" {
+		t.Errorf("connectAndListen() session id = %v, want empty", holder.session.ID)
+	}
+}
+
+// flakyWebSocket 模拟gateway故障的ws，fail为true时Connect失败
+type flakyWebSocket struct {
+	MockBotWebSocket
+	fail bool
+}
+
+// Connect 连接到 wss 地址
+func (m *flakyWebSocket) Connect() error {
+	if m.fail {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func Test_sessionHolder_nextRetry(t *testing.T) {
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	mgr.backoff = Backoff{Initial: time.Second, Max: 4 * time.Second, Multiplier: 2, ResetAfter: time.Minute}
+	// 每次都需要identify，去掉频控避免等待
+	mgr.limiter = nil
+	holder := mgr.newHolder(1)
+	ws := &flakyWebSocket{fail: true}
+	holder.ws = ws
+	var got []time.Duration
+	retry := func() {
+		holder.connectAndListen()
+		got = append(got, holder.nextRetry())
+	}
+
+	// gateway故障期间等待时间指数增长，不超过Max
+	for i := 0; i < 4; i++ {
+		retry()
+	}
+	// 链接建立后很快断开，不重置退避
+	ws.fail = false
+	retry()
+	// 链接保持超过ResetAfter后断开，重新从Initial开始退避
+	holder.connectedAt = time.Now().Add(-time.Hour)
+	got = append(got, holder.nextRetry())
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second, time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sessionHolder.nextRetry() = %v, want %v", got, want)
+	}
+}
+
+func Test_CanNotIdentify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "banned", err: errs.New(errs.CodeConnCloseCantIdentify, "websocket: close 4915: banned"), want: true},
+		{name: "invalid token", err: errs.New(errs.CodeConnCloseCantResume, "websocket: close 4004: invalid token"), want: false},
+		{name: "invalid session", err: errs.New(errs.CodeConnCloseCantResume, "websocket: close 4009: timeout"), want: false},
+		{name: "need reconnect", err: errs.ErrNeedReConnect, want: false},
+		{name: "network", err: errors.New("read tcp: connection reset by peer"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanNotIdentify(tt.err); got != tt.want {
+				t.Errorf("CanNotIdentify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_IsInvalidAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "invalid token", err: &wss.CloseError{Code: 4004, Text: "invalid token"}, want: true},
+		{name: "wrapped invalid intent", err: fmt.Errorf("listening: %w", &wss.CloseError{Code: 4013}), want: true},
+		{name: "invalid session", err: &wss.CloseError{Code: 4009}, want: false},
+		// botgo默认的ws实现只保留了错误信息
+		{name: "botgo invalid token", err: errs.New(errs.CodeConnCloseCantResume, "websocket: close 4004: invalid token"), want: true},
+		{name: "botgo invalid intent", err: errs.New(errs.CodeConnCloseCantResume, "websocket: close 4014"), want: true},
+		{name: "botgo other close", err: errs.New(errs.CodeConnCloseCantResume, "websocket: close 4006: session timeout"), want: false},
+		{name: "botgo invalid session", err: errs.ErrInvalidSession, want: false},
+		{name: "wrapped close error", err: newCloseError(errs.CodeConnCloseCantResume, &wss.CloseError{Code: 4012}), want: true},
+		{name: "network", err: errors.New("read tcp: connection reset by peer"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsInvalidAuth(tt.err); got != tt.want {
+				t.Errorf("IsInvalidAuth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionManager_canNotReconnect(t *testing.T) {
+	invalidAuth := &wss.CloseError{Code: 4004}
+	mgr := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	if mgr.canNotReconnect(invalidAuth) {
+		t.Errorf("SessionManager.canNotReconnect() = true by default, want false")
+	}
+	mgr.stopOnInvalidAuth = true
+	if !mgr.canNotReconnect(invalidAuth) {
+		t.Errorf("SessionManager.canNotReconnect() = false with stopOnInvalidAuth, want true")
+	}
+}
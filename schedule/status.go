@@ -0,0 +1,156 @@
+// Package schedule 本文件实现调度器运行状态查询
+package schedule
+
+import (
+	"time"
+)
+
+// ShardState 分区链接状态
+type ShardState string
+
+const (
+	// ShardStateWaiting 等待启动，或者分区仍由其他实例持有
+	ShardStateWaiting ShardState = "waiting"
+	// ShardStateConnecting 正在建立websocket链接，包括等待鉴权预算和频控令牌
+	ShardStateConnecting ShardState = "connecting"
+	// ShardStateIdentifying 正在鉴权
+	ShardStateIdentifying ShardState = "identifying"
+	// ShardStateResuming 正在resume
+	ShardStateResuming ShardState = "resuming"
+	// ShardStateConnected 链接已建立，正在接收事件
+	ShardStateConnected ShardState = "connected"
+	// ShardStateBackoff 链接断开，等待重连
+	ShardStateBackoff ShardState = "backoff"
+	// ShardStateStopped 已停止，分区不再由本实例负责或者无法再鉴权
+	ShardStateStopped ShardState = "stopped"
+)
+
+// ShardStatus 分区链接状态信息
+type ShardStatus struct {
+	// ShardID 分区id
+	ShardID uint32 `json:"shard_id"`
+	// State 链接状态
+	State ShardState `json:"state"`
+	// SessionID 当前session id
+	SessionID string `json:"session_id,omitempty"`
+	// LastSeq 最近同步到的事件序号，默认的ws实现每个事件处理完成后同步，其他ws实现在链接关闭时同步
+	LastSeq uint32 `json:"last_seq"`
+	// LastError 最近一次错误
+	LastError string `json:"last_error,omitempty"`
+	// Reconnects 重连次数
+	Reconnects int `json:"reconnects"`
+	// ConnectedAt 最近一次链接建立成功的时间，没有建立过链接时为nil
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+}
+
+// Status 调度器运行状态
+type Status struct {
+	// InstanceID 本地实例id
+	InstanceID string `json:"instance_id"`
+	// Running 调度协程是否正在运行
+	Running bool `json:"running"`
+	// Draining 本地实例是否正在下线
+	Draining bool `json:"draining"`
+	// Fenced 本地实例租约失效后是否处于隔离状态，隔离期间不处理任何分区
+	Fenced bool `json:"fenced"`
+	// Leader 开启集中分配时本地实例是否为leader
+	Leader bool `json:"leader"`
+	// AssignmentVersion 开启集中分配时最近收到的分配结果版本号
+	AssignmentVersion uint64 `json:"assignment_version,omitempty"`
+	// MembershipVersion 最近一次调度使用的成员视图指纹
+	MembershipVersion string `json:"membership_version"`
+	// Members 最近一次调度使用的成员视图，按照实例id排序
+	Members []string `json:"members"`
+	// ShardNum 分区总数，没有运行中的bot session时为0
+	ShardNum uint32 `json:"shard_num"`
+	// ShardIDs 本实例负责的分区id列表
+	ShardIDs []uint32 `json:"shard_ids"`
+	// Shards 各分区的链接状态
+	Shards []ShardStatus `json:"shards"`
+	// IdentifyBudget 鉴权次数预算
+	IdentifyBudget IdentifyBudget `json:"identify_budget"`
+}
+
+// Status 获取调度器当前的运行状态，可以用于运维看板或者就绪检查
+func (sched *Scheduler) Status() Status {
+	status := Status{
+		InstanceID: sched.localInstance.GetID(),
+		Running:    sched.running(),
+	}
+	sched.stateMu.RLock()
+	view, sessionCtx := sched.view, sched.sessionCtx
+	status.Draining, status.Leader, status.Fenced = sched.draining, sched.leader, sched.fenced
+	if sched.assignment != nil {
+		status.AssignmentVersion = sched.assignment.Version
+	}
+	sched.stateMu.RUnlock()
+	if view != nil {
+		status.MembershipVersion = view.version
+		for _, ins := range view.instances {
+			status.Members = append(status.Members, ins.GetID())
+		}
+	}
+	if sessionCtx != nil {
+		status.ShardNum, status.ShardIDs, status.Shards = sessionCtx.sm.status()
+		status.IdentifyBudget = sessionCtx.sm.IdentifyBudget()
+	}
+	return status
+}
+
+// status 获取分区总数、负责的分区以及各分区的链接状态
+func (mgr *SessionManager) status() (uint32, []uint32, []ShardStatus) {
+	mgr.mu.Lock()
+	shardNum := mgr.si.shardNum
+	shardIDs := append([]uint32(nil), mgr.si.shardIDs...)
+	holders := mgr.holders
+	mgr.mu.Unlock()
+	shards := make([]ShardStatus, 0, len(holders))
+	for _, h := range holders {
+		shards = append(shards, h.getStatus())
+	}
+	return shardNum, shardIDs, shards
+}
+
+// setState 更新分区链接状态，err不为nil时记录为最近一次错误
+func (holder *sessionHolder) setState(state ShardState, err error) {
+	holder.statusMu.Lock()
+	holder.status.State = state
+	if err != nil {
+		holder.status.LastError = err.Error()
+	}
+	switch state {
+	case ShardStateConnected:
+		now := time.Now()
+		holder.status.ConnectedAt = &now
+	case ShardStateBackoff:
+		holder.status.Reconnects++
+	}
+	holder.statusMu.Unlock()
+	holder.mgr.getMetrics().ObserveShardState(holder.status.ShardID, state)
+}
+
+// setSession 更新状态中的session id与seq，并根据seq的增量上报事件数。
+// 同一个session的seq增量即为期间收到的事件数，新session的seq从1开始
+func (holder *sessionHolder) setSession(sessionID string, lastSeq uint32) {
+	holder.statusMu.Lock()
+	prevID, prevSeq := holder.status.SessionID, holder.status.LastSeq
+	holder.status.SessionID = sessionID
+	holder.status.LastSeq = lastSeq
+	holder.statusMu.Unlock()
+	var n uint32
+	if sessionID != prevID {
+		n = lastSeq
+	} else if lastSeq > prevSeq {
+		n = lastSeq - prevSeq
+	}
+	if sessionID != "" && n > 0 {
+		holder.mgr.getMetrics().ObserveEvents(holder.status.ShardID, n)
+	}
+}
+
+// getStatus 获取分区链接状态
+func (holder *sessionHolder) getStatus() ShardStatus {
+	holder.statusMu.Lock()
+	defer holder.statusMu.Unlock()
+	return holder.status
+}
@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/token"
+)
+
+func TestScheduler_Status(t *testing.T) {
+	sched := &Scheduler{localInstance: &mockInstance{id: "ins2"}}
+	if got := sched.Status(); got.InstanceID != "ins2" || got.ShardNum != 0 || len(got.Shards) != 0 {
+		t.Errorf("Scheduler.Status() before schedule = %+v", got)
+	}
+
+	sched.view = newMembership([]base.Instance{&mockInstance{id: "ins2"}, &mockInstance{id: "ins1"}})
+	si := &shardInfo{
+		shardIDs: []uint32{1, 3},
+		shardNum: 4,
+		ap:       &dto.WebsocketAP{Shards: 4},
+	}
+	sm := NewSessionManager(context.Background(), &token.Token{}, &testIntent, si)
+	sm.limiter = nil
+	connected, failed := sm.newHolder(1), sm.newHolder(3)
+	sm.holders = []*sessionHolder{connected, failed}
+	sched.sessionCtx = &botSessionCtx{si: si, sm: sm}
+
+	connected.ws = &resumableWebSocket{}
+	connected.connectAndListen()
+	failed.ws = &flakyWebSocket{fail: true}
+	failed.connectAndListen()
+	failed.setState(ShardStateBackoff, nil)
+
+	got := sched.Status()
+	if got.MembershipVersion != sched.view.version || !reflect.DeepEqual(got.Members, []string{"ins1", "ins2"}) {
+		t.Errorf("Scheduler.Status() membership = %v %v", got.MembershipVersion, got.Members)
+	}
+	if got.ShardNum != 4 || !reflect.DeepEqual(got.ShardIDs, []uint32{1, 3}) || len(got.Shards) != 2 {
+		t.Fatalf("Scheduler.Status() shards = %v %v %v", got.ShardNum, got.ShardIDs, got.Shards)
+	}
+	if s := got.Shards[0]; s.State != ShardStateConnected || s.SessionID != "sid" || s.LastSeq != 10 ||
+		s.ConnectedAt == nil {
+		t.Errorf("Scheduler.Status() connected shard = %+v", s)
+	}
+	if s := got.Shards[1]; s.State != ShardStateBackoff || s.LastError == "" || s.Reconnects != 1 {
+		t.Errorf("Scheduler.Status() failed shard = %+v", s)
+	}
+}
+
+func Test_sessionHolder_setState(t *testing.T) {
+	sm := NewSessionManager(context.Background(), &token.Token{}, &testIntent, testShardInfo)
+	holder := sm.newHolder(0)
+	if got := holder.getStatus(); got.State != ShardStateWaiting || got.ShardID != 0 {
+		t.Errorf("sessionHolder.getStatus() = %+v", got)
+	}
+	holder.setState(ShardStateConnecting, errors.New("refused"))
+	// 没有新的错误时保留最近一次错误
+	holder.setState(ShardStateBackoff, nil)
+	holder.stop()
+	got := holder.getStatus()
+	if got.State != ShardStateStopped || got.LastError != "refused" || got.Reconnects != 1 {
+		t.Errorf("sessionHolder.getStatus() = %+v", got)
+	}
+	// 没有建立过链接时不输出链接时间
+	buf, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if strings.Contains(string(buf), "connected_at") {
+		t.Errorf("json.Marshal() = %s, want no connected_at", buf)
+	}
+}
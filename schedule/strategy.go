@@ -0,0 +1,201 @@
+// Package schedule 本文件实现分区分配策略
+package schedule
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+// Strategy 分区分配策略，根据有效实例列表计算各个实例需要处理的分区
+type Strategy interface {
+	// Assign 计算分区归属，返回以实例ID为key的分区id列表，分区id按照升序排列。
+	// 集群中每个实例都会独立计算，因此相同的输入必须得到相同的结果
+	Assign(insList []base.Instance, shardNum uint32) map[string][]uint32
+}
+
+// NewModuloStrategy 创建取模分配策略，第idx个实例处理 idx, idx+n, idx+2n... 号分区，
+// 分配最均匀，但实例数量变化时几乎所有分区都会迁移，为默认策略
+func NewModuloStrategy() Strategy {
+	return &moduloStrategy{}
+}
+
+// NewRendezvousStrategy 创建基于实例ID的最高随机权重（HRW）哈希分配策略，
+// 实例数量变化时只有约1/N的分区会发生迁移
+func NewRendezvousStrategy() Strategy {
+	return &rendezvousStrategy{}
+}
+
+// NewWeightedStrategy 创建按实例权重分配的策略，各实例分到的分区数与元数据中的Weight成正比（未设置时为1），
+// 且不超过元数据中的MaxShards（为0表示不限制）。所有实例都达到上限仍有剩余分区时，剩余分区按权重分配并突破上限，
+// 保证每个分区都有实例负责。实例按照id排序后依次分配连续的分区，结果与实例列表顺序无关
+func NewWeightedStrategy() Strategy {
+	return &weightedStrategy{}
+}
+
+// moduloStrategy 取模分配策略
+type moduloStrategy struct{}
+
+// Assign 按照实例在列表中的位置轮流分配分区
+func (s *moduloStrategy) Assign(insList []base.Instance, shardNum uint32) map[string][]uint32 {
+	result := make(map[string][]uint32, len(insList))
+	insNum := uint32(len(insList))
+	if insNum == 0 {
+		return result
+	}
+	for sid := uint32(0); sid < shardNum; sid++ {
+		id := insList[sid%insNum].GetID()
+		result[id] = append(result[id], sid)
+	}
+	return result
+}
+
+// rendezvousStrategy HRW哈希分配策略
+type rendezvousStrategy struct{}
+
+// Assign 每个分区分配给与其哈希得分最高的实例
+func (s *rendezvousStrategy) Assign(insList []base.Instance, shardNum uint32) map[string][]uint32 {
+	result := make(map[string][]uint32, len(insList))
+	if len(insList) == 0 {
+		return result
+	}
+	insHash := make([]uint64, len(insList))
+	for i, ins := range insList {
+		insHash[i] = hashString(ins.GetID())
+	}
+	for sid := uint32(0); sid < shardNum; sid++ {
+		shardHash := mix64(uint64(sid))
+		best, bestScore := 0, uint64(0)
+		for i := range insList {
+			score := mix64(insHash[i] ^ shardHash)
+			// 得分相同时取id较小的实例，保证各实例计算结果一致
+			if i == 0 || score > bestScore ||
+				(score == bestScore && insList[i].GetID() < insList[best].GetID()) {
+				best, bestScore = i, score
+			}
+		}
+		id := insList[best].GetID()
+		result[id] = append(result[id], sid)
+	}
+	return result
+}
+
+// weightedStrategy 按权重分配策略
+type weightedStrategy struct{}
+
+// Assign 先按照权重和上限计算各实例的分区数，再按照实例id顺序分配连续的分区
+func (s *weightedStrategy) Assign(insList []base.Instance, shardNum uint32) map[string][]uint32 {
+	result := make(map[string][]uint32, len(insList))
+	if len(insList) == 0 {
+		return result
+	}
+	sorted := make([]base.Instance, len(insList))
+	copy(sorted, insList)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetID() < sorted[j].GetID()
+	})
+	quotas := weightedQuotas(sorted, shardNum)
+	sid := uint32(0)
+	for i, ins := range sorted {
+		for n := uint32(0); n < quotas[i]; n++ {
+			result[ins.GetID()] = append(result[ins.GetID()], sid)
+			sid++
+		}
+	}
+	return result
+}
+
+// weightedQuotas 计算各实例负责的分区数，超过上限的实例固定为上限，其余分区在未达上限的实例间按权重重新分配，
+// 直到没有实例超过上限。全部使用整数运算，保证各实例计算结果一致
+func weightedQuotas(insList []base.Instance, shardNum uint32) []uint32 {
+	quotas := make([]uint32, len(insList))
+	capped := make([]bool, len(insList))
+	remaining := uint64(shardNum)
+	for {
+		var active []int
+		var sumWeight uint64
+		for i, ins := range insList {
+			if !capped[i] {
+				active = append(active, i)
+				sumWeight += uint64(instanceWeight(ins))
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+		changed := false
+		for _, i := range active {
+			maxShards := uint64(insList[i].GetMetadata().MaxShards)
+			// 按权重分到的分区数超过上限
+			if maxShards > 0 && remaining*uint64(instanceWeight(insList[i])) > maxShards*sumWeight {
+				quotas[i], capped[i], changed = uint32(maxShards), true, true
+				remaining -= maxShards
+			}
+		}
+		if !changed {
+			distribute(insList, active, remaining, quotas)
+			return quotas
+		}
+	}
+	if remaining > 0 {
+		// 所有实例都达到上限，剩余分区按权重分配给所有实例
+		all := make([]int, len(insList))
+		for i := range all {
+			all[i] = i
+		}
+		distribute(insList, all, remaining, quotas)
+	}
+	return quotas
+}
+
+// distribute 使用最大余数法将shardNum个分区按权重分配给指定实例，余数相同时优先分给排在前面的实例
+func distribute(insList []base.Instance, idx []int, shardNum uint64, quotas []uint32) {
+	var sumWeight uint64
+	for _, i := range idx {
+		sumWeight += uint64(instanceWeight(insList[i]))
+	}
+	remainders := make([]uint64, len(idx))
+	assigned := uint64(0)
+	for k, i := range idx {
+		share := shardNum * uint64(instanceWeight(insList[i]))
+		quotas[i] += uint32(share / sumWeight)
+		remainders[k] = share % sumWeight
+		assigned += share / sumWeight
+	}
+	order := make([]int, len(idx))
+	for k := range order {
+		order[k] = k
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for k := uint64(0); k < shardNum-assigned; k++ {
+		quotas[idx[order[k]]]++
+	}
+}
+
+// instanceWeight 获取实例权重，未设置时为1
+func instanceWeight(ins base.Instance) uint32 {
+	if w := ins.GetMetadata().Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// hashString 计算字符串的fnv64a哈希
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix64 splitmix64的混淆函数，用于打散哈希值
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,169 @@
+package schedule
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+)
+
+func newMockInsList(num int) []base.Instance {
+	var insList []base.Instance
+	for i := 0; i < num; i++ {
+		insList = append(insList, &mockInstance{id: fmt.Sprintf("ins_%d", i)})
+	}
+	return insList
+}
+
+// checkAssignment 校验每个分区有且只有一个实例负责
+func checkAssignment(t *testing.T, assignment map[string][]uint32, shardNum uint32) {
+	owners := make(map[uint32]string, shardNum)
+	for id, shardIDs := range assignment {
+		for _, sid := range shardIDs {
+			if owner, ok := owners[sid]; ok {
+				t.Fatalf("shard %v assigned to both %v and %v", sid, owner, id)
+			}
+			owners[sid] = id
+		}
+	}
+	if uint32(len(owners)) != shardNum {
+		t.Fatalf("assigned %v shards, want %v", len(owners), shardNum)
+	}
+}
+
+func Test_moduloStrategy_Assign(t *testing.T) {
+	tests := []struct {
+		name     string
+		insList  []base.Instance
+		shardNum uint32
+		want     map[string][]uint32
+	}{
+		{name: "empty", insList: nil, shardNum: 5, want: map[string][]uint32{}},
+		{
+			name: "remainder", insList: newMockInsList(3), shardNum: 5,
+			want: map[string][]uint32{"ins_0": {0, 3}, "ins_1": {1, 4}, "ins_2": {2}},
+		}, {
+			name: "less shards", insList: newMockInsList(3), shardNum: 2,
+			want: map[string][]uint32{"ins_0": {0}, "ins_1": {1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewModuloStrategy().Assign(tt.insList, tt.shardNum); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("moduloStrategy.Assign() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rendezvousStrategy_Assign(t *testing.T) {
+	const shardNum = 1000
+	strategy := NewRendezvousStrategy()
+	before := strategy.Assign(newMockInsList(10), shardNum)
+	checkAssignment(t, before, shardNum)
+	// 结果与实例列表顺序无关
+	reversed := newMockInsList(10)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	if got := strategy.Assign(reversed, shardNum); !reflect.DeepEqual(got, before) {
+		t.Errorf("rendezvousStrategy.Assign() depends on instance order")
+	}
+
+	// 新增一个实例，只有新实例分走的分区发生迁移
+	after := strategy.Assign(newMockInsList(11), shardNum)
+	checkAssignment(t, after, shardNum)
+	owners := make(map[uint32]string, shardNum)
+	for id, shardIDs := range before {
+		for _, sid := range shardIDs {
+			owners[sid] = id
+		}
+	}
+	moved := 0
+	for id, shardIDs := range after {
+		for _, sid := range shardIDs {
+			if owners[sid] == id {
+				continue
+			}
+			if id != "ins_10" {
+				t.Errorf("shard %v moved from %v to %v", sid, owners[sid], id)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > shardNum/5 {
+		t.Errorf("rendezvousStrategy.Assign() moved %v shards, want about %v", moved, shardNum/11)
+	}
+}
+
+func newWeightedIns(id string, weight, maxShards uint32) base.Instance {
+	return &mockInstance{id: id, metadata: base.Metadata{Weight: weight, MaxShards: maxShards}}
+}
+
+func Test_weightedStrategy_Assign(t *testing.T) {
+	tests := []struct {
+		name     string
+		insList  []base.Instance
+		shardNum uint32
+		want     map[string][]uint32
+	}{
+		{name: "empty", insList: nil, shardNum: 5, want: map[string][]uint32{}},
+		{
+			name: "default weight", insList: newMockInsList(3), shardNum: 5,
+			want: map[string][]uint32{"ins_0": {0, 1}, "ins_1": {2, 3}, "ins_2": {4}},
+		}, {
+			name:     "weighted",
+			insList:  []base.Instance{newWeightedIns("b", 8, 0), newWeightedIns("a", 2, 0)},
+			shardNum: 10,
+			want:     map[string][]uint32{"a": {0, 1}, "b": {2, 3, 4, 5, 6, 7, 8, 9}},
+		}, {
+			name: "max shards",
+			insList: []base.Instance{
+				newWeightedIns("a", 1, 0), newWeightedIns("b", 1, 2), newWeightedIns("c", 2, 0),
+			},
+			shardNum: 11,
+			want: map[string][]uint32{
+				"a": {0, 1, 2}, "b": {3, 4}, "c": {5, 6, 7, 8, 9, 10},
+			},
+		}, {
+			name:     "exceed all max shards",
+			insList:  []base.Instance{newWeightedIns("a", 1, 1), newWeightedIns("b", 3, 2)},
+			shardNum: 7,
+			want:     map[string][]uint32{"a": {0, 1}, "b": {2, 3, 4, 5, 6}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewWeightedStrategy().Assign(tt.insList, tt.shardNum)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("weightedStrategy.Assign() = %v, want %v", got, tt.want)
+			}
+			if len(tt.insList) > 0 {
+				checkAssignment(t, got, tt.shardNum)
+			}
+		})
+	}
+}
+
+func Test_weightedStrategy_Assign_deterministic(t *testing.T) {
+	const shardNum = 1000
+	var insList []base.Instance
+	for i := 0; i < 7; i++ {
+		insList = append(insList, newWeightedIns(fmt.Sprintf("ins_%d", i), uint32(i%3+1), uint32(i%2*100)))
+	}
+	strategy := NewWeightedStrategy()
+	want := strategy.Assign(insList, shardNum)
+	checkAssignment(t, want, shardNum)
+	for i, j := 0, len(insList)-1; i < j; i, j = i+1, j-1 {
+		insList[i], insList[j] = insList[j], insList[i]
+	}
+	if got := strategy.Assign(insList, shardNum); !reflect.DeepEqual(got, want) {
+		t.Errorf("weightedStrategy.Assign() depends on instance order")
+	}
+	for _, ins := range insList {
+		if max := ins.GetMetadata().MaxShards; max > 0 && uint32(len(want[ins.GetID()])) > max {
+			t.Errorf("%v assigned %v shards, exceeds max %v", ins.GetID(), len(want[ins.GetID()]), max)
+		}
+	}
+}
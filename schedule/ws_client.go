@@ -0,0 +1,389 @@
+// Package schedule 本文件实现分区使用的websocket链接
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	wss "github.com/gorilla/websocket"
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/errs"
+	"github.com/tencent-connect/botgo/log"
+	"github.com/tencent-connect/botgo/websocket"
+	"github.com/tencent-connect/botgo/websocket/client"
+)
+
+// dispatchNotifier 每个事件处理完成后回调最新session id与seq的ws实现
+type dispatchNotifier interface {
+	// setDispatchHook 设置事件处理完成后的回调，需要在Listening之前调用
+	setDispatchHook(hook func(sessionID string, seq uint32))
+}
+
+// wsClient 分区默认使用的ws实现，协议处理与botgo默认的ws实现（websocket/client）一致，区别在于：
+// session由锁保护，可以在监听期间安全读取；每个事件处理完成后回调最新的session id与seq，用于逐条保存；
+// Listening等待已经读取的事件处理完成后才返回，返回后session不会再变化
+type wsClient struct {
+	// mu 保护session
+	mu      sync.Mutex
+	session dto.Session
+	// writeMu 串行化写入，心跳与鉴权、重连可能并发
+	writeMu         sync.Mutex
+	conn            *wss.Conn
+	messageQueue    chan []byte
+	closeChan       chan error
+	heartBeatTicker *time.Ticker
+	// onDispatch 事件处理完成后的回调，为nil时不回调
+	onDispatch func(sessionID string, seq uint32)
+}
+
+// useWSClient 是否使用wsClient代替全局注册的ws实现，只替换botgo默认的实现，使用方注册的其他实现保持不变
+func useWSClient() bool {
+	if websocket.ClientImpl == nil {
+		return true
+	}
+	_, ok := websocket.ClientImpl.(*client.Client)
+	return ok
+}
+
+// New 新建一个连接对象
+func (c *wsClient) New(session dto.Session) websocket.WebSocket {
+	return &wsClient{
+		session:         session,
+		messageQueue:    make(chan []byte, client.DefaultQueueSize),
+		closeChan:       make(chan error, 10),
+		heartBeatTicker: time.NewTicker(60 * time.Second), // 先给一个默认 ticker，在收到 hello 包之后，会 reset
+	}
+}
+
+// setDispatchHook 设置事件处理完成后的回调
+func (c *wsClient) setDispatchHook(hook func(sessionID string, seq uint32)) {
+	c.onDispatch = hook
+}
+
+// Connect 连接到 websocket
+func (c *wsClient) Connect() error {
+	session := c.Session()
+	if session.URL == "" {
+		return errs.ErrURLInvalid
+	}
+	conn, _, err := wss.DefaultDialer.Dial(session.URL, nil)
+	if err != nil {
+		log.Errorf("%s, connect err: %v", session, err)
+		return err
+	}
+	c.conn = conn
+	log.Infof("%s, url %s, connected", session, session.URL)
+	return nil
+}
+
+// Listening 开始监听，阻塞到链接关闭，期间维护定时心跳。链接关闭后等待已经读取的事件处理完成再返回
+func (c *wsClient) Listening() error {
+	handled := make(chan struct{})
+	go c.readMessageToQueue()
+	// 事件处理放在独立的协程中，避免业务逻辑阻塞心跳与关闭
+	go func() {
+		defer close(handled)
+		c.listenMessageAndHandle()
+	}()
+	err := c.waitClose()
+	// 关闭链接后读取协程退出并关闭事件队列，事件处理协程处理完剩余的事件后退出
+	c.Close()
+	<-handled
+	return err
+}
+
+// waitClose 定时发送心跳，直到链接关闭，返回关闭的原因
+func (c *wsClient) waitClose() error {
+	for {
+		select {
+		case err := <-c.closeChan:
+			// 关闭连接的错误码 https://bot.q.qq.com/wiki/develop/api/gateway/error/error.html
+			log.Errorf("%s Listening stop. err is %v", c.Session(), err)
+			// 不能够 identify 的错误
+			if wss.IsCloseError(err, 4914, 4915) {
+				return newCloseError(errs.CodeConnCloseCantIdentify, err)
+			}
+			// 4009: session time out, 发了 reconnect 之后马上关闭连接时候的错误码，这个是允许 resume 的
+			if wss.IsUnexpectedCloseError(err, 4009) {
+				return newCloseError(errs.CodeConnCloseCantResume, err)
+			}
+			return err
+		case <-c.heartBeatTicker.C:
+			heartBeatEvent := &dto.WSPayload{
+				WSPayloadBase: dto.WSPayloadBase{
+					OPCode: dto.WSHeartbeat,
+				},
+				Data: c.Session().LastSeq,
+			}
+			// 不处理错误，Write 内部会处理，如果发生发包异常，会通知退出
+			_ = c.Write(heartBeatEvent)
+		}
+	}
+}
+
+// listenMessageAndHandle 从事件队列读取事件并处理，队列关闭后返回
+func (c *wsClient) listenMessageAndHandle() {
+	defer func() {
+		// panic，一般是由于业务自己实现的 handle 不完善导致，打印日志后关闭这个连接，进入重连流程
+		if err := recover(); err != nil {
+			websocket.PanicHandler(err, c.Session())
+			c.closeChan <- fmt.Errorf("panic: %v", err)
+		}
+	}()
+	for message := range c.messageQueue {
+		event := &dto.WSPayload{}
+		if err := json.Unmarshal(message, event); err != nil {
+			log.Errorf("%s json failed, %v", c.Session(), err)
+			continue
+		}
+		c.writeSeq(event.Seq)
+		// 处理内置的一些事件，如果处理成功，则这个事件不再投递给业务
+		if c.isHandleBuildIn(event, message) {
+			continue
+		}
+		if event.Type == "READY" {
+			// ready 事件需要特殊处理
+			c.readyHandler(message)
+		} else if err := parseAndHandle(event, message); err != nil {
+			// 解析具体事件，并投递给业务注册的 handler
+			log.Errorf("%s parseAndHandle failed, %v", c.Session(), err)
+		}
+		// 事件处理完成后再回调，保存的seq之前的事件都已经处理过
+		if c.onDispatch != nil {
+			session := c.Session()
+			c.onDispatch(session.ID, session.LastSeq)
+		}
+	}
+}
+
+// Write 发送数据
+func (c *wsClient) Write(message *dto.WSPayload) error {
+	m, _ := json.Marshal(message)
+	c.writeMu.Lock()
+	err := c.conn.WriteMessage(wss.TextMessage, m)
+	c.writeMu.Unlock()
+	if err != nil {
+		log.Errorf("%s WriteMessage failed, %v", c.Session(), err)
+		c.closeChan <- err
+		return err
+	}
+	return nil
+}
+
+// Resume 重连
+func (c *wsClient) Resume() error {
+	session := c.Session()
+	event := &dto.WSPayload{
+		Data: &dto.WSResumeData{
+			Token:     session.Token.GetString(),
+			SessionID: session.ID,
+			Seq:       session.LastSeq,
+		},
+	}
+	event.OPCode = dto.WSResume
+	return c.Write(event)
+}
+
+// Identify 对一个连接进行鉴权，并声明监听的 shard 信息
+func (c *wsClient) Identify() error {
+	c.mu.Lock()
+	// 避免传错 intent
+	if c.session.Intent == 0 {
+		c.session.Intent = dto.IntentGuilds
+	}
+	session := c.session
+	c.mu.Unlock()
+	event := &dto.WSPayload{
+		Data: &dto.WSIdentityData{
+			Token:   session.Token.GetString(),
+			Intents: session.Intent,
+			Shard: []uint32{
+				session.Shards.ShardID,
+				session.Shards.ShardCount,
+			},
+		},
+	}
+	event.OPCode = dto.WSIdentity
+	return c.Write(event)
+}
+
+// Close 关闭连接
+func (c *wsClient) Close() {
+	if err := c.conn.Close(); err != nil {
+		log.Errorf("%s, close conn err: %v", c.Session(), err)
+	}
+	c.heartBeatTicker.Stop()
+}
+
+// Session 获取session信息的拷贝
+func (c *wsClient) Session() *dto.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session := c.session
+	return &session
+}
+
+// isHandleBuildIn 内置的事件处理，处理那些不需要业务方处理的事件，返回true时说明事件已经被处理了
+func (c *wsClient) isHandleBuildIn(event *dto.WSPayload, message []byte) bool {
+	switch event.OPCode {
+	case dto.WSHello: // 接收到 hello 后需要开始发心跳
+		c.startHeartBeatTicker(message)
+		return true
+	case dto.WSHeartbeatAck: // 心跳 ack 不需要业务处理
+		return true
+	case dto.WSReconnect: // 达到连接时长，需要重新连接，此时可以通过 resume 续传原连接上的事件
+		c.closeChan <- errs.ErrNeedReConnect
+		return true
+	case dto.WSInvalidSession: // 无效的 session，需要重新鉴权
+		c.closeChan <- errs.ErrInvalidSession
+		return true
+	default:
+		return false
+	}
+}
+
+// startHeartBeatTicker 根据 hello 的回包，重新设置心跳的定时器时间
+func (c *wsClient) startHeartBeatTicker(message []byte) {
+	helloData := &dto.WSHelloData{}
+	if err := parseData(message, helloData); err != nil {
+		log.Errorf("%s hello data parse failed, %v, message %v", c.Session(), err, message)
+	}
+	if helloData.HeartbeatInterval > 0 {
+		c.heartBeatTicker.Reset(time.Duration(helloData.HeartbeatInterval) * time.Millisecond)
+	}
+}
+
+// readMessageToQueue 读取消息放入事件队列，读取失败时关闭队列并通知链接关闭
+func (c *wsClient) readMessageToQueue() {
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Errorf("%s read message failed, %v, message %s", c.Session(), err, string(message))
+			close(c.messageQueue)
+			c.closeChan <- err
+			return
+		}
+		c.messageQueue <- message
+	}
+}
+
+// readyHandler 针对ready返回的处理，需要记录 sessionID 等相关信息
+func (c *wsClient) readyHandler(message []byte) {
+	readyData := &dto.WSReadyData{}
+	if err := parseData(message, readyData); err != nil {
+		log.Errorf("%s parseReadyData failed, %v, message %v", c.Session(), err, message)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session.ID = readyData.SessionID
+	if len(readyData.Shard) == 2 {
+		c.session.Shards.ShardID = readyData.Shard[0]
+		c.session.Shards.ShardCount = readyData.Shard[1]
+	}
+}
+
+// writeSeq 记录最新的seq
+func (c *wsClient) writeSeq(seq uint32) {
+	if seq == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.session.LastSeq = seq
+	c.mu.Unlock()
+}
+
+// closeError 关闭链接的错误，与botgo默认的ws实现一样转换为sdk错误码，同时保留 *websocket.CloseError，
+// errors.As 既可以取到 *errs.Err，也可以取到 *websocket.CloseError
+type closeError struct {
+	sdkErr   *errs.Err
+	closeErr error
+}
+
+// newCloseError 使用错误码code包装关闭链接的错误
+func newCloseError(code int, err error) error {
+	return &closeError{sdkErr: errs.Error(errs.New(code, err.Error())), closeErr: err}
+}
+
+// Error 与botgo默认的ws实现返回的错误信息一致
+func (e *closeError) Error() string {
+	return e.sdkErr.Error()
+}
+
+// Unwrap 返回原始的关闭错误
+func (e *closeError) Unwrap() error {
+	return e.closeErr
+}
+
+// As 支持通过 errors.As 获取sdk错误
+func (e *closeError) As(target interface{}) bool {
+	if t, ok := target.(**errs.Err); ok {
+		*t = e.sdkErr
+		return true
+	}
+	return false
+}
+
+// parseAndHandle 解析事件并投递给业务注册的handler，与botgo默认的ws实现一致：
+// 已知类型的事件投递给对应类型的handler，其余事件投递给透传handler
+func parseAndHandle(event *dto.WSPayload, message []byte) error {
+	h := websocket.DefaultHandlers
+	if event.OPCode == dto.WSDispatchEvent {
+		switch event.Type {
+		case dto.EventGuildCreate, dto.EventGuildUpdate, dto.EventGuildDelete:
+			data := &dto.WSGuildData{}
+			return handleData(message, data, h.Guild != nil, func() error { return h.Guild(event, data) })
+		case dto.EventChannelCreate, dto.EventChannelUpdate, dto.EventChannelDelete:
+			data := &dto.WSChannelData{}
+			return handleData(message, data, h.Channel != nil, func() error { return h.Channel(event, data) })
+		case dto.EventGuildMemberAdd, dto.EventGuildMemberUpdate, dto.EventGuildMemberRemove:
+			data := &dto.WSGuildMemberData{}
+			return handleData(message, data, h.GuildMember != nil, func() error { return h.GuildMember(event, data) })
+		case dto.EventMessageCreate:
+			data := &dto.WSMessageData{}
+			return handleData(message, data, h.Message != nil, func() error { return h.Message(event, data) })
+		case dto.EventMessageReactionAdd, dto.EventMessageReactionRemove:
+			data := &dto.WSMessageReactionData{}
+			return handleData(message, data, h.MessageReaction != nil,
+				func() error { return h.MessageReaction(event, data) })
+		case dto.EventAtMessageCreate:
+			data := &dto.WSATMessageData{}
+			return handleData(message, data, h.ATMessage != nil, func() error { return h.ATMessage(event, data) })
+		case dto.EventDirectMessageCreate:
+			data := &dto.WSDirectMessageData{}
+			return handleData(message, data, h.DirectMessage != nil,
+				func() error { return h.DirectMessage(event, data) })
+		case dto.EventAudioStart, dto.EventAudioFinish, dto.EventAudioOnMic, dto.EventAudioOffMic:
+			data := &dto.WSAudioData{}
+			return handleData(message, data, h.Audio != nil, func() error { return h.Audio(event, data) })
+		}
+	}
+	// 透传handler，如果未注册具体类型的 handler，会统一投递到这个 handler
+	if h.Plain != nil {
+		return h.Plain(event, message)
+	}
+	return nil
+}
+
+// handleData 解析事件数据到data，registered为true时调用handle投递给业务
+func handleData(message []byte, data interface{}, registered bool, handle func() error) error {
+	if err := parseData(message, data); err != nil {
+		return err
+	}
+	if !registered {
+		return nil
+	}
+	return handle()
+}
+
+// parseData 解析消息中的事件数据
+func parseData(message []byte, target interface{}) error {
+	payload := struct {
+		Data json.RawMessage `json:"d"`
+	}{}
+	if err := json.Unmarshal(message, &payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload.Data, target)
+}
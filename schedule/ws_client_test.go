@@ -0,0 +1,190 @@
+package schedule
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	wss "github.com/gorilla/websocket"
+	"github.com/tencent-connect/botgo-plugins/cluster/base"
+	"github.com/tencent-connect/botgo/dto"
+	"github.com/tencent-connect/botgo/token"
+	"github.com/tencent-connect/botgo/websocket"
+	"github.com/tencent-connect/botgo/websocket/client"
+)
+
+// startGateway 启动模拟的gateway，建立链接后发送hello并等待鉴权，再交给serve处理，返回ws地址
+func startGateway(t *testing.T, serve func(conn *wss.Conn)) string {
+	t.Helper()
+	upgrader := wss.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteJSON(&dto.WSPayload{
+			WSPayloadBase: dto.WSPayloadBase{OPCode: dto.WSHello},
+			Data:          &dto.WSHelloData{HeartbeatInterval: 60000},
+		})
+		// 等待identify或者resume
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dispatch 发送一个事件
+func dispatch(conn *wss.Conn, seq uint32, eventType dto.EventType, data interface{}) {
+	_ = conn.WriteJSON(&dto.WSPayload{
+		WSPayloadBase: dto.WSPayloadBase{OPCode: dto.WSDispatchEvent, Seq: seq, Type: eventType},
+		Data:          data,
+	})
+}
+
+// closeConn 使用关闭码code关闭链接
+func closeConn(conn *wss.Conn, code int) {
+	_ = conn.WriteMessage(wss.CloseMessage, wss.FormatCloseMessage(code, ""))
+	// 等待对端关闭
+	_, _, _ = conn.ReadMessage()
+}
+
+func Test_wsClient_Listening(t *testing.T) {
+	url := startGateway(t, func(conn *wss.Conn) {
+		dispatch(conn, 1, "READY", &dto.WSReadyData{SessionID: "sid", Shard: []uint32{1, 2}})
+		dispatch(conn, 2, dto.EventGuildCreate, &dto.WSGuildData{ID: "guild"})
+		dispatch(conn, 3, "UNKNOWN_EVENT", nil)
+		closeConn(conn, 4009)
+	})
+	ws := (&wsClient{}).New(dto.Session{URL: url, Shards: dto.ShardConfig{ShardID: 1, ShardCount: 2}})
+	type dispatched struct {
+		id  string
+		seq uint32
+	}
+	var got []dispatched
+	ws.(dispatchNotifier).setDispatchHook(func(sessionID string, seq uint32) {
+		got = append(got, dispatched{sessionID, seq})
+	})
+	if err := ws.Connect(); err != nil {
+		t.Fatalf("wsClient.Connect() error = %v", err)
+	}
+	if err := ws.Identify(); err != nil {
+		t.Fatalf("wsClient.Identify() error = %v", err)
+	}
+	err := ws.Listening()
+	if !wss.IsCloseError(err, 4009) {
+		t.Errorf("wsClient.Listening() error = %v, want close 4009", err)
+	}
+	// Listening返回前已经处理完所有事件
+	want := []dispatched{{"sid", 1}, {"sid", 2}, {"sid", 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dispatch hook got %v, want %v", got, want)
+	}
+	if s := ws.Session(); s.ID != "sid" || s.LastSeq != 3 {
+		t.Errorf("wsClient.Session() = %+v", s)
+	}
+}
+
+func Test_wsClient_Listening_canNotIdentify(t *testing.T) {
+	url := startGateway(t, func(conn *wss.Conn) {
+		closeConn(conn, 4914)
+	})
+	ws := (&wsClient{}).New(dto.Session{URL: url})
+	if err := ws.Connect(); err != nil {
+		t.Fatalf("wsClient.Connect() error = %v", err)
+	}
+	_ = ws.Identify()
+	if err := ws.Listening(); !CanNotIdentify(err) {
+		t.Errorf("wsClient.Listening() error = %v, want can not identify", err)
+	}
+}
+
+func Test_sessionHolder_saveOnDispatch(t *testing.T) {
+	ctx := context.Background()
+	saved := make(chan struct{})
+	release := make(chan struct{})
+	url := startGateway(t, func(conn *wss.Conn) {
+		dispatch(conn, 1, "READY", &dto.WSReadyData{SessionID: "sid", Shard: []uint32{1, 2}})
+		dispatch(conn, 5, dto.EventGuildCreate, &dto.WSGuildData{ID: "guild"})
+		// 链接保持期间检查保存的seq
+		<-saved
+		<-release
+		closeConn(conn, 4009)
+	})
+	store := base.NewMemorySessionStore()
+	mgr := NewSessionManager(ctx, &token.Token{}, &testIntent, &shardInfo{
+		shardIDs: []uint32{1},
+		shardNum: 2,
+		ap:       &dto.WebsocketAP{URL: url, Shards: 2},
+	})
+	mgr.store = store
+	mgr.limiter = nil
+	holder := mgr.newHolder(1)
+	ws := (&wsClient{}).New(holder.session)
+	var once sync.Once
+	ws.(dispatchNotifier).setDispatchHook(func(sessionID string, seq uint32) {
+		holder.saveSession(sessionID, seq)
+		if seq == 5 {
+			once.Do(func() { close(saved) })
+		}
+	})
+	holder.ws = ws
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		holder.connectAndListen()
+	}()
+	select {
+	case <-saved:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("dispatch not saved")
+	}
+	want := &base.Session{ShardID: 1, ShardCount: 2, SessionID: "sid", LastSeq: 5}
+	if got, _ := store.LoadSession(ctx, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("saved session while listening = %+v, want %+v", got, want)
+	}
+	if got := holder.getStatus(); got.SessionID != "sid" || got.LastSeq != 5 {
+		t.Errorf("sessionHolder.getStatus() while listening = %+v", got)
+	}
+	close(release)
+	<-done
+	if holder.session.ID != "sid" || holder.session.LastSeq != 5 {
+		t.Errorf("connectAndListen() session not synced: %+v", holder.session)
+	}
+}
+
+func Test_IsInvalidAuth_gateway(t *testing.T) {
+	url := startGateway(t, func(conn *wss.Conn) {
+		closeConn(conn, 4004)
+	})
+	tests := []struct {
+		name string
+		ws   websocket.WebSocket
+	}{
+		{name: "wsClient", ws: &wsClient{}},
+		// botgo默认的ws实现将关闭错误转换为错误码，只保留错误信息
+		{name: "botgo client", ws: &client.Client{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := tt.ws.New(dto.Session{URL: url})
+			if err := ws.Connect(); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			_ = ws.Identify()
+			err := ws.Listening()
+			if !IsInvalidAuth(err) || !canNotResume(err) || CanNotIdentify(err) {
+				t.Errorf("Listening() error = %v, IsInvalidAuth = %v, canNotResume = %v, CanNotIdentify = %v",
+					err, IsInvalidAuth(err), canNotResume(err), CanNotIdentify(err))
+			}
+		})
+	}
+}